@@ -0,0 +1,88 @@
+package godb
+
+import (
+  "fmt"
+  "context"
+  "database/sql"
+  "database/sql/driver"
+)
+
+// A connector which opens connections with a driver and a DSN. This is what
+// database/sql does for drivers which do not implement driver.DriverContext.
+type dsnConnector struct {
+  dsn     string
+  driver  driver.Driver
+}
+
+func (c dsnConnector) Connect(_ context.Context) (driver.Conn, error) {
+  return c.driver.Open(c.dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+  return c.driver
+}
+
+// A connector which executes a set of statements on every new connection
+type onConnectConnector struct {
+  driver.Connector
+  stmts []string
+}
+
+// Create a connector for the named driver which executes the provided statements
+// on every new connection it opens.
+func newOnConnectConnector(name, dsn string, stmts []string) (driver.Connector, error) {
+  db, err := sql.Open(name, dsn) // this just resolves the driver, no connection is made
+  if err != nil {
+    return nil, err
+  }
+  d := db.Driver()
+  db.Close()
+  
+  var c driver.Connector
+  if x, ok := d.(driver.DriverContext); ok {
+    c, err = x.OpenConnector(dsn)
+    if err != nil {
+      return nil, err
+    }
+  }else{
+    c = dsnConnector{dsn, d}
+  }
+  
+  return onConnectConnector{c, stmts}, nil
+}
+
+func (c onConnectConnector) Connect(ctx context.Context) (driver.Conn, error) {
+  conn, err := c.Connector.Connect(ctx)
+  if err != nil {
+    return nil, err
+  }
+  for _, e := range c.stmts {
+    err = execConn(ctx, conn, e)
+    if err != nil {
+      conn.Close()
+      return nil, fmt.Errorf("Could not execute on-connect statement (%s): %v", e, err)
+    }
+  }
+  return conn, nil
+}
+
+// Execute a statement directly on a driver connection
+func execConn(ctx context.Context, conn driver.Conn, q string) error {
+  if x, ok := conn.(driver.ExecerContext); ok {
+    _, err := x.ExecContext(ctx, q, nil)
+    if err != driver.ErrSkip {
+      return err
+    }
+  }
+  stmt, err := conn.Prepare(q)
+  if err != nil {
+    return err
+  }
+  defer stmt.Close()
+  if x, ok := stmt.(driver.StmtExecContext); ok {
+    _, err = x.ExecContext(ctx, nil)
+  }else{
+    _, err = stmt.Exec(nil)
+  }
+  return err
+}
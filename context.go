@@ -1,7 +1,8 @@
 package godb
 
 import (
-  "fmt"
+  "time"
+  "context"
   "database/sql"
 )
 
@@ -14,35 +15,141 @@ type Context interface {
   Exec(query string, args ...interface{})(sql.Result, error)
   Query(query string, args ...interface{})(*sql.Rows, error)
   QueryRow(query string, args ...interface{})(*sql.Row)
+  ExecContext(ctx context.Context, query string, args ...interface{})(sql.Result, error)
+  QueryContext(ctx context.Context, query string, args ...interface{})(*sql.Rows, error)
+  QueryRowContext(ctx context.Context, query string, args ...interface{})(*sql.Row)
+}
+
+// Implemented by contexts which wrap another context
+type Wrapper interface {
+  Unwrap()(Context)
+}
+
+// A context which binds a context.Context to an underlying execution context.
+// Statements executed without an explicit context.Context use the bound one, so
+// cancellation and deadlines reach code that only knows about Context.
+type boundContext struct {
+  ctx context.Context
+  cxt Context
+}
+
+// Bind a context.Context to an execution context. If the provided context.Context
+// is nil the execution context is returned as-is.
+func BindContext(ctx context.Context, cxt Context) Context {
+  if ctx == nil || cxt == nil {
+    return cxt
+  }
+  if b, ok := cxt.(boundContext); ok {
+    cxt = b.cxt
+  }
+  return boundContext{ctx, cxt}
+}
+
+// Obtain the context.Context bound to an execution context, if any. When no
+// context.Context is bound, context.Background() is returned.
+func ContextFrom(cxt Context) context.Context {
+  switch c := cxt.(type) {
+    case boundContext:
+      return c.ctx
+    case DebugContext:
+      return ContextFrom(c.cxt)
+    case InstrumentedContext:
+      return ContextFrom(c.cxt)
+    case SlowQueryContext:
+      return ContextFrom(c.cxt)
+    default:
+      return context.Background()
+  }
+}
+
+// Implement Wrapper
+func (b boundContext) Unwrap() Context {
+  return b.cxt
+}
+
+func (b boundContext) Exec(query string, args ...interface{}) (sql.Result, error) {
+  return b.cxt.ExecContext(b.ctx, query, args...)
+}
+
+func (b boundContext) Query(query string, args ...interface{}) (*sql.Rows, error) {
+  return b.cxt.QueryContext(b.ctx, query, args...)
+}
+
+func (b boundContext) QueryRow(query string, args ...interface{}) *sql.Row {
+  return b.cxt.QueryRowContext(b.ctx, query, args...)
+}
+
+func (b boundContext) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+  return b.cxt.ExecContext(ctx, query, args...)
+}
+
+func (b boundContext) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+  return b.cxt.QueryContext(ctx, query, args...)
+}
+
+func (b boundContext) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+  return b.cxt.QueryRowContext(ctx, query, args...)
 }
 
 // A debug context which logs out statements
 type DebugContext struct{
   prefix  string
   cxt     Context
+  log     Logger
 }
 
 // Create a debug context
 func NewDebugContext(cxt Context) DebugContext {
-  return DebugContext{cxt:cxt}
+  return DebugContext{cxt:cxt, log:defaultLogger}
 }
 
 // Create a debug context
 func NewDebugContextWithPrefix(prefix string, cxt Context) DebugContext {
-  return DebugContext{prefix, cxt}
+  return DebugContext{prefix, cxt, defaultLogger}
+}
+
+// Create a debug context which logs to the provided logger
+func NewDebugContextWithLogger(prefix string, l Logger, cxt Context) DebugContext {
+  return DebugContext{prefix, cxt, loggerOrDefault(l)}
+}
+
+// Implement Wrapper
+func (d DebugContext) Unwrap() Context {
+  return d.cxt
+}
+
+// Log a statement
+func (d DebugContext) trace(ctx context.Context, op, query string, args []interface{}, start time.Time) {
+  d.log.Log(ctx, LevelDebug, op + d.prefix, Fields{
+    FieldStatement: text.CollapseSpaces(query),
+    FieldArgs:      args,
+    FieldDuration:  time.Since(start),
+  })
 }
 
 func (d DebugContext) Exec(query string, args ...interface{}) (sql.Result, error) {
-  fmt.Println("db/exec:"+ d.prefix, text.CollapseSpaces(query), args)
-  return d.cxt.Exec(query, args...)
+  return d.ExecContext(ContextFrom(d.cxt), query, args...)
 }
 
 func (d DebugContext) Query(query string, args ...interface{}) (*sql.Rows, error) {
-  fmt.Println("db/query/n:"+ d.prefix, text.CollapseSpaces(query), args)
-  return d.cxt.Query(query, args...)
+  return d.QueryContext(ContextFrom(d.cxt), query, args...)
 }
 
 func (d DebugContext) QueryRow(query string, args ...interface{}) *sql.Row {
-  fmt.Println("db/query/1:"+ d.prefix, text.CollapseSpaces(query), args)
-  return d.cxt.QueryRow(query, args...)
+  return d.QueryRowContext(ContextFrom(d.cxt), query, args...)
+}
+
+func (d DebugContext) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+  defer d.trace(ctx, "db/exec:", query, args, time.Now())
+  return d.cxt.ExecContext(ctx, query, args...)
+}
+
+func (d DebugContext) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+  defer d.trace(ctx, "db/query/n:", query, args, time.Now())
+  return d.cxt.QueryContext(ctx, query, args...)
+}
+
+func (d DebugContext) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+  defer d.trace(ctx, "db/query/1:", query, args, time.Now())
+  return d.cxt.QueryRowContext(ctx, query, args...)
 }
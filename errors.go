@@ -2,6 +2,10 @@ package godb
 
 import (
   "fmt"
+  "errors"
+  "context"
+  "database/sql"
+  "database/sql/driver"
 )
 
 import (
@@ -11,42 +15,346 @@ import (
 var (
   ErrNotFound       = fmt.Errorf("Not found")
   ErrTransient      = fmt.Errorf("Transient")
+  ErrNotPersisted   = fmt.Errorf("Not persisted")
   ErrImmutable      = fmt.Errorf("Immutable")
   ErrInconvertible  = fmt.Errorf("Inconvertible")
   ErrForbidden      = fmt.Errorf("Forbidden")
 	ErrInvalidEntity  = fmt.Errorf("Invalid Entity")
 )
 
+// Sentinels matched by database errors. Failures which may succeed if they are
+// retried also match ErrTransient.
+var (
+  ErrConstraint           = fmt.Errorf("Constraint violation")
+  ErrUniqueViolation      = fmt.Errorf("Unique violation")
+  ErrForeignKeyViolation  = fmt.Errorf("Foreign key violation")
+  ErrNotNullViolation     = fmt.Errorf("Not null violation")
+  ErrCheckViolation       = fmt.Errorf("Check violation")
+  ErrExclusionViolation   = fmt.Errorf("Exclusion violation")
+  ErrSerializationFailure = fmt.Errorf("Serialization failure")
+  ErrDeadlock             = fmt.Errorf("Deadlock detected")
+  ErrLockNotAvailable     = fmt.Errorf("Lock not available")
+  ErrQueryCanceled        = fmt.Errorf("Query canceled")
+  ErrConnection           = fmt.Errorf("Connection failure")
+)
+
 // Postgres errors from: https://github.com/lib/pq/blob/master/error.go#L78
 const (
   PG_ERROR_UNIQUE_VIOLATION       = "23505"
   PG_ERROR_FOREIGN_KEY_VIOLATION  = "23503"
+  PG_ERROR_NOT_NULL_VIOLATION     = "23502"
+  PG_ERROR_CHECK_VIOLATION        = "23514"
+  PG_ERROR_EXCLUSION_VIOLATION    = "23P01"
+  PG_ERROR_SERIALIZATION_FAILURE  = "40001"
+  PG_ERROR_DEADLOCK_DETECTED      = "40P01"
+  PG_ERROR_LOCK_NOT_AVAILABLE     = "55P03"
+  PG_ERROR_QUERY_CANCELED         = "57014"
 )
 
-// Is the error a Postgres unique violation?
-func IsUniqueViolation(e error) bool {
-  switch c := e.(type) {
-    case pq.Error:
-      return c.Code == PG_ERROR_UNIQUE_VIOLATION
-    case *pq.Error:
-      return c.Code == PG_ERROR_UNIQUE_VIOLATION
+// Postgres error classes
+const (
+  PG_CLASS_CONNECTION_EXCEPTION   = "08"
+  PG_CLASS_DATA_EXCEPTION         = "22"
+  PG_CLASS_INTEGRITY_VIOLATION    = "23"
+  PG_CLASS_TRANSACTION_ROLLBACK   = "40"
+  PG_CLASS_SYNTAX_OR_ACCESS       = "42"
+  PG_CLASS_INSUFFICIENT_RESOURCES = "53"
+  PG_CLASS_OBJECT_STATE           = "55"
+  PG_CLASS_OPERATOR_INTERVENTION  = "57"
+)
+
+// The kind of a database error
+type ErrorKind int
+const (
+  KindUnknown ErrorKind = iota
+  KindNotFound
+  KindUniqueViolation
+  KindForeignKeyViolation
+  KindNotNullViolation
+  KindCheckViolation
+  KindExclusionViolation
+  KindIntegrityViolation
+  KindDataException
+  KindSerializationFailure
+  KindDeadlock
+  KindTransactionRollback
+  KindSyntaxOrAccess
+  KindLockNotAvailable
+  KindObjectState
+  KindQueryCanceled
+  KindInsufficientResources
+  KindOperatorIntervention
+  KindConnection
+)
+
+var errorKindNames = map[ErrorKind]string{
+  KindUnknown:                "unknown",
+  KindNotFound:               "not_found",
+  KindUniqueViolation:        "unique_violation",
+  KindForeignKeyViolation:    "foreign_key_violation",
+  KindNotNullViolation:       "not_null_violation",
+  KindCheckViolation:         "check_violation",
+  KindExclusionViolation:     "exclusion_violation",
+  KindIntegrityViolation:     "integrity_constraint_violation",
+  KindDataException:          "data_exception",
+  KindSerializationFailure:   "serialization_failure",
+  KindDeadlock:               "deadlock_detected",
+  KindTransactionRollback:    "transaction_rollback",
+  KindSyntaxOrAccess:         "syntax_error_or_access_rule_violation",
+  KindLockNotAvailable:       "lock_not_available",
+  KindObjectState:            "object_not_in_prerequisite_state",
+  KindQueryCanceled:          "query_canceled",
+  KindInsufficientResources:  "insufficient_resources",
+  KindOperatorIntervention:   "operator_intervention",
+  KindConnection:             "connection_exception",
+}
+
+func (k ErrorKind) String() string {
+  if n, ok := errorKindNames[k]; ok {
+    return n
+  }else{
+    return fmt.Sprintf("kind(%d)", int(k))
+  }
+}
+
+// Is this kind a constraint violation?
+func (k ErrorKind) Constraint() bool {
+  switch k {
+    case KindUniqueViolation, KindForeignKeyViolation, KindNotNullViolation, KindCheckViolation, KindExclusionViolation, KindIntegrityViolation:
+      return true
     default:
       return false
   }
 }
 
-// Is the error a Postgres foreign key violation?
+// Is this kind a failure which may succeed if it is retried?
+func (k ErrorKind) Transient() bool {
+  switch k {
+    case KindSerializationFailure, KindDeadlock, KindTransactionRollback, KindLockNotAvailable, KindInsufficientResources, KindOperatorIntervention, KindConnection:
+      return true
+    default:
+      return false
+  }
+}
+
+// The sentinel matched by errors of a kind
+func (k ErrorKind) sentinel() error {
+  switch k {
+    case KindNotFound:
+      return ErrNotFound
+    case KindUniqueViolation:
+      return ErrUniqueViolation
+    case KindForeignKeyViolation:
+      return ErrForeignKeyViolation
+    case KindNotNullViolation:
+      return ErrNotNullViolation
+    case KindCheckViolation:
+      return ErrCheckViolation
+    case KindExclusionViolation:
+      return ErrExclusionViolation
+    case KindSerializationFailure:
+      return ErrSerializationFailure
+    case KindDeadlock:
+      return ErrDeadlock
+    case KindLockNotAvailable:
+      return ErrLockNotAvailable
+    case KindQueryCanceled:
+      return ErrQueryCanceled
+    case KindConnection:
+      return ErrConnection
+    default:
+      return nil
+  }
+}
+
+// A database error. Errors produced by the driver are classified by their kind
+// and annotated with the operation that failed. An error matches, via errors.Is,
+// the sentinel for its kind as well as ErrConstraint or ErrTransient where those
+// apply; the underlying driver error is available via errors.As.
+type Error struct {
+  Kind        ErrorKind
+  Op          string  // the operation that failed, e.g., "exec" or "query"
+  Code        string  // the SQLSTATE code, if the error originated in the database
+  Constraint  string
+  Table       string
+  Column      string
+  Cause       error
+}
+
+// Classify an error which occurred during the provided operation. If the error
+// is nil, nil is returned. If it is already a database error it is returned as-is.
+// Driver errors are classified as Postgres errors.
+func NewError(op string, err error) error {
+  return NewErrorWithDialect(Postgres, op, err)
+}
+
+// Classify an error which occurred during the provided operation, as with NewError,
+// with driver errors classified by the provided dialect.
+func NewErrorWithDialect(d Dialect, op string, err error) error {
+  if err == nil {
+    return nil
+  }
+  var x *Error
+  if errors.As(err, &x) {
+    return err
+  }
+  e := &Error{Kind:KindUnknown, Op:op, Cause:err}
+  if d.ClassifyError(e) {
+    return e
+  }
+  if errors.Is(err, sql.ErrNoRows) {
+    e.Kind = KindNotFound
+  }else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+    e.Kind = KindQueryCanceled
+  }else if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+    e.Kind = KindConnection
+  }
+  return e
+}
+
+// Classify an SQLSTATE error code
+func classifyCode(c string) ErrorKind {
+  switch c {
+    case PG_ERROR_UNIQUE_VIOLATION:
+      return KindUniqueViolation
+    case PG_ERROR_FOREIGN_KEY_VIOLATION:
+      return KindForeignKeyViolation
+    case PG_ERROR_NOT_NULL_VIOLATION:
+      return KindNotNullViolation
+    case PG_ERROR_CHECK_VIOLATION:
+      return KindCheckViolation
+    case PG_ERROR_EXCLUSION_VIOLATION:
+      return KindExclusionViolation
+    case PG_ERROR_SERIALIZATION_FAILURE:
+      return KindSerializationFailure
+    case PG_ERROR_DEADLOCK_DETECTED:
+      return KindDeadlock
+    case PG_ERROR_LOCK_NOT_AVAILABLE:
+      return KindLockNotAvailable
+    case PG_ERROR_QUERY_CANCELED:
+      return KindQueryCanceled
+  }
+  if len(c) < 2 {
+    return KindUnknown
+  }
+  switch c[:2] {
+    case PG_CLASS_CONNECTION_EXCEPTION:
+      return KindConnection
+    case PG_CLASS_DATA_EXCEPTION:
+      return KindDataException
+    case PG_CLASS_INTEGRITY_VIOLATION:
+      return KindIntegrityViolation
+    case PG_CLASS_TRANSACTION_ROLLBACK:
+      return KindTransactionRollback
+    case PG_CLASS_SYNTAX_OR_ACCESS:
+      return KindSyntaxOrAccess
+    case PG_CLASS_INSUFFICIENT_RESOURCES:
+      return KindInsufficientResources
+    case PG_CLASS_OBJECT_STATE:
+      return KindObjectState
+    case PG_CLASS_OPERATOR_INTERVENTION:
+      return KindOperatorIntervention
+  }
+  return KindUnknown
+}
+
+func (e *Error) Error() string {
+  s := "db"
+  if e.Op != "" {
+    s += "/"+ e.Op
+  }
+  s += fmt.Sprintf(": %v", e.Kind)
+  if e.Constraint != "" {
+    s += fmt.Sprintf(" (constraint %s)", e.Constraint)
+  }else if e.Column != "" {
+    s += fmt.Sprintf(" (column %s)", e.Column)
+  }
+  return s +": "+ e.Cause.Error()
+}
+
+func (e *Error) Unwrap() error {
+  return e.Cause
+}
+
+func (e *Error) Is(target error) bool {
+  switch target {
+    case ErrConstraint:
+      return e.Kind.Constraint()
+    case ErrTransient:
+      return e.Kind.Transient()
+  }
+  if s := e.Kind.sentinel(); s != nil {
+    return s == target
+  }
+  return false
+}
+
+// Obtain the underlying Postgres error, if any
+func pqError(e error) (*pq.Error, bool) {
+  var p *pq.Error
+  if errors.As(e, &p) {
+    return p, true
+  }
+  var v pq.Error
+  if errors.As(e, &v) {
+    return &v, true
+  }
+  return nil, false
+}
+
+// Determine the kind of an error. Unclassified Postgres driver errors are
+// classified by their SQLSTATE code.
+func errorKind(e error) ErrorKind {
+  var x *Error
+  if errors.As(e, &x) {
+    return x.Kind
+  }
+  if p, ok := pqError(e); ok {
+    return classifyCode(string(p.Code))
+  }
+  return KindUnknown
+}
+
+// Is the error a unique violation?
+func IsUniqueViolation(e error) bool {
+  return errorKind(e) == KindUniqueViolation
+}
+
+// Is the error a foreign key violation?
 func IsForeignKeyViolation(e error) bool {
-  switch c := e.(type) {
-    case pq.Error:
-      return c.Code == PG_ERROR_FOREIGN_KEY_VIOLATION
-    case *pq.Error:
-      return c.Code == PG_ERROR_FOREIGN_KEY_VIOLATION
+  return errorKind(e) == KindForeignKeyViolation
+}
+
+// Is the error a serialization failure?
+func IsSerializationFailure(e error) bool {
+  return errorKind(e) == KindSerializationFailure
+}
+
+// Is the error a deadlock?
+func IsDeadlock(e error) bool {
+  return errorKind(e) == KindDeadlock
+}
+
+// Is the error one which is retried by default: a serialization failure or a
+// deadlock? Unclassified Postgres driver errors are classified by their SQLSTATE
+// code.
+func IsRetryable(e error) bool {
+  switch errorKind(e) {
+    case KindSerializationFailure, KindDeadlock:
+      return true
     default:
       return false
   }
 }
 
+// Is the error one which may succeed if it is retried? This is the case for
+// exactly those errors which match ErrTransient: serialization failures, deadlocks
+// and other transaction rollbacks, unavailable locks, insufficient resources,
+// operator intervention and connection failures.
+func IsTransient(e error) bool {
+  return errorKind(e).Transient()
+}
+
 func ErrNotFoundInTable(table string) error {
 	return fmt.Errorf("Not found in table: %v", table)
-} 
+}
@@ -0,0 +1,141 @@
+package godb
+
+import (
+  "fmt"
+  "errors"
+  "context"
+  "testing"
+  "database/sql"
+  "database/sql/driver"
+)
+
+import (
+  "github.com/lib/pq"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestClassifyCode(t *testing.T) {
+  tests := []struct {
+    Code  string
+    Kind  ErrorKind
+  }{
+    {PG_ERROR_UNIQUE_VIOLATION, KindUniqueViolation},
+    {PG_ERROR_FOREIGN_KEY_VIOLATION, KindForeignKeyViolation},
+    {PG_ERROR_NOT_NULL_VIOLATION, KindNotNullViolation},
+    {PG_ERROR_CHECK_VIOLATION, KindCheckViolation},
+    {PG_ERROR_EXCLUSION_VIOLATION, KindExclusionViolation},
+    {PG_ERROR_SERIALIZATION_FAILURE, KindSerializationFailure},
+    {PG_ERROR_DEADLOCK_DETECTED, KindDeadlock},
+    {PG_ERROR_LOCK_NOT_AVAILABLE, KindLockNotAvailable},
+    {PG_ERROR_QUERY_CANCELED, KindQueryCanceled},
+    {"08006", KindConnection},
+    {"22012", KindDataException},
+    {"23000", KindIntegrityViolation},
+    {"40002", KindTransactionRollback},
+    {"42P01", KindSyntaxOrAccess},
+    {"53300", KindInsufficientResources},
+    {"55006", KindObjectState},
+    {"57P01", KindOperatorIntervention},
+    {"XX000", KindUnknown},
+    {"0", KindUnknown},
+    {"", KindUnknown},
+  }
+  for _, e := range tests {
+    assert.Equal(t, e.Kind, classifyCode(e.Code), e.Code)
+  }
+}
+
+func TestErrorIs(t *testing.T) {
+  tests := []struct {
+    Kind        ErrorKind
+    Sentinel    error
+    Constraint  bool
+    Transient   bool
+  }{
+    {KindNotFound, ErrNotFound, false, false},
+    {KindUniqueViolation, ErrUniqueViolation, true, false},
+    {KindForeignKeyViolation, ErrForeignKeyViolation, true, false},
+    {KindNotNullViolation, ErrNotNullViolation, true, false},
+    {KindCheckViolation, ErrCheckViolation, true, false},
+    {KindExclusionViolation, ErrExclusionViolation, true, false},
+    {KindIntegrityViolation, nil, true, false},
+    {KindDataException, nil, false, false},
+    {KindSerializationFailure, ErrSerializationFailure, false, true},
+    {KindDeadlock, ErrDeadlock, false, true},
+    {KindTransactionRollback, nil, false, true},
+    {KindLockNotAvailable, ErrLockNotAvailable, false, true},
+    {KindInsufficientResources, nil, false, true},
+    {KindOperatorIntervention, nil, false, true},
+    {KindConnection, ErrConnection, false, true},
+    {KindQueryCanceled, ErrQueryCanceled, false, false},
+    {KindUnknown, nil, false, false},
+  }
+  for _, e := range tests {
+    err := fmt.Errorf("wrapped: %w", &Error{Kind:e.Kind, Op:"exec", Cause:errors.New("Cause")})
+    if e.Sentinel != nil {
+      assert.True(t, errors.Is(err, e.Sentinel), e.Kind.String())
+    }
+    assert.Equal(t, e.Constraint, errors.Is(err, ErrConstraint), e.Kind.String())
+    assert.Equal(t, e.Transient, errors.Is(err, ErrTransient), e.Kind.String())
+    assert.Equal(t, e.Transient, IsTransient(err), e.Kind.String())
+    assert.Equal(t, e.Kind == KindSerializationFailure || e.Kind == KindDeadlock, IsRetryable(err), e.Kind.String())
+  }
+}
+
+func TestNewErrorWithDialect(t *testing.T) {
+  assert.Nil(t, NewErrorWithDialect(Postgres, "exec", nil))
+  
+  tests := []struct {
+    Cause     error
+    Kind      ErrorKind
+    Sentinel  error
+  }{
+    {sql.ErrNoRows, KindNotFound, ErrNotFound},
+    {fmt.Errorf("scan: %w", sql.ErrNoRows), KindNotFound, ErrNotFound},
+    {driver.ErrBadConn, KindConnection, ErrConnection},
+    {sql.ErrConnDone, KindConnection, ErrConnection},
+    {context.Canceled, KindQueryCanceled, ErrQueryCanceled},
+    {context.DeadlineExceeded, KindQueryCanceled, ErrQueryCanceled},
+    {&pq.Error{Code:PG_ERROR_DEADLOCK_DETECTED}, KindDeadlock, ErrDeadlock},
+    {errors.New("Something else"), KindUnknown, nil},
+  }
+  for _, e := range tests {
+    err := NewErrorWithDialect(Postgres, "query", e.Cause)
+    var x *Error
+    if assert.True(t, errors.As(err, &x), e.Cause.Error()) {
+      assert.Equal(t, e.Kind, x.Kind, e.Cause.Error())
+      assert.Equal(t, "query", x.Op, e.Cause.Error())
+    }
+    assert.True(t, errors.Is(err, e.Cause), e.Cause.Error())
+    if e.Sentinel != nil {
+      assert.True(t, errors.Is(err, e.Sentinel), e.Cause.Error())
+    }
+  }
+  
+  // Postgres errors carry their details
+  err := NewErrorWithDialect(Postgres, "exec", &pq.Error{Code:PG_ERROR_UNIQUE_VIOLATION, Constraint:"users_email_key", Table:"users"})
+  var x *Error
+  if assert.True(t, errors.As(err, &x)) {
+    assert.Equal(t, KindUniqueViolation, x.Kind)
+    assert.Equal(t, PG_ERROR_UNIQUE_VIOLATION, x.Code)
+    assert.Equal(t, "users_email_key", x.Constraint)
+    assert.Equal(t, "users", x.Table)
+  }
+  assert.True(t, errors.Is(err, ErrConstraint))
+  
+  // errors which are already classified are not classified again
+  assert.Equal(t, err, NewErrorWithDialect(Postgres, "commit", err))
+  wrapped := fmt.Errorf("wrapped: %w", err)
+  assert.Equal(t, wrapped, NewErrorWithDialect(Postgres, "commit", wrapped))
+}
+
+func TestIsRetryable(t *testing.T) {
+  assert.True(t, IsRetryable(&pq.Error{Code:PG_ERROR_SERIALIZATION_FAILURE}))
+  assert.True(t, IsRetryable(&pq.Error{Code:PG_ERROR_DEADLOCK_DETECTED}))
+  assert.False(t, IsRetryable(&pq.Error{Code:PG_ERROR_LOCK_NOT_AVAILABLE}))
+  assert.False(t, IsRetryable(&pq.Error{Code:"08006"}))
+  assert.True(t, IsTransient(&pq.Error{Code:"08006"}))
+  assert.False(t, IsRetryable(&pq.Error{Code:PG_ERROR_UNIQUE_VIOLATION}))
+  assert.False(t, IsRetryable(errors.New("Something else")))
+  assert.False(t, IsRetryable(nil))
+}
@@ -0,0 +1,18 @@
+package godb
+
+import (
+  "time"
+)
+
+// Expose internals to tests in the godb_test package, which cannot be part of
+// this package since they depend on the test package, which depends on it.
+
+func (p RetryPolicy) Backoff(n int) time.Duration {
+  return p.backoff(n)
+}
+
+const ExplainHistoryMax = explainHistoryMax
+
+func (s SlowQueryContext) ShouldExplain(query string) bool {
+  return s.shouldExplain(query)
+}
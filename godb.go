@@ -3,6 +3,7 @@ package godb
 import (
   "fmt"
   "time"
+  "context"
   "net/url"
   "strings"
   "database/sql"
@@ -12,13 +13,11 @@ import (
 
 import (
 	_ "github.com/lib/pq"
-  
-  "github.com/bww/go-lru"
-  "github.com/bww/go-alert"
+
   "github.com/bww/go-upgrade"
   "github.com/bww/go-util/env"
   "github.com/bww/go-util/debug"
-  "github.com/bww/go-upgrade/driver/postgres"
+  "github.com/rcrowley/go-metrics"
 )
 
 const (
@@ -37,52 +36,137 @@ type TransactionHandler func(cxt Context)(error)
 
 // The store client
 type Database struct {
-  db      *sql.DB
-  cache   *lru.Cache
-  dbname  string
+  db          *sql.DB
+  replicas    *replicaSet
+  cache       *stmtCache
+  dbname      string
+  migrations  string
+  mtable      string
+  utable      string
+  dialect     Dialect
+  stats       *statsPublisher
+  log         Logger
+  tracer      Tracer
 }
 
 // Create a new store
 func New(uri string, migrate bool, syncer sync.Service) (*Database, error) {
+  return NewWithOptions(uri, Options{Migrate:migrate, Sync:syncer})
+}
+
+// Create a new store with options. Options which are not set explicitly may be
+// provided as query parameters in the URI.
+func NewWithOptions(uri string, opts Options) (*Database, error) {
+  
+  // extract options from the URI; explicit options take precedence
+  dsn, params, err := ParseOptions(uri)
+  if err != nil {
+    return nil, err
+  }
+  opts = opts.merge(params)
   
   // parse the URL for the scheme
-  u, err := url.Parse(uri)
+  u, err := url.Parse(dsn)
+  if err != nil {
+    return nil, err
+  }
+  
+  // determine the dialect and the driver data source
+  dialect := opts.Dialect
+  if dialect == nil {
+    dialect, err = dialectForScheme(u.Scheme)
+    if err != nil {
+      return nil, err
+    }
+  }
+  driver, source, err := dialect.DataSource(u)
   if err != nil {
     return nil, err
   }
   
   // note this here, since we don't want to log credentials
-  fmt.Printf("-----> Connecting to %v at: %v%v", strings.Title(u.Scheme), u.Host, u.Path)
-  if info := u.User; info != nil {
-    fmt.Printf(" (%s)\n", info.Username())
-  }else{
-    fmt.Println()
+  log := loggerOrDefault(opts.Logger)
+  if !opts.Quiet {
+    f := Fields{"host": u.Host, "database": u.Path}
+    if info := u.User; info != nil {
+      f["user"] = info.Username()
+    }
+    log.Log(context.Background(), LevelInfo, fmt.Sprintf("-----> Connecting to %v", strings.Title(u.Scheme)), f)
   }
   
   // open our database connection
-  db, err := sql.Open(u.Scheme, uri)
+  db, err := open(driver, source, dialect, opts)
   if err != nil {
-    return nil, fmt.Errorf("Could not open cache DB connection: %v", err)
+    return nil, err
   }
   
-  // params
-  db.SetMaxOpenConns(10)
-  db.SetMaxIdleConns(10)
+  // open replica connections
+  var replicas *replicaSet
+  if len(opts.Replicas) > 0 {
+    replicas, err = newReplicaSet(opts, dialect, log)
+    if err != nil {
+      db.Close()
+      return nil, err
+    }
+  }
+  
+  // resolve migration resources
+  migrations := opts.Migrations
+  if migrations == "" {
+    migrations = env.Etc("db")
+  }
+  
+  // setup our prepared statement cache
+  var cache *stmtCache
+  if n := opts.StatementCacheSize; n == 0 {
+    cache = newStmtCache(CACHE_ELEMENTS_DEFAULT)
+  }else if n > 0 {
+    cache = newStmtCache(n)
+  }
+  
+  // resolve the migration tables, for health checks
+  mtable := opts.MigrationTable
+  if mtable == "" {
+    mtable = MIGRATION_TABLE_DEFAULT
+  }
+  utable := opts.UpgradeTable
+  if utable == "" {
+    utable = UPGRADE_TABLE_DEFAULT
+  }
+  
+  // publish pool statistics
+  var stats *statsPublisher
+  if ival := opts.StatsInterval; ival >= 0 {
+    if ival == 0 {
+      ival = STATS_INTERVAL_DEFAULT
+    }
+    reg := opts.StatsRegistry
+    if reg == nil {
+      reg = metrics.DefaultRegistry
+    }
+    prefix := opts.StatsPrefix
+    if prefix == "" {
+      prefix = statsPrefix(u.Host, u.Path)
+    }
+    stats = newStatsPublisher(db, ival, reg, prefix)
+  }
   
   // setup our store
-  store := &Database{db, lru.New(CACHE_ELEMENTS_DEFAULT), u.Path}
+  store := &Database{db, replicas, cache, u.Path, migrations, mtable, utable, dialect, stats, log, tracerOrDefault(opts.Tracer, log)}
   
   // run migrations if necessary
-  if migrate {
-    if syncer == nil {
+  if opts.Migrate {
+    if opts.Sync == nil {
       panic("search: Cannot migrate without a synchronization service!")
     }
-    lock, err := syncer.Mutex(fmt.Sprintf("/godb/%s/db/postgres", env.Environ()))
+    lock, err := opts.Sync.Mutex(fmt.Sprintf("/godb/%s/db/postgres", env.Environ()))
     if err != nil {
+      store.Close()
       return nil, err
     }
     err = lock.Perform(store.migrate)
     if err != nil {
+      store.Close()
       return nil, err
     }
   }
@@ -90,15 +174,70 @@ func New(uri string, migrate bool, syncer sync.Service) (*Database, error) {
   return store, nil
 }
 
+// Open a database connection pool
+func open(driver, dsn string, dialect Dialect, opts Options) (*sql.DB, error) {
+  stmts, err := opts.onConnect(dialect)
+  if err != nil {
+    return nil, err
+  }
+  var db *sql.DB
+  if len(stmts) > 0 {
+    c, err := newOnConnectConnector(driver, dsn, stmts)
+    if err != nil {
+      return nil, fmt.Errorf("Could not open DB connection: %v", err)
+    }
+    db = sql.OpenDB(c)
+  }else{
+    var err error
+    db, err = sql.Open(driver, dsn)
+    if err != nil {
+      return nil, fmt.Errorf("Could not open DB connection: %v", err)
+    }
+  }
+  
+  if opts.MaxOpenConns != 0 {
+    db.SetMaxOpenConns(opts.MaxOpenConns)
+  }else{
+    db.SetMaxOpenConns(MAX_OPEN_CONNS_DEFAULT)
+  }
+  if opts.MaxIdleConns != 0 {
+    db.SetMaxIdleConns(opts.MaxIdleConns)
+  }else{
+    db.SetMaxIdleConns(MAX_IDLE_CONNS_DEFAULT)
+  }
+  if opts.ConnMaxLifetime > 0 {
+    db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+  }
+  if opts.ConnMaxIdleTime > 0 {
+    db.SetConnMaxIdleTime(opts.ConnMaxIdleTime)
+  }
+  
+  return db, nil
+}
+
+// Close the database, including any replica connections
+func (d *Database) Close() error {
+  if d.stats != nil {
+    d.stats.Close()
+  }
+  if d.cache != nil {
+    d.cache.Close()
+  }
+  if d.replicas != nil {
+    d.replicas.Close()
+  }
+  return d.db.Close()
+}
+
 // Migrate
 func (d *Database) migrate() error {
   
-  p, err := postgres.NewWithDB(d.db)
+  p, err := d.dialect.MigrationDriver(d.db)
   if err != nil {
     return err
   }
   
-  u, err := upgrade.New(upgrade.Config{Resources:env.Etc("db"), Driver:p})
+  u, err := upgrade.New(upgrade.Config{Resources:d.migrations, Driver:p})
   if err != nil {
     return err
   }
@@ -116,19 +255,78 @@ func (d *Database) Database() *sql.DB {
   return d.db
 }
 
+// Obtain the dialect
+func (d *Database) Dialect() Dialect {
+  return d.dialect
+}
+
+// Obtain the logger
+func (d *Database) Logger() Logger {
+  return d.log
+}
+
+// Set the logger
+func (d *Database) SetLogger(l Logger) {
+  d.log = loggerOrDefault(l)
+}
+
+// Obtain the tracer
+func (d *Database) Tracer() Tracer {
+  return d.tracer
+}
+
+// Set the tracer
+func (d *Database) SetTracer(t Tracer) {
+  d.tracer = tracerOrDefault(t, d.log)
+}
+
 // Implement Context
 func (d *Database) Exec(query string, args ...interface{}) (sql.Result, error) {
-  return d.db.Exec(query, args...)
+  return d.ExecContext(context.Background(), query, args...)
 }
 
-// Implement Context
+// Implement Context. The query is executed on the primary; use QueryContext with
+// WithReplica to allow a healthy replica to serve it.
 func (d *Database) Query(query string, args ...interface{}) (*sql.Rows, error) {
-  return d.db.Query(query, args...)
+  return d.QueryContext(context.Background(), query, args...)
 }
 
-// Implement Context
+// Implement Context. The query is executed on the primary; use QueryRowContext
+// with WithReplica to allow a healthy replica to serve it.
 func (d *Database) QueryRow(query string, args ...interface{}) *sql.Row {
-  return d.db.QueryRow(query, args...)
+  return d.QueryRowContext(context.Background(), query, args...)
+}
+
+// Implement Context. Failures are reported as *Error, which classifies the
+// underlying driver error.
+func (d *Database) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+  ctx, span := startStatement(ctx, d.tracer, "exec", query)
+  r, err := d.cache.exec(ctx, d.db, query, args)
+  err = NewErrorWithDialect(d.dialect, "exec", err)
+  span.Finish(err)
+  return r, err
+}
+
+// Implement Context. If replicas are configured and the context allows it, via
+// WithReplica, the query is executed on a healthy replica.
+func (d *Database) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+  ctx, span := startStatement(ctx, d.tracer, "query", query)
+  r, err := d.cache.query(ctx, d.reader(ctx), query, args)
+  err = NewErrorWithDialect(d.dialect, "query", err)
+  span.Finish(err)
+  return r, err
+}
+
+// Implement Context. If replicas are configured and the context allows it, via
+// WithReplica, the query is executed on a healthy replica.
+// 
+// A *sql.Row cannot carry a classified error, so the errors reported by its Err
+// and Scan methods are those of the driver. Use NewError to classify them.
+func (d *Database) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+  ctx, span := startStatement(ctx, d.tracer, "query", query)
+  r := d.cache.queryRow(ctx, d.reader(ctx), query, args)
+  span.Finish(NewErrorWithDialect(d.dialect, "query", r.Err()))
+  return r
 }
 
 // Begin a transaction
@@ -136,14 +334,58 @@ func (d *Database) Begin() (*sql.Tx, error) {
   return d.db.Begin()
 }
 
+// Begin a transaction which is rolled back if the provided context is canceled
+func (d *Database) BeginContext(ctx context.Context) (*sql.Tx, error) {
+  return d.db.BeginTx(ctx, nil)
+}
+
+// Begin a transaction with options. Deferrable is ignored unless the transaction
+// is serializable and read-only and the database is Postgres, the only case in
+// which it has any meaning.
+func (d *Database) BeginWithOptions(ctx context.Context, opts TxOptions) (*sql.Tx, error) {
+  tx, err := d.db.BeginTx(ctx, &sql.TxOptions{Isolation:opts.Isolation, ReadOnly:opts.ReadOnly})
+  if err != nil {
+    return nil, NewErrorWithDialect(d.dialect, "begin", err)
+  }
+  if opts.Deferrable && opts.Isolation == sql.LevelSerializable && opts.ReadOnly && d.dialect.Name() == DialectPostgres {
+    _, err = tx.ExecContext(ctx, "SET TRANSACTION DEFERRABLE")
+    if err != nil {
+      tx.Rollback()
+      return nil, NewErrorWithDialect(d.dialect, "begin", err)
+    }
+  }
+  return tx, nil
+}
+
 // Execute in a new transaction and commit or roll-back as necessary on completion
-// if the provided transation is nil. Otherwise, use the provided transaction and
-// assume it is managed externally.
+// if the provided transation is nil. If the provided context is a transaction, the
+// handler is executed in a savepoint within it so that a failure undoes only the
+// handler's work. Otherwise, use the provided context and assume it is managed
+// externally.
 func (d *Database) Atomic(cxt Context, h TransactionHandler) error {
+  return d.AtomicContext(ContextFrom(cxt), cxt, h)
+}
+
+// Execute atomically, as with Atomic, under the provided context.Context.
+func (d *Database) AtomicContext(ctx context.Context, cxt Context, h TransactionHandler) error {
+  return d.AtomicWithOptionsContext(ctx, cxt, TxOptions{}, h)
+}
+
+// Execute atomically, as with Atomic. If a new transaction is created it is
+// created with the provided options. Options do not apply when the handler is
+// executed within an existing transaction.
+func (d *Database) AtomicWithOptions(cxt Context, opts TxOptions, h TransactionHandler) error {
+  return d.AtomicWithOptionsContext(ContextFrom(cxt), cxt, opts, h)
+}
+
+// Execute atomically, as with AtomicWithOptions, under the provided context.Context.
+func (d *Database) AtomicWithOptionsContext(ctx context.Context, cxt Context, opts TxOptions, h TransactionHandler) error {
   if cxt == nil {
-    return d.Transaction(h)
+    return d.TransactionWithOptionsContext(ctx, opts, h)
+  }else if tx, ok := Transactional(cxt); ok {
+    return tx.Savepoint(ctx, h)
   }else{
-    return h(cxt)
+    return h(BindContext(ctx, cxt))
   }
 }
 
@@ -151,24 +393,69 @@ func (d *Database) Atomic(cxt Context, h TransactionHandler) error {
 // If the handler returns a non-nil error the transaction is rolled back, otherwise
 // the transaction is committed.
 func (d *Database) Transaction(h TransactionHandler) error {
+  return d.TransactionContext(context.Background(), h)
+}
+
+// Execute in a transaction, as with Transaction, under the provided context.Context.
+// The context the handler receives is bound to ctx, so statements it executes are
+// canceled along with it. If ctx is canceled the transaction is rolled back.
+// 
+// If ctx was obtained from a transaction context of this database, the handler is
+// executed in a savepoint within that transaction instead of a new transaction.
+func (d *Database) TransactionContext(ctx context.Context, h TransactionHandler) error {
+  return d.TransactionWithOptionsContext(ctx, TxOptions{}, h)
+}
+
+// Execute in a transaction with options, as with Transaction.
+func (d *Database) TransactionWithOptions(opts TxOptions, h TransactionHandler) error {
+  return d.TransactionWithOptionsContext(context.Background(), opts, h)
+}
+
+// Execute in a transaction with options, as with TransactionContext. Options do
+// not apply when the handler is executed in a savepoint within an existing
+// transaction.
+func (d *Database) TransactionWithOptionsContext(ctx context.Context, opts TxOptions, h TransactionHandler) error {
+  if tx := txFromContext(ctx); tx != nil && tx.db == d {
+    return tx.Savepoint(ctx, h)
+  }
+  if opts.Retry != nil {
+    return d.retry(ctx, *opts.Retry, opts, h)
+  }else{
+    return d.transaction(ctx, opts, h)
+  }
+}
+
+// Execute in a new transaction
+func (d *Database) transaction(ctx context.Context, opts TxOptions, h TransactionHandler) (err error) {
+  ctx, span := d.tracer.Start(ctx, "godb.transaction")
+  defer func() { span.Finish(err) }()
   
-  tx, err := d.Begin()
+  stx, err := d.BeginWithOptions(ctx, opts)
   if err != nil {
     return err
   }
   
-  cxt := Context(tx)
+  stmts := newStmtTxContext(stx, d.db, d.cache)
+  var cxt Context = stmts
   if debug.VERBOSE {
-    cxt = NewDebugContextWithPrefix(" <txn>", cxt)
+    cxt = NewDebugContextWithLogger(" <txn>", d.log, cxt)
   }
   
-  err = h(cxt)
+  tx := newTx(d, stx, cxt)
+  ctx = context.WithValue(ctx, txContextKey{}, tx)
+  err = h(BindContext(ctx, tx))
+  if err == nil {
+    err = tx.failure() // a savepoint could not be rolled back, so the transaction cannot be committed
+  }
   
   if err == nil {
-    err = tx.Commit()
-  }else if terr := tx.Rollback(); terr != nil {
-    alt.Errorf("store: Could not rollback transaction: %v", terr)
+    err = NewErrorWithDialect(d.dialect, "commit", stx.Commit())
+  }else if terr := stx.Rollback(); terr != nil {
+    d.log.Log(ctx, LevelError, "store: Could not rollback transaction", Fields{FieldError: terr})
   }
+  stmts.close()
+  tx.close()
+  tx.finish(err)
   
   return err
 }
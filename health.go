@@ -0,0 +1,217 @@
+package godb
+
+import (
+  "fmt"
+  "time"
+  "sync"
+  "context"
+  "strings"
+  "database/sql"
+)
+
+import (
+  "github.com/rcrowley/go-metrics"
+)
+
+const (
+  STATS_INTERVAL_DEFAULT    = time.Second * 10
+  MIGRATION_TABLE_DEFAULT   = "godb_migrations"
+  UPGRADE_TABLE_DEFAULT     = "schema_version"
+)
+
+// Pool statistic metric names, relative to the prefix of a database
+const (
+  poolOpenMetric          = "open"
+  poolInUseMetric         = "in_use"
+  poolIdleMetric          = "idle"
+  poolWaitCountMetric     = "wait.count"
+  poolWaitDurationMetric  = "wait.duration" // milliseconds
+)
+
+// The health of a read replica
+type ReplicaHealth struct {
+  Host    string
+  Healthy bool
+  Latency time.Duration // the time taken to query the replica's lag
+  Lag     time.Duration // the time since the replica last replayed a transaction from the primary
+  Error   error         // the reason the replica could not be checked, if any
+}
+
+// The health of a database
+type Health struct {
+  Latency   time.Duration // the time taken to ping the primary
+  Version   string        // the server version of the primary
+  Migration int64         // the highest applied migration version, or zero if none have been applied
+  Replicas  []ReplicaHealth
+  Stats     sql.DBStats   // connection pool statistics for the primary
+}
+
+// Verify that the primary is reachable
+func (d *Database) Ping(ctx context.Context) error {
+  return NewErrorWithDialect(d.dialect, "ping", d.db.PingContext(ctx))
+}
+
+// Check the health of the database, as with HealthContext
+func (d *Database) Health() (*Health, error) {
+  return d.HealthContext(context.Background())
+}
+
+// Check the health of the database. An error is returned if the primary cannot
+// be checked; replicas which cannot be checked are reported as unhealthy in the
+// result. The migration version is the highest version recorded by the migrate
+// package in the configured migration table or, if that table does not exist, by
+// go-upgrade in the configured upgrade table.
+func (d *Database) HealthContext(ctx context.Context) (*Health, error) {
+  h := &Health{}
+  
+  start := time.Now()
+  err := d.Ping(ctx)
+  if err != nil {
+    return nil, err
+  }
+  h.Latency = time.Since(start)
+  
+  err = d.db.QueryRowContext(ctx, d.dialect.Version()).Scan(&h.Version)
+  if err != nil {
+    return nil, NewErrorWithDialect(d.dialect, "health", err)
+  }
+  
+  h.Migration, err = d.migrationVersion(ctx)
+  if err != nil {
+    return nil, err
+  }
+  
+  if d.replicas != nil {
+    for _, e := range d.replicas.replicas {
+      h.Replicas = append(h.Replicas, e.health(ctx))
+    }
+  }
+  
+  h.Stats = d.db.Stats()
+  return h, nil
+}
+
+// Obtain the highest applied migration version from the migration table or, if
+// it does not exist, the upgrade table; or zero if neither exists
+func (d *Database) migrationVersion(ctx context.Context) (int64, error) {
+  for _, e := range []string{d.mtable, d.utable} {
+    var exists bool
+    err := d.db.QueryRowContext(ctx, d.dialect.TableExists(), e).Scan(&exists)
+    if err != nil {
+      return 0, NewErrorWithDialect(d.dialect, "health", err)
+    }
+    if !exists {
+      continue
+    }
+    var v int64
+    err = d.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COALESCE(MAX(version), 0) FROM %s", e)).Scan(&v)
+    if err != nil {
+      return 0, NewErrorWithDialect(d.dialect, "health", err)
+    }
+    return v, nil
+  }
+  return 0, nil
+}
+
+// Check the health and replication lag of this replica. If the dialect cannot
+// measure replication lag, the replica is pinged instead and its lag is zero.
+func (r *replica) health(ctx context.Context) ReplicaHealth {
+  h := ReplicaHealth{Host:r.host}
+  start := time.Now()
+  lag, err := r.lag(ctx)
+  if err != nil {
+    h.Error = err
+    return h
+  }
+  h.Latency = time.Since(start)
+  h.Lag = lag
+  h.Healthy = r.isHealthy()
+  return h
+}
+
+// The default prefix of the pool statistics of a database, which is keyed by its
+// host and name, e.g., "godb.pool.localhost:5432.app."
+func statsPrefix(host, name string) string {
+  s := "godb.pool."
+  if host != "" {
+    s += host +"."
+  }
+  if name = strings.Trim(name, "/"); name != "" {
+    s += name +"."
+  }
+  return s
+}
+
+// Periodically publishes connection pool statistics as metrics
+type statsPublisher struct {
+  db            *sql.DB
+  reg           metrics.Registry
+  names         []string
+  open          metrics.Gauge
+  inUse         metrics.Gauge
+  idle          metrics.Gauge
+  waitCount     metrics.Gauge
+  waitDuration  metrics.Gauge
+  stop          chan struct{}
+  done          sync.WaitGroup
+}
+
+// Begin publishing statistics for the provided pool at the provided interval, as
+// gauges named with the provided prefix in the provided registry
+func newStatsPublisher(db *sql.DB, ival time.Duration, reg metrics.Registry, prefix string) *statsPublisher {
+  p := &statsPublisher{db:db, reg:reg, stop:make(chan struct{})}
+  p.open = p.gauge(prefix + poolOpenMetric)
+  p.inUse = p.gauge(prefix + poolInUseMetric)
+  p.idle = p.gauge(prefix + poolIdleMetric)
+  p.waitCount = p.gauge(prefix + poolWaitCountMetric)
+  p.waitDuration = p.gauge(prefix + poolWaitDurationMetric)
+  p.publish()
+  p.done.Add(1)
+  go p.run(ival)
+  return p
+}
+
+// Obtain a gauge, registering it if necessary
+func (p *statsPublisher) gauge(name string) metrics.Gauge {
+  p.names = append(p.names, name)
+  return p.reg.GetOrRegister(name, metrics.NewGauge).(metrics.Gauge)
+}
+
+// Publish statistics
+func (p *statsPublisher) publish() {
+  s := p.db.Stats()
+  p.open.Update(int64(s.OpenConnections))
+  p.inUse.Update(int64(s.InUse))
+  p.idle.Update(int64(s.Idle))
+  p.waitCount.Update(s.WaitCount)
+  p.waitDuration.Update(int64(s.WaitDuration / time.Millisecond))
+}
+
+// Publish statistics until stopped
+func (p *statsPublisher) run(ival time.Duration) {
+  defer p.done.Done()
+  t := time.NewTicker(ival)
+  defer t.Stop()
+  for {
+    select {
+      case <-p.stop:
+        return
+      case <-t.C:
+        p.publish()
+    }
+  }
+}
+
+// Stop publishing statistics and unregister the gauges
+func (p *statsPublisher) Close() {
+  select {
+    case <-p.stop:
+      return // already closed
+    default:
+      close(p.stop)
+  }
+  p.done.Wait()
+  for _, e := range p.names {
+    p.reg.Unregister(e)
+  }
+}
@@ -0,0 +1,109 @@
+package godb_test
+
+import (
+  "fmt"
+  "time"
+  "testing"
+  "database/sql/driver"
+  
+  "github.com/hirepurpose/godb"
+  "github.com/hirepurpose/godb/test"
+)
+
+import (
+  "github.com/rcrowley/go-metrics"
+  "github.com/stretchr/testify/assert"
+)
+
+// A fake database in which the provided tables exist, each recording the provided
+// migration version
+func newHealthDB(name string, tables map[string]int64) *test.FakeDB {
+  return test.NewFakeDB(name, func(q string, args []driver.Value) (*test.FakeResult, error) {
+    switch q {
+      case godb.Postgres.Version():
+        return &test.FakeResult{Rows:[][]driver.Value{{"16.2"}}}, nil
+      case godb.Postgres.TableExists():
+        _, ok := tables[args[0].(string)]
+        return &test.FakeResult{Rows:[][]driver.Value{{ok}}}, nil
+    }
+    for k, v := range tables {
+      if q == fmt.Sprintf("SELECT COALESCE(MAX(version), 0) FROM %s", k) {
+        return &test.FakeResult{Rows:[][]driver.Value{{v}}}, nil
+      }
+    }
+    return nil, fmt.Errorf("Unexpected statement: %s", q)
+  })
+}
+
+func TestHealth(t *testing.T) {
+  tests := []struct {
+    Tables    map[string]int64
+    Migration int64
+  }{
+    {map[string]int64{}, 0},
+    {map[string]int64{godb.MIGRATION_TABLE_DEFAULT: 7}, 7},
+    {map[string]int64{godb.UPGRADE_TABLE_DEFAULT: 12}, 12},
+    {map[string]int64{godb.MIGRATION_TABLE_DEFAULT: 7, godb.UPGRADE_TABLE_DEFAULT: 12}, 7},
+  }
+  for i, e := range tests {
+    f := newHealthDB(fmt.Sprintf("health_%d", i), e.Tables)
+    db, err := test.NewFakeDatabase(godb.Options{}, f)
+    if !assert.Nil(t, err, fmt.Sprint(err)) {
+      return
+    }
+    h, err := db.Health()
+    if assert.Nil(t, err, fmt.Sprint(err)) {
+      assert.Equal(t, "16.2", h.Version, fmt.Sprint(i))
+      assert.Equal(t, e.Migration, h.Migration, fmt.Sprint(i))
+      assert.Equal(t, 0, len(h.Replicas), fmt.Sprint(i)) // no replicas are configured
+    }
+    db.Close()
+  }
+}
+
+func TestHealthUpgradeTable(t *testing.T) {
+  f := newHealthDB("health_upgrade", map[string]int64{"upgrades": 3})
+  db, err := test.NewFakeDatabase(godb.Options{UpgradeTable:"upgrades"}, f)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  defer db.Close()
+  h, err := db.Health()
+  if assert.Nil(t, err, fmt.Sprint(err)) {
+    assert.Equal(t, int64(3), h.Migration)
+  }
+}
+
+func TestPoolStats(t *testing.T) {
+  reg := metrics.NewRegistry()
+  names := []string{"open", "in_use", "idle", "wait.count", "wait.duration"}
+  
+  // statistics of each database are published separately, keyed by host
+  a, err := test.NewFakeDatabase(godb.Options{StatsInterval:time.Hour, StatsRegistry:reg}, test.NewFakeDB("stats_a", nil))
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  b, err := test.NewFakeDatabase(godb.Options{StatsInterval:time.Hour, StatsRegistry:reg}, test.NewFakeDB("stats_b", nil))
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  c, err := test.NewFakeDatabase(godb.Options{StatsInterval:time.Hour, StatsRegistry:reg, StatsPrefix:"app.db."}, test.NewFakeDB("stats_c", nil))
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  for _, e := range names {
+    for _, p := range []string{"godb.pool.stats_a.", "godb.pool.stats_b.", "app.db."} {
+      _, ok := reg.Get(p + e).(metrics.Gauge)
+      assert.True(t, ok, p + e)
+    }
+  }
+  assert.Nil(t, reg.Get("godb.pool.open"))
+  
+  // and are unregistered when the database is closed
+  a.Close()
+  assert.Nil(t, reg.Get("godb.pool.stats_a.open"))
+  assert.NotNil(t, reg.Get("godb.pool.stats_b.open"))
+  b.Close()
+  c.Close()
+  assert.Nil(t, reg.Get("app.db.open"))
+}
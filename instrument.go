@@ -0,0 +1,299 @@
+package godb
+
+import (
+  "fmt"
+  "sort"
+  "sync"
+  "time"
+  "errors"
+  "regexp"
+  "context"
+  "strings"
+  "hash/fnv"
+  "database/sql"
+)
+
+import (
+  "github.com/rcrowley/go-metrics"
+)
+
+const (
+  STATEMENT_METRICS_MAX_DEFAULT = 1000
+  STATEMENT_OTHER               = "<other>"
+)
+
+var (
+  inListRegexp  = regexp.MustCompile(`(?i)\bIN\s*\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+  rowListRegexp = regexp.MustCompile(`(\(\s*\?(?:\s*,\s*\?)*\s*\))(?:\s*,\s*\(\s*\?(?:\s*,\s*\?)*\s*\))+`)
+)
+
+// Produce the fingerprint of a statement. Comments are removed, whitespace is
+// collapsed, literals and placeholders are replaced by '?', and IN-lists and
+// multi-row VALUES lists are collapsed so that statements which differ only in
+// their parameters share a fingerprint.
+func Fingerprint(query string) string {
+  var b strings.Builder
+  n := len(query)
+  space := false
+  for i := 0; i < n; {
+    c := query[i]
+    switch {
+      case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+        space = true
+        i++
+        continue
+      case c == '-' && i + 1 < n && query[i+1] == '-':
+        for i < n && query[i] != '\n' {
+          i++
+        }
+        space = true
+        continue
+      case c == '/' && i + 1 < n && query[i+1] == '*':
+        e := strings.Index(query[i+2:], "*/")
+        if e < 0 {
+          i = n
+        }else{
+          i += e + 4
+        }
+        space = true
+        continue
+    }
+    if space && b.Len() > 0 {
+      b.WriteByte(' ')
+    }
+    space = false
+    switch {
+      case c == '\'':
+        for i++; i < n; i++ {
+          if query[i] == '\'' {
+            if i + 1 < n && query[i+1] == '\'' {
+              i++ // escaped quote
+            }else{
+              break
+            }
+          }
+        }
+        i++
+        b.WriteByte('?')
+      case c == '"':
+        e := strings.IndexByte(query[i+1:], '"')
+        if e < 0 {
+          e = n - i - 1
+        }else{
+          e += 2
+        }
+        b.WriteString(query[i:i+e])
+        i += e
+      case c == '$' && i + 1 < n && isDigit(query[i+1]):
+        for i++; i < n && isDigit(query[i]); i++ {}
+        b.WriteByte('?')
+      case isDigit(c):
+        for ; i < n && (isDigit(query[i]) || query[i] == '.'); i++ {}
+        b.WriteByte('?')
+      case isIdent(c):
+        for ; i < n && (isIdent(query[i]) || isDigit(query[i])); i++ {
+          b.WriteByte(query[i])
+        }
+      default:
+        b.WriteByte(c)
+        i++
+    }
+  }
+  f := b.String()
+  f = inListRegexp.ReplaceAllString(f, "IN (...)")
+  f = rowListRegexp.ReplaceAllString(f, "$1, ...")
+  return f
+}
+
+// Determine if a byte is a decimal digit
+func isDigit(c byte) bool {
+  return c >= '0' && c <= '9'
+}
+
+// Determine if a byte may begin an identifier
+func isIdent(c byte) bool {
+  return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' || c >= 0x80
+}
+
+// Metrics for a single statement fingerprint
+type statementMetric struct {
+  name        string
+  fingerprint string
+  duration    metrics.Timer
+  errors      metrics.Counter
+}
+
+// Summary statistics for a statement fingerprint
+type StatementStats struct {
+  Fingerprint string
+  Count       int64
+  Errors      int64
+  Mean        time.Duration
+  P95         time.Duration
+  Max         time.Duration
+}
+
+// Per-statement metrics. Each distinct statement fingerprint is recorded as a
+// timer and an error counter in a go-metrics registry, under the names
+// 'godb.statement.<hash>.duration' and 'godb.statement.<hash>.errors', where
+// the hash identifies the fingerprint. To bound the number of metrics, once the
+// limit is reached further fingerprints are recorded together under STATEMENT_OTHER.
+type StatementMetrics struct {
+  sync.Mutex
+  registry  metrics.Registry
+  limit     int
+  stmts     map[string]*statementMetric
+}
+
+// Statement metrics recorded in the go-metrics default registry
+var DefaultStatementMetrics = NewStatementMetrics(metrics.DefaultRegistry, STATEMENT_METRICS_MAX_DEFAULT)
+
+// Create statement metrics which are recorded in the provided registry
+func NewStatementMetrics(r metrics.Registry, limit int) *StatementMetrics {
+  if limit < 1 {
+    limit = STATEMENT_METRICS_MAX_DEFAULT
+  }
+  return &StatementMetrics{registry:r, limit:limit, stmts:make(map[string]*statementMetric)}
+}
+
+// Obtain the metrics for a statement fingerprint, registering them if necessary
+func (s *StatementMetrics) metric(fp string) *statementMetric {
+  s.Lock()
+  defer s.Unlock()
+  if m, ok := s.stmts[fp]; ok {
+    return m
+  }
+  if len(s.stmts) >= s.limit {
+    fp = STATEMENT_OTHER
+    if m, ok := s.stmts[fp]; ok {
+      return m
+    }
+  }
+  h := fnv.New32a()
+  h.Write([]byte(fp))
+  name := fmt.Sprintf("godb.statement.%08x", h.Sum32())
+  m := &statementMetric{
+    name:         name,
+    fingerprint:  fp,
+    duration:     metrics.GetOrRegisterTimer(name +".duration", s.registry),
+    errors:       metrics.GetOrRegisterCounter(name +".errors", s.registry),
+  }
+  s.stmts[fp] = m
+  return m
+}
+
+// Record the execution of a statement
+func (s *StatementMetrics) Record(query string, d time.Duration, err error) {
+  m := s.metric(Fingerprint(query))
+  m.duration.Update(d)
+  if err != nil && !errors.Is(err, sql.ErrNoRows) {
+    m.errors.Inc(1)
+  }
+}
+
+// Obtain statistics for every recorded statement fingerprint
+func (s *StatementMetrics) Stats() []StatementStats {
+  s.Lock()
+  stmts := make([]*statementMetric, 0, len(s.stmts))
+  for _, e := range s.stmts {
+    stmts = append(stmts, e)
+  }
+  s.Unlock()
+  
+  stats := make([]StatementStats, len(stmts))
+  for i, e := range stmts {
+    t := e.duration.Snapshot()
+    stats[i] = StatementStats{
+      Fingerprint:  e.fingerprint,
+      Count:        t.Count(),
+      Errors:       e.errors.Count(),
+      Mean:         time.Duration(t.Mean()),
+      P95:          time.Duration(t.Percentile(0.95)),
+      Max:          time.Duration(t.Max()),
+    }
+  }
+  return stats
+}
+
+// Obtain statistics for the n statement fingerprints with the greatest mean
+// duration, slowest first
+func (s *StatementMetrics) Top(n int) []StatementStats {
+  stats := s.Stats()
+  sort.Slice(stats, func(i, j int) bool {
+    return stats[i].Mean > stats[j].Mean
+  })
+  if n >= 0 && n < len(stats) {
+    stats = stats[:n]
+  }
+  return stats
+}
+
+// Reset statement metrics, unregistering them from the registry
+func (s *StatementMetrics) Reset() {
+  s.Lock()
+  defer s.Unlock()
+  for _, e := range s.stmts {
+    s.registry.Unregister(e.name +".duration")
+    s.registry.Unregister(e.name +".errors")
+  }
+  s.stmts = make(map[string]*statementMetric)
+}
+
+// A context which records the duration and failures of every statement it
+// executes, keyed by statement fingerprint. The duration of a query is the time
+// taken to begin returning results, not to iterate them.
+type InstrumentedContext struct {
+  cxt     Context
+  metrics *StatementMetrics
+}
+
+// Create an instrumented context which records to DefaultStatementMetrics
+func NewInstrumentedContext(cxt Context) InstrumentedContext {
+  return InstrumentedContext{cxt, DefaultStatementMetrics}
+}
+
+// Create an instrumented context which records to the provided metrics
+func NewInstrumentedContextWithMetrics(m *StatementMetrics, cxt Context) InstrumentedContext {
+  if m == nil {
+    m = DefaultStatementMetrics
+  }
+  return InstrumentedContext{cxt, m}
+}
+
+// Implement Wrapper
+func (c InstrumentedContext) Unwrap() Context {
+  return c.cxt
+}
+
+func (c InstrumentedContext) Exec(query string, args ...interface{}) (sql.Result, error) {
+  return c.ExecContext(ContextFrom(c.cxt), query, args...)
+}
+
+func (c InstrumentedContext) Query(query string, args ...interface{}) (*sql.Rows, error) {
+  return c.QueryContext(ContextFrom(c.cxt), query, args...)
+}
+
+func (c InstrumentedContext) QueryRow(query string, args ...interface{}) *sql.Row {
+  return c.QueryRowContext(ContextFrom(c.cxt), query, args...)
+}
+
+func (c InstrumentedContext) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+  start := time.Now()
+  r, err := c.cxt.ExecContext(ctx, query, args...)
+  c.metrics.Record(query, time.Since(start), err)
+  return r, err
+}
+
+func (c InstrumentedContext) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+  start := time.Now()
+  r, err := c.cxt.QueryContext(ctx, query, args...)
+  c.metrics.Record(query, time.Since(start), err)
+  return r, err
+}
+
+func (c InstrumentedContext) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+  start := time.Now()
+  r := c.cxt.QueryRowContext(ctx, query, args...)
+  c.metrics.Record(query, time.Since(start), r.Err())
+  return r
+}
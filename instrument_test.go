@@ -0,0 +1,104 @@
+package godb
+
+import (
+  "fmt"
+  "time"
+  "errors"
+  "testing"
+  "database/sql"
+)
+
+import (
+  "github.com/rcrowley/go-metrics"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestFingerprint(t *testing.T) {
+  tests := []struct {
+    Query       string
+    Fingerprint string
+  }{
+    {"SELECT * FROM users", "SELECT * FROM users"},
+    {"  SELECT *\n\tFROM   users  ", "SELECT * FROM users"},
+    // literals and placeholders
+    {"SELECT * FROM users WHERE id = $1 AND age > 21", "SELECT * FROM users WHERE id = ? AND age > ?"},
+    {"SELECT * FROM users WHERE name = 'O''Brien' AND score = 1.5", "SELECT * FROM users WHERE name = ? AND score = ?"},
+    {"SELECT * FROM users WHERE name = ''", "SELECT * FROM users WHERE name = ?"},
+    {"SELECT * FROM users WHERE name = 'unterminated", "SELECT * FROM users WHERE name = ?"},
+    {`SELECT "user 1".id FROM "user 1"`, `SELECT "user 1".id FROM "user 1"`},
+    {"SELECT * FROM table2 WHERE col_3 = 3", "SELECT * FROM table2 WHERE col_3 = ?"},
+    // IN-lists
+    {"SELECT * FROM users WHERE id IN ($1, $2, $3)", "SELECT * FROM users WHERE id IN (...)"},
+    {"SELECT * FROM users WHERE id in (1,2)", "SELECT * FROM users WHERE id IN (...)"},
+    {"SELECT * FROM users WHERE id IN ($1)", "SELECT * FROM users WHERE id IN (...)"},
+    {"SELECT * FROM users WHERE name IN ('a', 'b')", "SELECT * FROM users WHERE name IN (...)"},
+    {"INSERT INTO t (a, b) VALUES ($1, $2), ($3, $4), ($5, $6)", "INSERT INTO t (a, b) VALUES (?, ?), ..."},
+    {"INSERT INTO t (a, b) VALUES ($1, $2)", "INSERT INTO t (a, b) VALUES (?, ?)"},
+    // comments
+    {"SELECT 1 -- a comment\nFROM users", "SELECT ? FROM users"},
+    {"/* leading */ SELECT * FROM users /* trailing */", "SELECT * FROM users"},
+    {"SELECT * /* unterminated", "SELECT *"},
+    {"SELECT * FROM users --", "SELECT * FROM users"},
+  }
+  for _, e := range tests {
+    assert.Equal(t, e.Fingerprint, Fingerprint(e.Query), e.Query)
+  }
+  
+  // statements which differ only in their parameters share a fingerprint
+  assert.Equal(t, Fingerprint("SELECT * FROM users WHERE id IN (1, 2)"), Fingerprint("SELECT * FROM users WHERE id IN ($1, $2, $3, $4)"))
+}
+
+func TestStatementMetrics(t *testing.T) {
+  r := metrics.NewRegistry()
+  m := NewStatementMetrics(r, 100)
+  
+  m.Record("SELECT * FROM a WHERE id = $1", time.Millisecond * 10, nil)
+  m.Record("SELECT * FROM a WHERE id = 5", time.Millisecond * 30, nil)
+  m.Record("SELECT * FROM b", time.Millisecond * 5, errors.New("Failed"))
+  m.Record("SELECT * FROM c", time.Millisecond * 50, sql.ErrNoRows)
+  m.Record("SELECT * FROM c", time.Millisecond * 50, fmt.Errorf("wrapped: %w", sql.ErrNoRows))
+  m.Record("SELECT * FROM c", time.Millisecond * 50, NewError("query", sql.ErrNoRows))
+  
+  stats := m.Top(-1)
+  if assert.Equal(t, 3, len(stats)) {
+    assert.Equal(t, "SELECT * FROM c", stats[0].Fingerprint)
+    assert.Equal(t, int64(3), stats[0].Count)
+    assert.Equal(t, int64(0), stats[0].Errors) // no rows is not a failure, however it is wrapped
+    assert.Equal(t, "SELECT * FROM a WHERE id = ?", stats[1].Fingerprint)
+    assert.Equal(t, int64(2), stats[1].Count)
+    assert.Equal(t, time.Millisecond * 20, stats[1].Mean)
+    assert.Equal(t, time.Millisecond * 30, stats[1].Max)
+    assert.Equal(t, "SELECT * FROM b", stats[2].Fingerprint)
+    assert.Equal(t, int64(1), stats[2].Errors)
+  }
+  
+  top := m.Top(2)
+  if assert.Equal(t, 2, len(top)) {
+    assert.Equal(t, "SELECT * FROM c", top[0].Fingerprint)
+    assert.Equal(t, "SELECT * FROM a WHERE id = ?", top[1].Fingerprint)
+  }
+  assert.Equal(t, 0, len(m.Top(0)))
+  assert.Equal(t, 3, len(m.Top(10)))
+  
+  m.Reset()
+  assert.Equal(t, 0, len(m.Stats()))
+  assert.Equal(t, 0, len(r.GetAll()))
+}
+
+func TestStatementMetricsLimit(t *testing.T) {
+  r := metrics.NewRegistry()
+  m := NewStatementMetrics(r, 2)
+  
+  m.Record("SELECT * FROM a", time.Millisecond, nil)
+  m.Record("SELECT * FROM b", time.Millisecond, nil)
+  m.Record("SELECT * FROM c", time.Millisecond, nil)
+  m.Record("SELECT * FROM d", time.Millisecond, nil)
+  m.Record("SELECT * FROM a", time.Millisecond, nil) // already recorded, so not grouped
+  
+  counts := make(map[string]int64)
+  for _, e := range m.Stats() {
+    counts[e.Fingerprint] = e.Count
+  }
+  assert.Equal(t, map[string]int64{"SELECT * FROM a": 2, "SELECT * FROM b": 1, STATEMENT_OTHER: 2}, counts)
+  assert.Equal(t, 6, len(r.GetAll())) // a timer and a counter for each
+}
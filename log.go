@@ -0,0 +1,119 @@
+package godb
+
+import (
+  "io"
+  "os"
+  "fmt"
+  "sort"
+  "context"
+  "strings"
+)
+
+import (
+  "github.com/bww/go-alert"
+)
+
+// Field names used in log records
+const (
+  FieldStatement  = "statement"
+  FieldArgs       = "args"
+  FieldDuration   = "duration"
+  FieldTable      = "table"
+  FieldEntity     = "entity"
+  FieldError      = "error"
+  FieldPlan       = "plan"
+)
+
+// A log level
+type Level int
+const (
+  LevelDebug Level = iota
+  LevelInfo
+  LevelWarn
+  LevelError
+)
+
+func (l Level) String() string {
+  switch l {
+    case LevelDebug:
+      return "debug"
+    case LevelInfo:
+      return "info"
+    case LevelWarn:
+      return "warn"
+    case LevelError:
+      return "error"
+    default:
+      return fmt.Sprintf("level(%d)", int(l))
+  }
+}
+
+// Structured log fields
+type Fields map[string]interface{}
+
+// A logger. The context.Context under which the logged activity occurred is
+// provided so implementations can include request-scoped values, such as
+// correlation identifiers, in their records.
+type Logger interface {
+  Log(ctx context.Context, level Level, msg string, fields Fields)
+}
+
+// The default logger writes records to standard output. Errors are additionally
+// reported via go-alert.
+var defaultLogger Logger = writerLogger{os.Stdout, true}
+
+// Obtain the default logger
+func DefaultLogger() Logger {
+  return defaultLogger
+}
+
+// A logger which discards everything
+type nopLogger struct {}
+
+// Create a logger which discards everything
+func NewNopLogger() Logger {
+  return nopLogger{}
+}
+
+func (l nopLogger) Log(ctx context.Context, level Level, msg string, fields Fields) {
+  // nothing
+}
+
+// A logger which writes formatted records to a writer
+type writerLogger struct {
+  w     io.Writer
+  alert bool
+}
+
+// Create a logger which writes formatted records to the provided writer
+func NewWriterLogger(w io.Writer) Logger {
+  return writerLogger{w, false}
+}
+
+func (l writerLogger) Log(ctx context.Context, level Level, msg string, fields Fields) {
+  s := &strings.Builder{}
+  s.WriteString(msg)
+  
+  keys := make([]string, 0, len(fields))
+  for k, _ := range fields {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+  for _, k := range keys {
+    fmt.Fprintf(s, " %s=%v", k, fields[k])
+  }
+  
+  fmt.Fprintln(l.w, s.String())
+  if l.alert && level >= LevelError {
+    alt.Errorf("%s", s.String())
+  }
+}
+
+// Resolve a logger, producing the default logger if the provided one is nil
+func loggerOrDefault(l Logger) Logger {
+  if l != nil {
+    return l
+  }else{
+    return defaultLogger
+  }
+}
@@ -0,0 +1,400 @@
+package migrate
+
+import (
+  "io"
+  "os"
+  "fmt"
+  "time"
+  "context"
+  "strings"
+  "io/fs"
+  
+  "github.com/hirepurpose/godb"
+  "github.com/hirepurpose/godb/sync"
+  "github.com/hirepurpose/godb/persist"
+)
+
+import (
+  "github.com/bww/go-util/env"
+)
+
+const (
+  TABLE_DEFAULT = godb.MIGRATION_TABLE_DEFAULT
+)
+
+var (
+  ErrModified     = fmt.Errorf("Applied migrations have been modified")
+  ErrUnknown      = fmt.Errorf("Applied migrations are unknown")
+  ErrIrreversible = fmt.Errorf("Migration is irreversible")
+)
+
+// Migrator options
+type Options struct {
+  Table   string        // the table in which applied migrations are recorded; defaults to TABLE_DEFAULT
+  Sync    sync.Service  // when provided, migrations are performed under a mutex
+  DryRun  bool          // write the SQL that would be executed to Output instead of executing it
+  Output  io.Writer     // the dry-run output; defaults to standard output
+  Logger  godb.Logger   // the logger; defaults to the database's logger
+}
+
+// A migrator applies and rolls back migrations on a database. Each migration is
+// applied in its own transaction, along with the record of it having been applied.
+type Migrator struct {
+  db          *godb.Database
+  migrations  []*Migration
+  table       string
+  sync        sync.Service
+  dryrun      bool
+  out         io.Writer
+  log         godb.Logger
+}
+
+// Create a migrator for the migrations in the root of a filesystem along with
+// registered Go migrations
+func New(db *godb.Database, fsys fs.FS) (*Migrator, error) {
+  return NewWithOptions(db, fsys, Options{})
+}
+
+// Create a migrator with options
+func NewWithOptions(db *godb.Database, fsys fs.FS, opts Options) (*Migrator, error) {
+  m, err := Load(fsys)
+  if err != nil {
+    return nil, err
+  }
+  m, err = merge(m, Registered())
+  if err != nil {
+    return nil, err
+  }
+  return NewWithMigrations(db, m, opts), nil
+}
+
+// Create a migrator for a set of migrations, which must be ordered by version
+func NewWithMigrations(db *godb.Database, m []*Migration, opts Options) *Migrator {
+  table := opts.Table
+  if table == "" {
+    table = TABLE_DEFAULT
+  }
+  out := opts.Output
+  if out == nil {
+    out = os.Stdout
+  }
+  log := opts.Logger
+  if log == nil {
+    log = db.Logger()
+  }
+  return &Migrator{db, m, table, opts.Sync, opts.DryRun, out, log}
+}
+
+// Obtain the migrations managed by this migrator, ordered by version
+func (m *Migrator) Migrations() []*Migration {
+  return m.migrations
+}
+
+// A record of an applied migration
+type Record struct {
+  Version   int64
+  Name      string
+  Checksum  string
+  AppliedAt time.Time
+  Modified  bool  // the migration has been modified since it was applied
+  Unknown   bool  // the migration is not among those managed by the migrator
+}
+
+// Migration status
+type Status struct {
+  Current int64         // the highest applied version, or zero if none have been applied
+  Applied []*Record     // applied migrations, ordered by version
+  Pending []*Migration  // migrations which have not been applied, ordered by version
+}
+
+// Determine if any applied migration has been modified
+func (s *Status) Modified() []*Record {
+  var r []*Record
+  for _, e := range s.Applied {
+    if e.Modified {
+      r = append(r, e)
+    }
+  }
+  return r
+}
+
+// Determine if any applied migration is unknown
+func (s *Status) Unknown() []*Record {
+  var r []*Record
+  for _, e := range s.Applied {
+    if e.Unknown {
+      r = append(r, e)
+    }
+  }
+  return r
+}
+
+// Obtain the status of migrations
+func (m *Migrator) Status(ctx context.Context) (*Status, error) {
+  recs, err := m.applied(ctx)
+  if err != nil {
+    return nil, err
+  }
+  
+  byver := make(map[int64]*Migration)
+  for _, e := range m.migrations {
+    byver[e.Version] = e
+  }
+  
+  s := &Status{Applied:recs}
+  done := make(map[int64]struct{})
+  for _, e := range recs {
+    if x, ok := byver[e.Version]; !ok {
+      e.Unknown = true
+    }else if x.Checksum != e.Checksum {
+      e.Modified = true
+    }
+    if e.Version > s.Current {
+      s.Current = e.Version
+    }
+    done[e.Version] = struct{}{}
+  }
+  for _, e := range m.migrations {
+    if _, ok := done[e.Version]; !ok {
+      s.Pending = append(s.Pending, e)
+    }
+  }
+  
+  return s, nil
+}
+
+// Apply every pending migration, returning the number applied
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+  var target int64
+  if n := len(m.migrations); n > 0 {
+    target = m.migrations[n - 1].Version
+  }
+  return m.UpTo(ctx, target)
+}
+
+// Apply pending migrations up to and including the target version, returning
+// the number applied. Migrations are not applied if any applied migration has
+// been modified.
+func (m *Migrator) UpTo(ctx context.Context, target int64) (int, error) {
+  var n int
+  err := m.perform(ctx, func(ctx context.Context) error {
+    var err error
+    n, err = m.up(ctx, target)
+    return err
+  })
+  return n, err
+}
+
+// Apply migrations
+func (m *Migrator) up(ctx context.Context, target int64) (int, error) {
+  s, err := m.Status(ctx)
+  if err != nil {
+    return 0, err
+  }
+  if x := s.Modified(); len(x) > 0 {
+    return 0, fmt.Errorf("%w: %s", ErrModified, versions(x))
+  }
+  
+  var n int
+  for _, e := range s.Pending {
+    if e.Version > target {
+      break
+    }
+    err = m.apply(ctx, e)
+    if err != nil {
+      return n, fmt.Errorf("Could not apply migration %v: %w", e, err)
+    }
+    n++
+  }
+  
+  return n, nil
+}
+
+// Roll back applied migrations with versions greater than the target version,
+// returning the number rolled back. Migrations are rolled back in descending
+// order. Rolling back fails before any migration is rolled back if one of them
+// is unknown or irreversible.
+func (m *Migrator) Down(ctx context.Context, target int64) (int, error) {
+  var n int
+  err := m.perform(ctx, func(ctx context.Context) error {
+    var err error
+    n, err = m.down(ctx, target)
+    return err
+  })
+  return n, err
+}
+
+// Roll back migrations
+func (m *Migrator) down(ctx context.Context, target int64) (int, error) {
+  s, err := m.Status(ctx)
+  if err != nil {
+    return 0, err
+  }
+  
+  byver := make(map[int64]*Migration)
+  for _, e := range m.migrations {
+    byver[e.Version] = e
+  }
+  
+  var revert []*Migration
+  for i := len(s.Applied) - 1; i >= 0; i-- {
+    r := s.Applied[i]
+    if r.Version <= target {
+      break
+    }
+    if r.Unknown {
+      return 0, fmt.Errorf("%w: %d", ErrUnknown, r.Version)
+    }
+    x := byver[r.Version]
+    if !x.Reversible() {
+      return 0, fmt.Errorf("%w: %v", ErrIrreversible, x)
+    }
+    revert = append(revert, x)
+  }
+  
+  var n int
+  for _, e := range revert {
+    err = m.revert(ctx, e)
+    if err != nil {
+      return n, fmt.Errorf("Could not roll back migration %v: %w", e, err)
+    }
+    n++
+  }
+  
+  return n, nil
+}
+
+// Apply a migration
+func (m *Migrator) apply(ctx context.Context, e *Migration) error {
+  if m.dryrun {
+    return m.plan(e, "up", e.Up)
+  }
+  err := m.db.TransactionContext(ctx, func(cxt godb.Context) error {
+    var err error
+    if e.IsFunc() {
+      err = e.UpFunc(cxt, persist.NewWithLogger(cxt, m.log))
+    }else{
+      _, err = cxt.Exec(e.Up)
+    }
+    if err != nil {
+      return err
+    }
+    d := godb.DialectOf(cxt)
+    _, err = cxt.Exec(fmt.Sprintf("INSERT INTO %s (version, name, checksum) VALUES (%s, %s, %s)", m.table, d.Placeholder(1), d.Placeholder(2), d.Placeholder(3)), e.Version, e.Name, e.Checksum)
+    return err
+  })
+  if err != nil {
+    return err
+  }
+  m.log.Log(ctx, godb.LevelInfo, "migrate: Applied migration", godb.Fields{"version": e.Version, "name": e.Name})
+  return nil
+}
+
+// Roll back a migration
+func (m *Migrator) revert(ctx context.Context, e *Migration) error {
+  if m.dryrun {
+    return m.plan(e, "down", e.Down)
+  }
+  err := m.db.TransactionContext(ctx, func(cxt godb.Context) error {
+    var err error
+    if e.IsFunc() {
+      err = e.DownFunc(cxt, persist.NewWithLogger(cxt, m.log))
+    }else{
+      _, err = cxt.Exec(e.Down)
+    }
+    if err != nil {
+      return err
+    }
+    _, err = cxt.Exec(fmt.Sprintf("DELETE FROM %s WHERE version = %s", m.table, godb.DialectOf(cxt).Placeholder(1)), e.Version)
+    return err
+  })
+  if err != nil {
+    return err
+  }
+  m.log.Log(ctx, godb.LevelInfo, "migrate: Rolled back migration", godb.Fields{"version": e.Version, "name": e.Name})
+  return nil
+}
+
+// Describe a migration in a dry run
+func (m *Migrator) plan(e *Migration, dir, sql string) error {
+  var err error
+  if e.IsFunc() {
+    _, err = fmt.Fprintf(m.out, "-- %v (%s)\n-- Go migration; statements are not known in advance\n", e, dir)
+  }else{
+    _, err = fmt.Fprintf(m.out, "-- %v (%s)\n%s\n", e, dir, strings.TrimSpace(sql))
+  }
+  return err
+}
+
+// Obtain applied migrations, ordered by version. The migration table is created
+// if it does not exist, except in a dry run.
+func (m *Migrator) applied(ctx context.Context) ([]*Record, error) {
+  if m.dryrun {
+    var exists bool
+    err := m.db.Primary().QueryRowContext(ctx, m.db.Dialect().TableExists(), m.table).Scan(&exists)
+    if err != nil {
+      return nil, err
+    }
+    if !exists {
+      return nil, nil
+    }
+  }else{
+    _, err := m.db.ExecContext(ctx, createTable(m.db.Dialect(), m.table))
+    if err != nil {
+      return nil, err
+    }
+  }
+  
+  rows, err := m.db.Primary().QueryContext(ctx, fmt.Sprintf("SELECT version, name, checksum, applied_at FROM %s ORDER BY version", m.table))
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  
+  var recs []*Record
+  for rows.Next() {
+    r := &Record{}
+    err = rows.Scan(&r.Version, &r.Name, &r.Checksum, &r.AppliedAt)
+    if err != nil {
+      return nil, err
+    }
+    recs = append(recs, r)
+  }
+  if err = rows.Err(); err != nil {
+    return nil, err
+  }
+  
+  return recs, nil
+}
+
+// Perform an operation, under a mutex if a synchronization service is available.
+// Waiting for the mutex is abandoned if the context is done, and the operation is
+// provided a context which is canceled if the mutex is lost.
+func (m *Migrator) perform(ctx context.Context, f func(context.Context) error) error {
+  if m.sync == nil {
+    return f(ctx)
+  }
+  lock, err := m.sync.Mutex(fmt.Sprintf("/godb/%s/db/migrate/%s", env.Environ(), m.table))
+  if err != nil {
+    return err
+  }
+  return lock.PerformContext(ctx, f)
+}
+
+// Format record versions
+func versions(r []*Record) string {
+  s := make([]string, len(r))
+  for i, e := range r {
+    s[i] = fmt.Sprint(e.Version)
+  }
+  return strings.Join(s, ", ")
+}
+
+// Produce the statement which creates the migration table
+func createTable(d godb.Dialect, table string) string {
+  if d.Name() == godb.DialectPostgres {
+    return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version BIGINT PRIMARY KEY, name TEXT NOT NULL, checksum TEXT NOT NULL, applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now())", table)
+  }else{
+    return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version BIGINT PRIMARY KEY, name TEXT NOT NULL, checksum TEXT NOT NULL, applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)", table)
+  }
+}
@@ -0,0 +1,266 @@
+package migrate
+
+import (
+  "fmt"
+  "sort"
+  "time"
+  "bytes"
+  "errors"
+  "context"
+  "strings"
+  "testing"
+  "testing/fstest"
+  "database/sql/driver"
+  
+  "github.com/hirepurpose/godb"
+  "github.com/hirepurpose/godb/test"
+  "github.com/hirepurpose/godb/sync/memory"
+)
+
+import (
+  "github.com/bww/go-util/env"
+  "github.com/stretchr/testify/assert"
+)
+
+// A migration table, maintained in memory by a fake database
+type fakeTable struct {
+  created bool
+  records map[int64]*Record
+}
+
+func newFakeTable() *fakeTable {
+  return &fakeTable{records:make(map[int64]*Record)}
+}
+
+// Record a migration as applied
+func (t *fakeTable) add(version int64, name, sum string) {
+  t.created = true
+  t.records[version] = &Record{Version:version, Name:name, Checksum:sum, AppliedAt:time.Now()}
+}
+
+// Handle statements which manage the migration table; other statements, such
+// as migrations, succeed without effect
+func (t *fakeTable) handle(q string, args []driver.Value) (*test.FakeResult, error) {
+  switch {
+    case q == godb.Postgres.TableExists():
+      return &test.FakeResult{Columns:[]string{"exists"}, Rows:[][]driver.Value{{t.created}}}, nil
+    case strings.HasPrefix(q, "CREATE TABLE IF NOT EXISTS "+ TABLE_DEFAULT):
+      t.created = true
+    case strings.HasPrefix(q, "INSERT INTO "+ TABLE_DEFAULT):
+      t.add(args[0].(int64), args[1].(string), args[2].(string))
+      return &test.FakeResult{RowsAffected:1}, nil
+    case strings.HasPrefix(q, "DELETE FROM "+ TABLE_DEFAULT):
+      delete(t.records, args[0].(int64))
+      return &test.FakeResult{RowsAffected:1}, nil
+    case strings.HasPrefix(q, "SELECT version, name, checksum, applied_at FROM "+ TABLE_DEFAULT):
+      var vers []int64
+      for k := range t.records {
+        vers = append(vers, k)
+      }
+      sort.Slice(vers, func(i, j int) bool { return vers[i] < vers[j] })
+      r := &test.FakeResult{Columns:[]string{"version", "name", "checksum", "applied_at"}}
+      for _, v := range vers {
+        e := t.records[v]
+        r.Rows = append(r.Rows, []driver.Value{e.Version, e.Name, e.Checksum, e.AppliedAt})
+      }
+      return r, nil
+  }
+  return nil, nil
+}
+
+// Create a migrator for a fake database along with the migrations it manages
+func newFakeMigrator(t *testing.T, name string, opts Options) (*Migrator, *test.FakeDB, *fakeTable) {
+  tbl := newFakeTable()
+  f := test.NewFakeDB(name, tbl.handle)
+  db, err := test.NewFakeDatabase(godb.Options{}, f)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    t.FailNow()
+  }
+  t.Cleanup(func() { db.Close() })
+  
+  m, err := NewWithOptions(db, fstest.MapFS{
+    "001_create_users.up.sql":   &fstest.MapFile{Data:[]byte("CREATE TABLE users (id TEXT PRIMARY KEY);")},
+    "001_create_users.down.sql": &fstest.MapFile{Data:[]byte("DROP TABLE users;")},
+    "002_add_email.up.sql":      &fstest.MapFile{Data:[]byte("ALTER TABLE users ADD email TEXT;")},
+    "002_add_email.down.sql":    &fstest.MapFile{Data:[]byte("ALTER TABLE users DROP email;")},
+    "003_add_name.up.sql":       &fstest.MapFile{Data:[]byte("ALTER TABLE users ADD name TEXT;")},
+    "003_add_name.down.sql":     &fstest.MapFile{Data:[]byte("ALTER TABLE users DROP name;")},
+  }, opts)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    t.FailNow()
+  }
+  
+  f.Reset()
+  return m, f, tbl
+}
+
+// Select the statements which are not part of managing the migration table
+func migrations(stmts []string) []string {
+  var r []string
+  for _, e := range stmts {
+    if !strings.Contains(e, TABLE_DEFAULT) && e != godb.Postgres.TableExists() {
+      r = append(r, e)
+    }
+  }
+  return r
+}
+
+func TestUpAndStatus(t *testing.T) {
+  m, f, _ := newFakeMigrator(t, "migrate_up", Options{})
+  ctx := context.Background()
+  
+  s, err := m.Status(ctx)
+  if assert.Nil(t, err, fmt.Sprint(err)) {
+    assert.Equal(t, int64(0), s.Current)
+    assert.Len(t, s.Applied, 0)
+    assert.Len(t, s.Pending, 3)
+  }
+  
+  // each migration is applied in its own transaction
+  f.Reset()
+  n, err := m.UpTo(ctx, 2)
+  assert.Nil(t, err, fmt.Sprint(err))
+  assert.Equal(t, 2, n)
+  assert.Equal(t, []string{
+    "BEGIN", "CREATE TABLE users (id TEXT PRIMARY KEY);", "COMMIT",
+    "BEGIN", "ALTER TABLE users ADD email TEXT;", "COMMIT",
+  }, migrations(f.Statements()))
+  
+  s, err = m.Status(ctx)
+  if assert.Nil(t, err, fmt.Sprint(err)) {
+    assert.Equal(t, int64(2), s.Current)
+    if assert.Len(t, s.Applied, 2) {
+      assert.Equal(t, "create_users", s.Applied[0].Name)
+      assert.Equal(t, checksum("ALTER TABLE users ADD email TEXT;"), s.Applied[1].Checksum)
+    }
+    if assert.Len(t, s.Pending, 1) {
+      assert.Equal(t, int64(3), s.Pending[0].Version)
+    }
+    assert.Len(t, s.Modified(), 0)
+    assert.Len(t, s.Unknown(), 0)
+  }
+  
+  // the remaining migrations are applied
+  f.Reset()
+  n, err = m.Up(ctx)
+  assert.Nil(t, err, fmt.Sprint(err))
+  assert.Equal(t, 1, n)
+  assert.Equal(t, []string{"BEGIN", "ALTER TABLE users ADD name TEXT;", "COMMIT"}, migrations(f.Statements()))
+  
+  n, err = m.Up(ctx)
+  assert.Nil(t, err, fmt.Sprint(err))
+  assert.Equal(t, 0, n)
+}
+
+func TestDown(t *testing.T) {
+  m, f, tbl := newFakeMigrator(t, "migrate_down", Options{})
+  ctx := context.Background()
+  
+  _, err := m.Up(ctx)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  
+  // migrations are rolled back in descending order
+  f.Reset()
+  n, err := m.Down(ctx, 1)
+  assert.Nil(t, err, fmt.Sprint(err))
+  assert.Equal(t, 2, n)
+  assert.Equal(t, []string{
+    "BEGIN", "ALTER TABLE users DROP name;", "COMMIT",
+    "BEGIN", "ALTER TABLE users DROP email;", "COMMIT",
+  }, migrations(f.Statements()))
+  
+  s, err := m.Status(ctx)
+  if assert.Nil(t, err, fmt.Sprint(err)) {
+    assert.Equal(t, int64(1), s.Current)
+    assert.Len(t, s.Pending, 2)
+  }
+  
+  // nothing is rolled back when an applied migration is unknown
+  tbl.add(9, "elsewhere", checksum("SELECT 1;"))
+  f.Reset()
+  n, err = m.Down(ctx, 0)
+  assert.True(t, errors.Is(err, ErrUnknown), fmt.Sprint(err))
+  assert.Equal(t, 0, n)
+  assert.Len(t, migrations(f.Statements()), 0)
+  delete(tbl.records, 9)
+  
+  // nor when one is irreversible
+  m.migrations[0].Down = ""
+  f.Reset()
+  n, err = m.Down(ctx, 0)
+  assert.True(t, errors.Is(err, ErrIrreversible), fmt.Sprint(err))
+  assert.Equal(t, 0, n)
+  assert.Len(t, migrations(f.Statements()), 0)
+}
+
+func TestModified(t *testing.T) {
+  m, f, tbl := newFakeMigrator(t, "migrate_modified", Options{})
+  ctx := context.Background()
+  
+  // the migration has been edited since it was applied
+  tbl.add(1, "create_users", checksum("CREATE TABLE users (id BIGINT PRIMARY KEY);"))
+  
+  s, err := m.Status(ctx)
+  if assert.Nil(t, err, fmt.Sprint(err)) {
+    if x := s.Modified(); assert.Len(t, x, 1) {
+      assert.Equal(t, int64(1), x[0].Version)
+    }
+  }
+  
+  f.Reset()
+  n, err := m.Up(ctx)
+  assert.True(t, errors.Is(err, ErrModified), fmt.Sprint(err))
+  assert.Equal(t, 0, n)
+  assert.Len(t, migrations(f.Statements()), 0)
+}
+
+func TestDryRun(t *testing.T) {
+  out := &bytes.Buffer{}
+  m, f, tbl := newFakeMigrator(t, "migrate_dryrun", Options{DryRun:true, Output:out})
+  ctx := context.Background()
+  
+  // nothing is executed and the migration table is not created
+  n, err := m.UpTo(ctx, 2)
+  assert.Nil(t, err, fmt.Sprint(err))
+  assert.Equal(t, 2, n)
+  assert.False(t, tbl.created)
+  assert.Equal(t, []string{godb.Postgres.TableExists()}, f.Statements())
+  assert.Equal(t, "-- 1_create_users (up)\nCREATE TABLE users (id TEXT PRIMARY KEY);\n-- 2_add_email (up)\nALTER TABLE users ADD email TEXT;\n", out.String())
+  
+  // rolling back describes the down scripts
+  tbl.add(1, "create_users", checksum("CREATE TABLE users (id TEXT PRIMARY KEY);"))
+  out.Reset()
+  f.Reset()
+  n, err = m.Down(ctx, 0)
+  assert.Nil(t, err, fmt.Sprint(err))
+  assert.Equal(t, 1, n)
+  assert.Len(t, migrations(f.Statements()), 0)
+  assert.Equal(t, "-- 1_create_users (down)\nDROP TABLE users;\n", out.String())
+}
+
+func TestPerformContext(t *testing.T) {
+  svc := memory.New()
+  m, f, _ := newFakeMigrator(t, "migrate_sync", Options{Sync:svc})
+  
+  // another process holds the migration mutex
+  lock, err := svc.Mutex(fmt.Sprintf("/godb/%s/db/migrate/%s", env.Environ(), TABLE_DEFAULT))
+  if !assert.Nil(t, err, fmt.Sprint(err)) || !assert.Nil(t, lock.Lock()) {
+    return
+  }
+  
+  // waiting for it is abandoned along with the context
+  ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 50)
+  defer cancel()
+  n, err := m.Up(ctx)
+  assert.Equal(t, context.DeadlineExceeded, err)
+  assert.Equal(t, 0, n)
+  assert.Len(t, f.Statements(), 0)
+  
+  // and migrations are applied once it is released
+  assert.Nil(t, lock.Unlock())
+  n, err = m.Up(context.Background())
+  assert.Nil(t, err, fmt.Sprint(err))
+  assert.Equal(t, 3, n)
+}
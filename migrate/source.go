@@ -0,0 +1,180 @@
+package migrate
+
+import (
+  "fmt"
+  "sort"
+  "sync"
+  "regexp"
+  "strconv"
+  "io/fs"
+  "crypto/sha256"
+  "encoding/hex"
+  
+  "github.com/hirepurpose/godb"
+  "github.com/hirepurpose/godb/persist"
+)
+
+// Migration file names are of the form `<version>_<name>.up.sql`, with an optional
+// `<version>_<name>.down.sql` counterpart. A file without a direction, such as
+// `<version>_<name>.sql`, is an up migration.
+var migrationFilename = regexp.MustCompile(`^(\d+)(?:[_\-](.*?))?(?:\.(up|down))?\.sql$`)
+
+// A Go migration function. The context is the transaction in which the migration
+// is applied and the ORM executes in that transaction by default.
+type Func func(cxt godb.Context, orm persist.ORM)(error)
+
+// A migration, which is either SQL or Go
+type Migration struct {
+  Version   int64
+  Name      string
+  Up        string  // the SQL which applies this migration
+  Down      string  // the SQL which rolls back this migration; empty if it is irreversible
+  UpFunc    Func    // the function which applies a Go migration
+  DownFunc  Func    // the function which rolls back a Go migration; nil if it is irreversible
+  Checksum  string  // the checksum of the up migration
+}
+
+// Determine if this is a Go migration
+func (m *Migration) IsFunc() bool {
+  return m.UpFunc != nil
+}
+
+// Determine if this migration can be rolled back
+func (m *Migration) Reversible() bool {
+  if m.IsFunc() {
+    return m.DownFunc != nil
+  }else{
+    return m.Down != ""
+  }
+}
+
+func (m *Migration) String() string {
+  if m.Name != "" {
+    return fmt.Sprintf("%d_%s", m.Version, m.Name)
+  }else{
+    return strconv.FormatInt(m.Version, 10)
+  }
+}
+
+// Produce the checksum for migration SQL
+func checksum(s string) string {
+  h := sha256.Sum256([]byte(s))
+  return hex.EncodeToString(h[:])
+}
+
+// Load migrations from the root of a filesystem, ordered by version. Files which
+// are not named like migrations are ignored. To load from a subdirectory, e.g.,
+// of an embed.FS, use fs.Sub.
+func Load(fsys fs.FS) ([]*Migration, error) {
+  ents, err := fs.ReadDir(fsys, ".")
+  if err != nil {
+    return nil, err
+  }
+  
+  set := make(map[int64]*Migration)
+  for _, e := range ents {
+    if e.IsDir() {
+      continue
+    }
+    x := migrationFilename.FindStringSubmatch(e.Name())
+    if x == nil {
+      continue
+    }
+    v, err := strconv.ParseInt(x[1], 10, 64)
+    if err != nil {
+      return nil, fmt.Errorf("Invalid migration version: %s: %v", e.Name(), err)
+    }
+    data, err := fs.ReadFile(fsys, e.Name())
+    if err != nil {
+      return nil, err
+    }
+    
+    m, ok := set[v]
+    if !ok {
+      m = &Migration{Version:v, Name:x[2]}
+      set[v] = m
+    }else if m.Name != x[2] {
+      return nil, fmt.Errorf("Migration %d has conflicting names: %q, %q", v, m.Name, x[2])
+    }
+    
+    if x[3] == "down" {
+      if m.Down != "" {
+        return nil, fmt.Errorf("Migration %d has more than one down script", v)
+      }
+      m.Down = string(data)
+    }else{
+      if m.Checksum != "" {
+        return nil, fmt.Errorf("Migration %d has more than one up script", v)
+      }
+      m.Up = string(data)
+      m.Checksum = checksum(m.Up)
+    }
+  }
+  
+  res := make([]*Migration, 0, len(set))
+  for _, e := range set {
+    if e.Checksum == "" {
+      return nil, fmt.Errorf("Migration %d has a down script but no up script", e.Version)
+    }
+    res = append(res, e)
+  }
+  sort.Slice(res, func(i, j int) bool {
+    return res[i].Version < res[j].Version
+  })
+  
+  return res, nil
+}
+
+// Registered Go migrations
+var (
+  registryLock  sync.Mutex
+  registry      = make(map[int64]*Migration)
+)
+
+// Register a Go migration, typically from an init function. Go migrations are
+// applied along with SQL migrations, ordered by version, by migrators created
+// with New or NewWithOptions. The down function may be nil if the migration is
+// irreversible. This function panics if the version is already registered.
+func Register(version int64, name string, up, down Func) {
+  if up == nil {
+    panic(fmt.Sprintf("migrate: Migration %d has no up function", version))
+  }
+  registryLock.Lock()
+  defer registryLock.Unlock()
+  if _, ok := registry[version]; ok {
+    panic(fmt.Sprintf("migrate: Migration %d is already registered", version))
+  }
+  m := &Migration{Version:version, Name:name, UpFunc:up, DownFunc:down}
+  m.Checksum = checksum(fmt.Sprintf("go:%v", m)) // functions cannot be checksummed; a renamed migration is detected
+  registry[version] = m
+}
+
+// Obtain registered Go migrations, ordered by version
+func Registered() []*Migration {
+  registryLock.Lock()
+  defer registryLock.Unlock()
+  res := make([]*Migration, 0, len(registry))
+  for _, e := range registry {
+    res = append(res, e)
+  }
+  sort.Slice(res, func(i, j int) bool {
+    return res[i].Version < res[j].Version
+  })
+  return res
+}
+
+// Merge ordered sets of migrations, which must not share versions
+func merge(a, b []*Migration) ([]*Migration, error) {
+  res := make([]*Migration, 0, len(a) + len(b))
+  for len(a) > 0 && len(b) > 0 {
+    if a[0].Version == b[0].Version {
+      return nil, fmt.Errorf("Migration %d is defined more than once", a[0].Version)
+    }else if a[0].Version < b[0].Version {
+      res, a = append(res, a[0]), a[1:]
+    }else{
+      res, b = append(res, b[0]), b[1:]
+    }
+  }
+  res = append(res, a...)
+  return append(res, b...), nil
+}
@@ -0,0 +1,77 @@
+package migrate
+
+import (
+  "testing"
+  "testing/fstest"
+  
+  "github.com/hirepurpose/godb"
+  "github.com/hirepurpose/godb/persist"
+)
+
+import (
+  "github.com/stretchr/testify/assert"
+)
+
+func TestLoad(t *testing.T) {
+  fsys := fstest.MapFS{
+    "002_add_email.up.sql":     &fstest.MapFile{Data:[]byte("ALTER TABLE users ADD email TEXT;")},
+    "002_add_email.down.sql":   &fstest.MapFile{Data:[]byte("ALTER TABLE users DROP email;")},
+    "001_create_users.sql":     &fstest.MapFile{Data:[]byte("CREATE TABLE users (id TEXT PRIMARY KEY);")},
+    "010.up.sql":               &fstest.MapFile{Data:[]byte("SELECT 1;")},
+    "README.md":                &fstest.MapFile{Data:[]byte("Not a migration")},
+  }
+  
+  m, err := Load(fsys)
+  if assert.Nil(t, err, err) && assert.Len(t, m, 3) {
+    assert.Equal(t, int64(1), m[0].Version)
+    assert.Equal(t, "create_users", m[0].Name)
+    assert.False(t, m[0].Reversible())
+    assert.Equal(t, checksum("CREATE TABLE users (id TEXT PRIMARY KEY);"), m[0].Checksum)
+    assert.Equal(t, int64(2), m[1].Version)
+    assert.Equal(t, "add_email", m[1].Name)
+    assert.Equal(t, "ALTER TABLE users DROP email;", m[1].Down)
+    assert.True(t, m[1].Reversible())
+    assert.Equal(t, int64(10), m[2].Version)
+    assert.Equal(t, "10", m[2].String())
+  }
+  
+  _, err = Load(fstest.MapFS{
+    "001_a.up.sql": &fstest.MapFile{Data:[]byte("SELECT 1;")},
+    "001_b.up.sql": &fstest.MapFile{Data:[]byte("SELECT 2;")},
+  })
+  assert.NotNil(t, err)
+  
+  _, err = Load(fstest.MapFS{
+    "001_a.down.sql": &fstest.MapFile{Data:[]byte("SELECT 1;")},
+  })
+  assert.NotNil(t, err)
+}
+
+func TestRegister(t *testing.T) {
+  up := func(cxt godb.Context, orm persist.ORM) error { return nil }
+  Register(3, "backfill_names", up, nil)
+  defer func() {
+    registryLock.Lock()
+    delete(registry, 3)
+    registryLock.Unlock()
+  }()
+  
+  assert.Panics(t, func() { Register(3, "duplicate", up, nil) })
+  
+  r := Registered()
+  if assert.Len(t, r, 1) {
+    assert.True(t, r[0].IsFunc())
+    assert.False(t, r[0].Reversible())
+    assert.Equal(t, checksum("go:3_backfill_names"), r[0].Checksum)
+  }
+  
+  m, err := merge([]*Migration{{Version:1}, {Version:5}}, r)
+  if assert.Nil(t, err, err) && assert.Len(t, m, 3) {
+    assert.Equal(t, int64(1), m[0].Version)
+    assert.Equal(t, int64(3), m[1].Version)
+    assert.Equal(t, int64(5), m[2].Version)
+  }
+  
+  _, err = merge([]*Migration{{Version:3}}, r)
+  assert.NotNil(t, err)
+}
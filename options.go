@@ -0,0 +1,221 @@
+package godb
+
+import (
+  "fmt"
+  "time"
+  "strconv"
+  "strings"
+  "net/url"
+  
+  "github.com/hirepurpose/godb/sync"
+)
+
+import (
+  "github.com/rcrowley/go-metrics"
+)
+
+const (
+  MAX_OPEN_CONNS_DEFAULT      = 10
+  MAX_IDLE_CONNS_DEFAULT      = 10
+)
+
+// DSN query parameters which are interpreted by godb and removed before the DSN
+// is handed to the driver
+const (
+  paramMaxOpenConns           = "max_open_conns"
+  paramMaxIdleConns           = "max_idle_conns"
+  paramConnMaxLifetime        = "conn_max_lifetime"
+  paramConnMaxIdleTime        = "conn_max_idle_time"
+  paramApplicationName        = "application_name"
+  paramTimezone               = "timezone"
+  paramStatementTimeout       = "statement_timeout"
+  paramOnConnect              = "on_connect"
+  paramMigrations             = "migrations"
+  paramReplica                = "replica"
+  paramReplicaCheckInterval   = "replica_check_interval"
+  paramReplicaMaxLag          = "replica_max_lag"
+  paramStatementCacheSize     = "statement_cache_size"
+  paramStatsInterval          = "stats_interval"
+)
+
+// Database options. Zero values are unset; unset options may be provided by query
+// parameters in the database URI and otherwise take their defaults.
+type Options struct {
+  MaxOpenConns          int            // maximum open connections in the pool
+  MaxIdleConns          int            // maximum idle connections in the pool
+  ConnMaxLifetime       time.Duration  // maximum time a connection may be reused
+  ConnMaxIdleTime       time.Duration  // maximum time a connection may be idle
+  ApplicationName       string         // set as application_name on connect
+  Timezone              string         // set as the session time zone on connect
+  StatementTimeout      time.Duration  // set as statement_timeout on connect
+  OnConnect             []string       // additional statements executed on every new connection
+  Migrate               bool           // run migrations on startup
+  Migrations            string         // migration resource location; defaults to env.Etc("db")
+  Sync                  sync.Service   // synchronization service used to serialize migrations
+  Dialect               Dialect        // the SQL dialect; defaults to the dialect for the URI scheme
+  Quiet                 bool           // do not log the connection banner
+  Logger                Logger         // the logger; defaults to DefaultLogger()
+  Tracer                Tracer         // the tracer; defaults to logging spans if debug.TRACE is set and otherwise not tracing
+  Replicas              []string       // read replica URIs
+  ReplicaCheckInterval  time.Duration  // interval between replica health checks
+  ReplicaMaxLag         time.Duration  // replication lag beyond which a replica is unhealthy; defaults to REPLICA_MAX_LAG_DEFAULT, negative disables the limit
+  StatementCacheSize    int            // maximum cached prepared statements; negative disables caching
+  StatsInterval         time.Duration  // interval at which pool statistics are published as metrics; negative disables publishing
+  StatsRegistry         metrics.Registry // the registry in which pool statistics are published; defaults to the go-metrics default registry
+  StatsPrefix           string         // the prefix of pool statistic names; defaults to one keyed by the database host and name
+  MigrationTable        string         // the table in which the migrate package records applied migrations, for health checks; defaults to MIGRATION_TABLE_DEFAULT
+  UpgradeTable          string         // the table in which go-upgrade records the schema version, for health checks when the migration table does not exist; defaults to UPGRADE_TABLE_DEFAULT
+}
+
+// Parse options from query parameters in a database URI. Parameters interpreted
+// as options are removed and the remaining URI is returned.
+func ParseOptions(uri string) (string, Options, error) {
+  var opts Options
+  
+  u, err := url.Parse(uri)
+  if err != nil {
+    return "", opts, err
+  }
+  
+  q, err := url.ParseQuery(u.RawQuery)
+  if err != nil {
+    return "", opts, fmt.Errorf("Invalid query parameters: %v", err)
+  }
+  for k, v := range q {
+    if len(v) < 1 {
+      continue
+    }
+    switch k {
+      case paramMaxOpenConns:
+        opts.MaxOpenConns, err = strconv.Atoi(v[0])
+      case paramMaxIdleConns:
+        opts.MaxIdleConns, err = strconv.Atoi(v[0])
+      case paramConnMaxLifetime:
+        opts.ConnMaxLifetime, err = time.ParseDuration(v[0])
+      case paramConnMaxIdleTime:
+        opts.ConnMaxIdleTime, err = time.ParseDuration(v[0])
+      case paramApplicationName:
+        opts.ApplicationName = v[0]
+      case paramTimezone:
+        opts.Timezone = v[0]
+      case paramStatementTimeout:
+        opts.StatementTimeout, err = parseMillis(v[0])
+      case paramOnConnect:
+        opts.OnConnect = append(opts.OnConnect, v...)
+      case paramMigrations:
+        opts.Migrations = v[0]
+      case paramReplica:
+        opts.Replicas = append(opts.Replicas, v...)
+      case paramReplicaCheckInterval:
+        opts.ReplicaCheckInterval, err = time.ParseDuration(v[0])
+      case paramReplicaMaxLag:
+        opts.ReplicaMaxLag, err = time.ParseDuration(v[0])
+      case paramStatementCacheSize:
+        opts.StatementCacheSize, err = strconv.Atoi(v[0])
+      case paramStatsInterval:
+        opts.StatsInterval, err = time.ParseDuration(v[0])
+      default:
+        continue
+    }
+    if err != nil {
+      return "", opts, fmt.Errorf("Invalid value for parameter %s: %v", k, err)
+    }
+    q.Del(k)
+  }
+  
+  u.RawQuery = q.Encode()
+  return u.String(), opts, nil
+}
+
+// Merge options; set values in the receiver take precedence over those in the
+// provided options.
+func (o Options) merge(d Options) Options {
+  if o.MaxOpenConns == 0 {
+    o.MaxOpenConns = d.MaxOpenConns
+  }
+  if o.MaxIdleConns == 0 {
+    o.MaxIdleConns = d.MaxIdleConns
+  }
+  if o.ConnMaxLifetime == 0 {
+    o.ConnMaxLifetime = d.ConnMaxLifetime
+  }
+  if o.ConnMaxIdleTime == 0 {
+    o.ConnMaxIdleTime = d.ConnMaxIdleTime
+  }
+  if o.ApplicationName == "" {
+    o.ApplicationName = d.ApplicationName
+  }
+  if o.Timezone == "" {
+    o.Timezone = d.Timezone
+  }
+  if o.StatementTimeout == 0 {
+    o.StatementTimeout = d.StatementTimeout
+  }
+  if o.Migrations == "" {
+    o.Migrations = d.Migrations
+  }
+  if o.Sync == nil {
+    o.Sync = d.Sync
+  }
+  if o.Dialect == nil {
+    o.Dialect = d.Dialect
+  }
+  if o.Logger == nil {
+    o.Logger = d.Logger
+  }
+  if o.Tracer == nil {
+    o.Tracer = d.Tracer
+  }
+  if o.Replicas == nil {
+    o.Replicas = d.Replicas
+  }
+  if o.ReplicaCheckInterval == 0 {
+    o.ReplicaCheckInterval = d.ReplicaCheckInterval
+  }
+  if o.ReplicaMaxLag == 0 {
+    o.ReplicaMaxLag = d.ReplicaMaxLag
+  }
+  if o.StatementCacheSize == 0 {
+    o.StatementCacheSize = d.StatementCacheSize
+  }
+  if o.StatsInterval == 0 {
+    o.StatsInterval = d.StatsInterval
+  }
+  if o.StatsRegistry == nil {
+    o.StatsRegistry = d.StatsRegistry
+  }
+  if o.StatsPrefix == "" {
+    o.StatsPrefix = d.StatsPrefix
+  }
+  if o.MigrationTable == "" {
+    o.MigrationTable = d.MigrationTable
+  }
+  if o.UpgradeTable == "" {
+    o.UpgradeTable = d.UpgradeTable
+  }
+  o.OnConnect = append(append([]string{}, d.OnConnect...), o.OnConnect...)
+  return o
+}
+
+// Produce the statements to execute on every new connection. Session settings
+// are produced by the dialect, which fails if it cannot apply one.
+func (o Options) onConnect(d Dialect) ([]string, error) {
+  s, err := d.Session(o.ApplicationName, o.Timezone, o.StatementTimeout)
+  if err != nil {
+    return nil, err
+  }
+  return append(s, o.OnConnect...), nil
+}
+
+// Parse a duration which is either a Go duration or an integer number of milliseconds
+func parseMillis(s string) (time.Duration, error) {
+  if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+    return time.Duration(n) * time.Millisecond, nil
+  }
+  return time.ParseDuration(s)
+}
+
+// Quote a string literal
+func quoteLiteral(s string) string {
+  return "'"+ strings.Replace(s, "'", "''", -1) +"'"
+}
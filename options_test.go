@@ -0,0 +1,128 @@
+package godb
+
+import (
+  "fmt"
+  "time"
+  "testing"
+)
+
+import (
+  "github.com/stretchr/testify/assert"
+)
+
+func TestParseOptions(t *testing.T) {
+  tests := []struct {
+    URI     string
+    DSN     string
+    Options Options
+    Error   bool
+  }{
+    {
+      "postgres://u@h/db?sslmode=disable",
+      "postgres://u@h/db?sslmode=disable",
+      Options{},
+      false,
+    },
+    {
+      "postgres://u@h/db?sslmode=disable&max_open_conns=5&max_idle_conns=2&statement_cache_size=-1",
+      "postgres://u@h/db?sslmode=disable",
+      Options{MaxOpenConns:5, MaxIdleConns:2, StatementCacheSize:-1},
+      false,
+    },
+    {
+      "postgres://u@h/db?conn_max_lifetime=5m&conn_max_idle_time=30s&replica_check_interval=2s&replica_max_lag=10s&stats_interval=1m",
+      "postgres://u@h/db",
+      Options{ConnMaxLifetime:time.Minute * 5, ConnMaxIdleTime:time.Second * 30, ReplicaCheckInterval:time.Second * 2, ReplicaMaxLag:time.Second * 10, StatsInterval:time.Minute},
+      false,
+    },
+    {
+      "postgres://u@h/db?statement_timeout=1500&application_name=app&timezone=UTC",
+      "postgres://u@h/db",
+      Options{StatementTimeout:time.Millisecond * 1500, ApplicationName:"app", Timezone:"UTC"},
+      false,
+    },
+    {
+      "postgres://u@h/db?statement_timeout=2s",
+      "postgres://u@h/db",
+      Options{StatementTimeout:time.Second * 2},
+      false,
+    },
+    {
+      "postgres://u@h/db?replica=postgres://r1/db&replica=postgres://r2/db&on_connect=SET+search_path+TO+app&migrations=/etc/db",
+      "postgres://u@h/db",
+      Options{Replicas:[]string{"postgres://r1/db", "postgres://r2/db"}, OnConnect:[]string{"SET search_path TO app"}, Migrations:"/etc/db"},
+      false,
+    },
+    {"postgres://u@h/db?max_open_conns=many", "", Options{}, true},
+    {"postgres://u@h/db?max_idle_conns=1.5", "", Options{}, true},
+    {"postgres://u@h/db?conn_max_lifetime=5", "", Options{}, true},
+    {"postgres://u@h/db?conn_max_idle_time=soon", "", Options{}, true},
+    {"postgres://u@h/db?statement_timeout=-", "", Options{}, true},
+    {"postgres://u@h/db?replica_check_interval=1x", "", Options{}, true},
+    {"postgres://u@h/db?replica_max_lag=soon", "", Options{}, true},
+    {"postgres://u@h/db?statement_cache_size=", "", Options{}, true},
+    {"postgres://u@h/db?stats_interval=10", "", Options{}, true},
+    {"postgres://u@h/db?%zz", "", Options{}, true},
+    {"postgres://%zz", "", Options{}, true},
+  }
+  for _, e := range tests {
+    dsn, opts, err := ParseOptions(e.URI)
+    if e.Error {
+      assert.NotNil(t, err, e.URI)
+    }else if assert.Nil(t, err, fmt.Sprintf("%s: %v", e.URI, err)) {
+      assert.Equal(t, e.DSN, dsn, e.URI)
+      assert.Equal(t, e.Options, opts, e.URI)
+    }
+  }
+}
+
+func TestMergeOptions(t *testing.T) {
+  params := Options{
+    MaxOpenConns:     5,
+    MaxIdleConns:     2,
+    StatementTimeout: time.Second,
+    ApplicationName:  "param",
+    Replicas:         []string{"postgres://r1/db"},
+    OnConnect:        []string{"SET a = 1"},
+  }
+  
+  m := Options{MaxOpenConns:20, ApplicationName:"explicit", OnConnect:[]string{"SET b = 2"}}.merge(params)
+  assert.Equal(t, 20, m.MaxOpenConns)
+  assert.Equal(t, 2, m.MaxIdleConns)
+  assert.Equal(t, time.Second, m.StatementTimeout)
+  assert.Equal(t, "explicit", m.ApplicationName)
+  assert.Equal(t, []string{"postgres://r1/db"}, m.Replicas)
+  assert.Equal(t, []string{"SET a = 1", "SET b = 2"}, m.OnConnect)
+  
+  m = Options{Replicas:[]string{}}.merge(params)
+  assert.Equal(t, []string{}, m.Replicas) // explicitly no replicas
+  
+  m = Options{}.merge(Options{})
+  assert.Equal(t, 0, m.MaxOpenConns)
+  assert.Equal(t, []string{}, m.OnConnect)
+}
+
+func TestOnConnect(t *testing.T) {
+  opts := Options{ApplicationName:"app's", Timezone:"UTC", StatementTimeout:time.Second * 2, OnConnect:[]string{"SET search_path TO app"}}
+  
+  s, err := opts.onConnect(Postgres)
+  if assert.Nil(t, err, fmt.Sprint(err)) {
+    assert.Equal(t, []string{"SET application_name = 'app''s'", "SET TIME ZONE 'UTC'", "SET statement_timeout = 2000", "SET search_path TO app"}, s)
+  }
+  
+  _, err = opts.onConnect(MySQL)
+  assert.NotNil(t, err) // no application name
+  s, err = Options{Timezone:"UTC", StatementTimeout:time.Second}.onConnect(MySQL)
+  if assert.Nil(t, err, fmt.Sprint(err)) {
+    assert.Equal(t, []string{"SET time_zone = 'UTC'", "SET SESSION max_execution_time = 1000"}, s)
+  }
+  
+  for _, e := range []Options{{ApplicationName:"app"}, {Timezone:"UTC"}, {StatementTimeout:time.Second}} {
+    _, err = e.onConnect(SQLite)
+    assert.NotNil(t, err, fmt.Sprint(e))
+  }
+  s, err = Options{OnConnect:[]string{"PRAGMA foreign_keys = ON"}}.onConnect(SQLite)
+  if assert.Nil(t, err, fmt.Sprint(err)) {
+    assert.Equal(t, []string{"PRAGMA foreign_keys = ON"}, s)
+  }
+}
@@ -0,0 +1,96 @@
+package otel
+
+import (
+  "fmt"
+  "context"
+  
+  "github.com/hirepurpose/godb"
+)
+
+import (
+  "go.opentelemetry.io/otel/trace"
+  "go.opentelemetry.io/otel/codes"
+  "go.opentelemetry.io/otel/attribute"
+)
+
+const (
+  SYSTEM_DEFAULT = "postgresql"
+)
+
+// Tracer options
+type Options struct {
+  System string // the value of the db.system attribute; defaults to SYSTEM_DEFAULT
+}
+
+// A tracer which starts OpenTelemetry client spans. Spans are started by the
+// underlying OpenTelemetry tracer, so a span is the child of the OpenTelemetry
+// span carried by its context.Context, whether that span was started by this
+// tracer, by the application or extracted from an inbound request by a propagator.
+type tracer struct {
+  t       trace.Tracer
+  system  string
+}
+
+// Create a tracer which starts spans with the provided OpenTelemetry tracer,
+// e.g., one obtained from otel.Tracer or a TracerProvider
+func NewTracer(t trace.Tracer) godb.Tracer {
+  return NewTracerWithOptions(t, Options{})
+}
+
+// Create a tracer with options
+func NewTracerWithOptions(t trace.Tracer, opts Options) godb.Tracer {
+  if opts.System == "" {
+    opts.System = SYSTEM_DEFAULT
+  }
+  return &tracer{t, opts.System}
+}
+
+// Implement godb.Tracer
+func (t *tracer) Start(ctx context.Context, name string) (context.Context, godb.Span) {
+  ctx, s := t.t.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String(godb.AttrSystem, t.system)))
+  x := span{s}
+  return godb.ContextWithSpan(ctx, x), x
+}
+
+// A span which wraps an OpenTelemetry span
+type span struct {
+  trace.Span
+}
+
+// Implement godb.Span
+func (s span) SetAttribute(key string, value interface{}) {
+  s.SetAttributes(keyValue(key, value))
+}
+
+// Implement godb.Span. As with OpenTelemetry spans, once a span has finished
+// subsequent calls have no effect.
+func (s span) Finish(err error) {
+  if err != nil {
+    s.RecordError(err)
+    s.SetStatus(codes.Error, err.Error())
+  }else{
+    s.SetStatus(codes.Ok, "")
+  }
+  s.End()
+}
+
+// Convert an attribute value to its OpenTelemetry representation. Values which
+// have no equivalent are represented as strings.
+func keyValue(key string, value interface{}) attribute.KeyValue {
+  switch v := value.(type) {
+    case string:
+      return attribute.String(key, v)
+    case bool:
+      return attribute.Bool(key, v)
+    case int:
+      return attribute.Int(key, v)
+    case int64:
+      return attribute.Int64(key, v)
+    case float64:
+      return attribute.Float64(key, v)
+    case []string:
+      return attribute.StringSlice(key, v)
+    default:
+      return attribute.String(key, fmt.Sprint(v))
+  }
+}
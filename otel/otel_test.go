@@ -0,0 +1,88 @@
+package otel
+
+import (
+  "fmt"
+  "context"
+  "testing"
+  
+  "github.com/hirepurpose/godb"
+)
+
+import (
+  "go.opentelemetry.io/otel/trace"
+  "go.opentelemetry.io/otel/codes"
+  "go.opentelemetry.io/otel/attribute"
+  "go.opentelemetry.io/otel/propagation"
+  "go.opentelemetry.io/otel/sdk/trace/tracetest"
+  sdktrace "go.opentelemetry.io/otel/sdk/trace"
+  "github.com/stretchr/testify/assert"
+)
+
+// Create an OpenTelemetry tracer which records finished spans
+func newRecorder() (*tracetest.SpanRecorder, trace.Tracer) {
+  r := tracetest.NewSpanRecorder()
+  p := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(r))
+  return r, p.Tracer("godb")
+}
+
+// Obtain the attributes of a recorded span
+func attributes(s sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+  m := make(map[attribute.Key]attribute.Value)
+  for _, e := range s.Attributes() {
+    m[e.Key] = e.Value
+  }
+  return m
+}
+
+func TestSpans(t *testing.T) {
+  r, ot := newRecorder()
+  tr := NewTracer(ot)
+  
+  // spans are children of an application span
+  ctx, app := ot.Start(context.Background(), "handler")
+  ctx, parent := tr.Start(ctx, "persist.fetch")
+  parent.SetAttribute(godb.AttrTable, "foo")
+  _, child := tr.Start(ctx, "godb.query")
+  child.SetAttribute(godb.AttrRows, 3)
+  child.Finish(nil)
+  parent.Finish(fmt.Errorf("Failed"))
+  parent.Finish(nil) // no effect
+  app.End()
+  
+  spans := r.Ended()
+  if assert.Len(t, spans, 3) {
+    s, p, a := spans[0], spans[1], spans[2]
+    assert.Equal(t, "godb.query", s.Name())
+    assert.Equal(t, "persist.fetch", p.Name())
+    assert.Equal(t, a.SpanContext().TraceID(), p.SpanContext().TraceID())
+    assert.Equal(t, a.SpanContext().SpanID(), p.Parent().SpanID())
+    assert.Equal(t, p.SpanContext().TraceID(), s.SpanContext().TraceID())
+    assert.Equal(t, p.SpanContext().SpanID(), s.Parent().SpanID())
+    assert.Equal(t, trace.SpanKindClient, p.SpanKind())
+    assert.Equal(t, "foo", attributes(p)[godb.AttrTable].AsString())
+    assert.Equal(t, SYSTEM_DEFAULT, attributes(p)[godb.AttrSystem].AsString())
+    assert.Equal(t, int64(3), attributes(s)[godb.AttrRows].AsInt64())
+    assert.Equal(t, sdktrace.Status{Code:codes.Error, Description:"Failed"}, p.Status())
+    assert.Equal(t, codes.Ok, s.Status().Code)
+  }
+}
+
+func TestRemoteParent(t *testing.T) {
+  r, ot := newRecorder()
+  tr := NewTracer(ot)
+  
+  // a parent propagated by another service
+  carrier := propagation.MapCarrier{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+  ctx := propagation.TraceContext{}.Extract(context.Background(), carrier)
+  
+  ctx, s := tr.Start(ctx, "godb.exec")
+  assert.Equal(t, s, godb.SpanFromContext(ctx))
+  s.Finish(nil)
+  
+  spans := r.Ended()
+  if assert.Len(t, spans, 1) {
+    assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].SpanContext().TraceID().String())
+    assert.Equal(t, "00f067aa0ba902b7", spans[0].Parent().SpanID().String())
+    assert.True(t, spans[0].Parent().IsRemote())
+  }
+}
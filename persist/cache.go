@@ -0,0 +1,188 @@
+package persist
+
+import (
+  "fmt"
+  "sync"
+  "time"
+  "reflect"
+  "strconv"
+)
+
+import (
+  "github.com/bww/go-lru"
+)
+
+const (
+  ENTITY_CACHE_ELEMENTS_DEFAULT = 4096
+)
+
+// Implemented by persisters whose entities may be cached by the ORM when they
+// are fetched by their primary key. Caching is only used when the ORM has been
+// configured with an EntityCache.
+type CachesEntities interface {
+  // Obtain the time-to-live for cached entities. A non-positive value disables caching.
+  EntityCacheTTL()(time.Duration)
+}
+
+// An entity cache. Keys identify an entity by its table and primary key.
+type EntityCache interface {
+  // Obtain a cached entity, if it is present and has not expired
+  Get(string)(interface{}, bool)
+  // Cache an entity for the provided time-to-live
+  Set(string, interface{}, time.Duration)
+  // Remove a cached entity
+  Delete(string)
+}
+
+// A cached entity, along with the options it was fetched with
+type cachedEntity struct {
+  opts  FetchOptions
+  value interface{}
+}
+
+// Produce an entity cache key. The table and each component of the key are
+// quoted, so that distinct tables and keys cannot produce the same cache key.
+func entityCacheKey(table string, id interface{}) string {
+  k := strconv.Quote(table)
+  for _, e := range keyArgs(id) {
+    k += ":"+ strconv.Quote(fmt.Sprint(e))
+  }
+  return k
+}
+
+// An in-memory LRU entity cache
+type memoryCache struct {
+  sync.Mutex
+  cache *lru.Cache
+}
+
+// An in-memory cache entry
+type memoryCacheEntry struct {
+  value   interface{}
+  expires time.Time
+}
+
+// Create an in-memory entity cache which holds up to n entities. If n is not
+// positive, a default size is used.
+func NewMemoryCache(n int) EntityCache {
+  if n <= 0 {
+    n = ENTITY_CACHE_ELEMENTS_DEFAULT
+  }
+  return &memoryCache{cache:lru.New(n)}
+}
+
+func (c *memoryCache) Get(k string) (interface{}, bool) {
+  c.Lock()
+  defer c.Unlock()
+  v, ok := c.cache.Get(k)
+  if !ok {
+    return nil, false
+  }
+  e := v.(memoryCacheEntry)
+  if time.Now().After(e.expires) {
+    c.cache.Remove(k)
+    return nil, false
+  }
+  return e.value, true
+}
+
+func (c *memoryCache) Set(k string, v interface{}, ttl time.Duration) {
+  c.Lock()
+  defer c.Unlock()
+  c.cache.Add(k, memoryCacheEntry{v, time.Now().Add(ttl)})
+}
+
+func (c *memoryCache) Delete(k string) {
+  c.Lock()
+  defer c.Unlock()
+  c.cache.Remove(k)
+}
+
+// Produce a deep copy of a value. Exported pointer, slice, map and struct fields
+// are copied recursively; unexported fields are copied shallowly. References to
+// the same pointer, slice or map are copied to references to the same copy, so
+// cyclic values are copied with the same cycles.
+func deepCopy(v interface{}) interface{} {
+  if v == nil {
+    return nil
+  }
+  return copyValue(reflect.ValueOf(v), make(map[copyRef]reflect.Value)).Interface()
+}
+
+// A reference which has been copied, identified by its address, length and type
+type copyRef struct {
+  ptr uintptr
+  len int
+  typ reflect.Type
+}
+
+// Produce a deep copy of a value, reusing the copies of references which have
+// already been copied
+func copyValue(v reflect.Value, seen map[copyRef]reflect.Value) reflect.Value {
+  switch v.Kind() {
+    case reflect.Ptr:
+      if v.IsNil() {
+        return v
+      }
+      r := copyRef{v.Pointer(), 0, v.Type()}
+      if c, ok := seen[r]; ok {
+        return c
+      }
+      c := reflect.New(v.Type().Elem())
+      seen[r] = c
+      c.Elem().Set(copyValue(v.Elem(), seen))
+      return c
+    case reflect.Interface:
+      if v.IsNil() {
+        return v
+      }
+      c := reflect.New(v.Type()).Elem()
+      c.Set(copyValue(v.Elem(), seen))
+      return c
+    case reflect.Struct:
+      c := reflect.New(v.Type()).Elem()
+      c.Set(v)
+      for i := 0; i < v.NumField(); i++ {
+        if f := c.Field(i); f.CanSet() {
+          f.Set(copyValue(v.Field(i), seen))
+        }
+      }
+      return c
+    case reflect.Slice:
+      if v.IsNil() {
+        return v
+      }
+      r := copyRef{v.Pointer(), v.Len(), v.Type()}
+      if c, ok := seen[r]; ok {
+        return c
+      }
+      c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+      seen[r] = c
+      for i := 0; i < v.Len(); i++ {
+        c.Index(i).Set(copyValue(v.Index(i), seen))
+      }
+      return c
+    case reflect.Array:
+      c := reflect.New(v.Type()).Elem()
+      for i := 0; i < v.Len(); i++ {
+        c.Index(i).Set(copyValue(v.Index(i), seen))
+      }
+      return c
+    case reflect.Map:
+      if v.IsNil() {
+        return v
+      }
+      r := copyRef{v.Pointer(), 0, v.Type()}
+      if c, ok := seen[r]; ok {
+        return c
+      }
+      c := reflect.MakeMapWithSize(v.Type(), v.Len())
+      seen[r] = c
+      for _, k := range v.MapKeys() {
+        c.SetMapIndex(k, copyValue(v.MapIndex(k), seen))
+      }
+      return c
+    default:
+      return v
+  }
+}
@@ -0,0 +1,158 @@
+package persist
+
+import (
+  "fmt"
+  "time"
+  "strings"
+  "testing"
+  "database/sql/driver"
+  
+  "github.com/hirepurpose/godb"
+  "github.com/hirepurpose/godb/test"
+  "github.com/hirepurpose/godb/uuid"
+)
+
+import (
+  "github.com/stretchr/testify/assert"
+)
+
+func TestDeepCopy(t *testing.T) {
+  e := &entityTester{Id: "1", Name: "Original", Foreign: &foreignTester{Value:"Foreign"}, Named: &namedInlineTester{true, "Named"}}
+  e.Inline.A = "Inline"
+  
+  c := deepCopy(e).(*entityTester)
+  assert.Equal(t, e, c)
+  
+  c.Name = "Changed"
+  c.Foreign.Value = "Changed"
+  c.Named.B = "Changed"
+  assert.Equal(t, "Original", e.Name)
+  assert.Equal(t, "Foreign", e.Foreign.Value)
+  assert.Equal(t, "Named", e.Named.B)
+}
+
+// A cyclic entity
+type cyclicTester struct {
+  Name      string
+  Parent    *cyclicTester
+  Children  []*cyclicTester
+  Index     map[string]*cyclicTester
+}
+
+func TestDeepCopyCycles(t *testing.T) {
+  e := &cyclicTester{Name:"Parent"}
+  c := &cyclicTester{Name:"Child", Parent:e}
+  e.Parent = e
+  e.Children = []*cyclicTester{c, c}
+  e.Index = map[string]*cyclicTester{"self": e, "child": c}
+  
+  d := deepCopy(e).(*cyclicTester)
+  assert.False(t, d == e)
+  assert.True(t, d.Parent == d)
+  assert.True(t, d.Children[0] == d.Children[1])
+  assert.False(t, d.Children[0] == c)
+  assert.True(t, d.Children[0].Parent == d)
+  assert.True(t, d.Index["self"] == d)
+  assert.True(t, d.Index["child"] == d.Children[0])
+  
+  d.Children[0].Name = "Changed"
+  assert.Equal(t, "Child", c.Name)
+  
+  // a slice which contains itself
+  s := make([]interface{}, 1)
+  s[0] = s
+  x := deepCopy(s).([]interface{})
+  assert.Equal(t, 1, len(x))
+}
+
+func TestEntityCacheKey(t *testing.T) {
+  assert.Equal(t, `"users":"1"`, entityCacheKey("users", 1))
+  assert.Equal(t, `"users":"1"`, entityCacheKey("users", "1"))
+  assert.Equal(t, `"memberships":"a":"b"`, entityCacheKey("memberships", Key{"a", "b"}))
+  
+  distinct := [][2]string{
+    {entityCacheKey("a:b", "c"), entityCacheKey("a", "b:c")},
+    {entityCacheKey("t", Key{"a:b", "c"}), entityCacheKey("t", Key{"a", "b:c"})},
+    {entityCacheKey("t", Key{"a", "b"}), entityCacheKey("t", "[a b]")},
+    {entityCacheKey("t", `a":"b`), entityCacheKey("t", Key{"a", "b"})},
+  }
+  for _, e := range distinct {
+    assert.NotEqual(t, e[0], e[1])
+  }
+}
+
+func TestMemoryCache(t *testing.T) {
+  c := NewMemoryCache(2)
+  
+  c.Set("a", 1, time.Minute)
+  v, ok := c.Get("a")
+  if assert.Equal(t, true, ok) {
+    assert.Equal(t, 1, v)
+  }
+  
+  c.Delete("a")
+  _, ok = c.Get("a")
+  assert.Equal(t, false, ok)
+  
+  c.Set("b", 2, -time.Second)
+  _, ok = c.Get("b")
+  assert.Equal(t, false, ok)
+}
+
+type cachedForeignPersister struct {
+  foreignPersister
+}
+
+func (e cachedForeignPersister) EntityCacheTTL() time.Duration {
+  return time.Minute
+}
+
+func TestFetchCachedPrimary(t *testing.T) {
+  id := uuid.New()
+  row := func(v string) test.FakeHandler {
+    return func(q string, args []driver.Value) (*test.FakeResult, error) {
+      if strings.HasPrefix(q, "SELECT") {
+        return &test.FakeResult{Columns:[]string{"id", "value"}, Rows:[][]driver.Value{{id.String(), v}}}, nil
+      }
+      return nil, nil
+    }
+  }
+  primary := test.NewFakeDB("persist_cache_primary", row("Current"))
+  replica := test.NewFakeDB("persist_cache_replica", nil)
+  db, err := test.NewFakeDatabase(godb.Options{}, primary, replica)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  defer db.Close()
+  replica.Reset() // forget the health check
+  replica.SetHandler(row("Stale"))
+  orm := NewWithOptions(db, Options{Cache:NewMemoryCache(16)})
+  
+  // a cached entity is read from the primary, never from a lagging replica
+  v := &foreignTester{}
+  err = orm.FetchEntityById(cachedForeignPersister{foreignPersister{orm}}, v, 0, nil, id)
+  if assert.Nil(t, err, fmt.Sprint(err)) {
+    assert.Equal(t, "Current", v.Value)
+  }
+  assert.Len(t, primary.Statements(), 1)
+  assert.Len(t, replica.Statements(), 0)
+  
+  // and is then served from the cache
+  primary.Reset()
+  v = &foreignTester{}
+  err = orm.FetchEntityById(cachedForeignPersister{foreignPersister{orm}}, v, 0, nil, id)
+  if assert.Nil(t, err, fmt.Sprint(err)) {
+    assert.Equal(t, "Current", v.Value)
+  }
+  assert.Len(t, primary.Statements(), 0)
+  assert.Len(t, replica.Statements(), 0)
+  
+  // entities which are not cached may be read from the replica
+  v = &foreignTester{}
+  err = orm.FetchEntityById(foreignPersister{orm}, v, 0, nil, id)
+  if assert.Nil(t, err, fmt.Sprint(err)) {
+    assert.Equal(t, "Stale", v.Value)
+  }
+  assert.Len(t, primary.Statements(), 0)
+  assert.Len(t, replica.Statements(), 1)
+}
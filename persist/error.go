@@ -2,8 +2,15 @@ package persist
 
 import (
   "fmt"
+  "context"
   "strings"
   "reflect"
+  
+  "github.com/hirepurpose/godb"
+)
+
+import (
+  "github.com/bww/go-util/text"
 )
 
 type multiError []error
@@ -30,3 +37,86 @@ func newSubfetchError(t reflect.Type, v reflect.Value, e error) subfetchError {
 func (s subfetchError) Error() string {
   return fmt.Sprintf("Sub-fetch (%v) - %v", s.which, s.err)
 }
+
+// An ORM operation
+type Op string
+const (
+  OpStore   = Op("store")   // a store which has not yet been resolved to an insert or update
+  OpInsert  = Op("insert")
+  OpUpdate  = Op("update")
+  OpUpsert  = Op("upsert")
+  OpDelete  = Op("delete")
+  OpFetch   = Op("fetch")
+  OpIter    = Op("iter")
+  OpCount   = Op("count")
+)
+
+// An ORM failure. Errors describe the operation which failed, the entity type and
+// table involved and, where one was executed, the statement. Statement argument
+// values are redacted unless the ORM is configured to include them.
+type Error struct {
+  Op        Op
+  Entity    string        // the entity type, e.g., "*model.User"
+  Table     string
+  Statement string
+  Args      []interface{} // statement arguments; nil when redacted
+  Cause     error
+}
+
+// Create an ORM error. If the cause is nil, nil is returned. If the cause is
+// already an ORM error, e.g., from a related entity, it is returned as-is.
+func newError(op Op, p Persister, v interface{}, q string, args []interface{}, cause error) error {
+  if cause == nil {
+    return nil
+  }
+  if _, ok := cause.(*Error); ok {
+    return cause
+  }
+  return &Error{Op:op, Entity:entityName(v), Table:tableName(p), Statement:text.CollapseSpaces(q), Args:args, Cause:cause}
+}
+
+// Obtain the table managed by a persister, if any
+func tableName(p Persister) string {
+  if p != nil {
+    return p.Table()
+  }else{
+    return ""
+  }
+}
+
+// Obtain the name of an entity type from an entity, a slice of entities or a type
+func entityName(v interface{}) string {
+  if t, ok := v.(reflect.Type); ok {
+    return t.String()
+  }else if v != nil {
+    return fmt.Sprintf("%T", v)
+  }else{
+    return ""
+  }
+}
+
+// Annotate a context with the persister and entity on whose behalf statements
+// are executed, for godb.SlowQueryContext
+func withCaller(ctx context.Context, p Persister, v interface{}) context.Context {
+  return godb.WithCaller(ctx, godb.Caller{Table:tableName(p), Entity:entityName(v)})
+}
+
+func (e *Error) Error() string {
+  s := &strings.Builder{}
+  fmt.Fprintf(s, "persist: Could not %s %s", e.Op, e.Entity)
+  if e.Table != "" {
+    fmt.Fprintf(s, " (%s)", e.Table)
+  }
+  if e.Statement != "" {
+    fmt.Fprintf(s, " [%s]", e.Statement)
+    if e.Args != nil {
+      fmt.Fprintf(s, " %v", e.Args)
+    }
+  }
+  fmt.Fprintf(s, ": %v", e.Cause)
+  return s.String()
+}
+
+func (e *Error) Unwrap() error {
+  return e.Cause
+}
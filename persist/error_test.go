@@ -0,0 +1,81 @@
+package persist
+
+import (
+  "fmt"
+  "errors"
+  "testing"
+  
+  "github.com/hirepurpose/godb"
+  "github.com/hirepurpose/godb/test"
+  "github.com/hirepurpose/godb/uuid"
+)
+
+import (
+  "github.com/stretchr/testify/assert"
+)
+
+type errorTestPersister struct{}
+
+func (p errorTestPersister) Table() string {
+  return "error_tester"
+}
+
+func TestError(t *testing.T) {
+  cause := fmt.Errorf("Failed")
+  
+  assert.Nil(t, newError(OpInsert, errorTestPersister{}, &entityTester{}, "", nil, nil))
+  
+  err := newError(OpInsert, errorTestPersister{}, &entityTester{}, "INSERT INTO  error_tester (a)\n VALUES ($1)", nil, cause)
+  assert.Equal(t, "persist: Could not insert *persist.entityTester (error_tester) [INSERT INTO error_tester (a) VALUES ($1)]: Failed", err.Error())
+  assert.True(t, errors.Is(err, cause))
+  
+  var x *Error
+  if assert.True(t, errors.As(err, &x)) {
+    assert.Equal(t, OpInsert, x.Op)
+    assert.Equal(t, "*persist.entityTester", x.Entity)
+    assert.Equal(t, "error_tester", x.Table)
+    assert.Nil(t, x.Args)
+  }
+  
+  err = newError(OpDelete, errorTestPersister{}, &entityTester{}, "DELETE FROM error_tester WHERE id = $1", []interface{}{"secret"}, godb.ErrForbidden)
+  assert.Equal(t, "persist: Could not delete *persist.entityTester (error_tester) [DELETE FROM error_tester WHERE id = $1] [secret]: Forbidden", err.Error())
+  assert.True(t, errors.Is(err, godb.ErrForbidden))
+  
+  assert.Equal(t, err, newError(OpFetch, errorTestPersister{}, nil, "", nil, err))
+  
+  d := &orm{}
+  err = d.error(OpUpdate, errorTestPersister{}, &entityTester{}, "UPDATE error_tester SET a = $1", []interface{}{"secret"}, cause)
+  assert.NotContains(t, err.Error(), "secret")
+  d.args = true
+  err = d.error(OpUpdate, errorTestPersister{}, &entityTester{}, "UPDATE error_tester SET a = $1", []interface{}{"secret"}, cause)
+  assert.Contains(t, err.Error(), "secret")
+}
+
+func TestErrorConditions(t *testing.T) {
+  f := test.NewFakeDB("persist_error_conditions", nil) // selects no rows
+  db, err := test.NewFakeDatabase(godb.Options{}, f)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  defer db.Close()
+  pf := &foreignPersister{New(db)}
+  
+  // conditions are described like any other failure and still match their sentinels
+  _, err = pf.FetchTesterEntity(uuid.New(), 0, nil)
+  assert.True(t, errors.Is(err, godb.ErrNotFound), fmt.Sprint(err))
+  var x *Error
+  if assert.True(t, errors.As(err, &x), fmt.Sprint(err)) {
+    assert.Equal(t, OpFetch, x.Op)
+    assert.Equal(t, "*persist.foreignTester", x.Entity)
+    assert.Equal(t, "hp_persist_test_foreign", x.Table)
+    assert.Equal(t, "SELECT id, value FROM hp_persist_test_foreign WHERE id = $1", x.Statement)
+  }
+  
+  err = pf.DeleteTesterEntity(&foreignTester{}, 0, nil)
+  assert.True(t, errors.Is(err, godb.ErrNotPersisted), fmt.Sprint(err))
+  assert.False(t, errors.Is(err, godb.ErrTransient), fmt.Sprint(err))
+  if assert.True(t, errors.As(err, &x), fmt.Sprint(err)) {
+    assert.Equal(t, OpDelete, x.Op)
+    assert.Equal(t, "hp_persist_test_foreign", x.Table)
+  }
+}
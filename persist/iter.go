@@ -9,8 +9,6 @@ import (
 )
 
 import (
-  "github.com/bww/go-util/text"
-  "github.com/bww/go-util/trace"
   "github.com/bww/go-util/debug"
 )
 
@@ -29,58 +27,80 @@ type iter struct {
   cxt     godb.Context
   m       PersistentMapping
   p       Persister
+  op      Op
   q       *pql.Query
-  tr      *trace.Trace
+  args    []interface{} // statement arguments for errors; nil when redacted
+  span    godb.Span     // the span of the operation, which is finished when the iterator is closed; nil if it is managed elsewhere
+  err     error         // the first error produced by the iterator
+  log     godb.Logger
   n, cols int
   discard []interface{} // discard columns, if we have extraneous fields
 }
 
 // Create an iterator
-func newIter(i *sql.Rows, o ORM, f FetchOptions, c godb.Context, m PersistentMapping, p Persister, q *pql.Query, t *trace.Trace) *iter {
-  return &iter{i, o, f, c, m, p, q, t, 0, -1, nil}
+func newIter(i *sql.Rows, o ORM, op Op, f FetchOptions, c godb.Context, m PersistentMapping, p Persister, q *pql.Query, args []interface{}, s godb.Span, l godb.Logger) *iter {
+  return &iter{i, o, f, c, m, p, op, q, args, s, nil, l, 0, -1, nil}
 }
 
-// Determine if there is a next element, and if so advance to it
+// Determine if there is a next element, and if so advance to it. If iteration
+// stops because it failed, e.g., because its context was canceled, the error is
+// reported when the iterator is closed.
 func (x *iter) Next() bool {
-  return x.Rows.Next()
+  if x.Rows.Next() {
+    return true
+  }
+  if err := x.Rows.Err(); err != nil {
+    x.error(nil, err)
+  }
+  return false
 }
 
 // Close this iterator. This method may be called on a nil pointer without
 // effect. This is just to simplify the convention:
 //   defer it.Close()
 // wherein `it` may be nil because it has already been cleaned up.
+//
+// The first error produced by the iterator is returned, if any; otherwise the
+// error closing its rows is.
 func (x *iter) Close() error {
-  if x != nil {
-    return x.Rows.Close()
-  }else{
+  if x == nil {
     return nil
   }
+  err := x.Rows.Close()
+  if x.err != nil {
+    err = x.err
+  }
+  if x.span != nil {
+    if x.err == nil {
+      x.err = err
+    }
+    x.span.SetAttribute(godb.AttrRows, x.n)
+    x.span.Finish(x.err)
+    x.span = nil
+  }
+  return err
 }
 
 // Scan an element
 func (x *iter) Scan(v interface{}) error {
   if v == nil {
-    return fmt.Errorf("persist: Scan target is nil")
+    return x.error(nil, fmt.Errorf("Scan target is nil"))
   }
   
   defer func(){ x.n++ }()
-  var sp *trace.Span
   
-  sp = x.tr.Start("Map destinations")
   dest, extra, err := x.m.ValueDestinations(v, x.q.Columns)
   if err != nil {
-    return err
+    return x.error(v, err)
   }
-  sp.Finish()
   
   if x.n == 0 { // first iteration, setup discard columns
     if debug.TRACE {
-      dumpMapping(v, x.q.Columns, dest)
+      dumpMapping(godb.ContextFrom(x.cxt), x.log, v, x.q.Columns, dest)
     }
-    sp = x.tr.Start("Resolve discard columns")
     cnames, err := x.Rows.Columns()
     if err != nil {
-      return err
+      return x.error(v, err)
     }
     x.cols = len(dest)
     if n := len(cnames) - x.cols; n > 0 {
@@ -89,33 +109,29 @@ func (x *iter) Scan(v interface{}) error {
         x.discard = append(x.discard, &v)
       }
     }
-    sp.Finish()
   }
   if x.discard != nil {
     dest = append(dest, x.discard...)
   }
   
-  sp = x.tr.Start("Scan fields")
   err = x.Rows.Scan(dest...)
   if err != nil {
-    if debug.VERBOSE {
-      return fmt.Errorf("persist: Could not query rows for %T w/ %T(%v) (%s): %v", v, x.cxt, x.cxt, text.CollapseSpaces(x.q.SQL), err)
-    }else{
-      return fmt.Errorf("persist: Could not query rows for %T: %v", v, err)
-    }
+    return x.error(v, err)
   }
-  sp.Finish()
   
-  sp = x.tr.Start("Fetch related")
   err = x.orm.FetchRelated(x.p, v, extra.Deref(), x.opts, x.cxt)
   if err != nil {
-    if debug.VERBOSE {
-      return fmt.Errorf("persist: Could not fetch related for %T w/ %T(%v) (%s): %v", v, x.cxt, x.cxt, text.CollapseSpaces(x.q.SQL), err)
-    }else{
-      return fmt.Errorf("persist: Could not fetch related for %T: %v", v, err)
-    }
+    return x.error(v, fmt.Errorf("Could not fetch related: %w", err))
   }
-  sp.Finish()
   
   return nil
 }
+
+// Produce an error for the current element
+func (x *iter) error(v interface{}, err error) error {
+  err = newError(x.op, x.p, v, x.q.SQL, x.args, err)
+  if x.err == nil {
+    x.err = err
+  }
+  return err
+}
@@ -9,10 +9,6 @@ import (
   "github.com/hirepurpose/godb/convert"
 )
 
-import (
-  "github.com/bww/go-util/debug"
-)
-
 const emptyName = "-"
 
 type Operation int
@@ -111,6 +107,7 @@ type fieldMapping struct {
 type mapping struct {
   reflect.Type
   primaryKeys map[string]fieldMapping
+  keyOrder    []string // primary key columns, in declaration order
   properties  map[string]fieldMapping
   embeds      []fieldMapping
 }
@@ -143,6 +140,7 @@ func newMapping(t reflect.Type) (*mapping, error) {
   }
   
   pk := make(map[string]fieldMapping)
+  po := make([]string, 0)
   pv := make(map[string]fieldMapping)
   em := make([]fieldMapping, 0)
   
@@ -172,6 +170,7 @@ func newMapping(t reflect.Type) (*mapping, error) {
       }else if tag.name != "" {
         if tag.primaryKey {
           pk[tag.name] = fm
+          po = append(po, tag.name)
         }else{
           pv[tag.name] = fm
         }
@@ -179,16 +178,16 @@ func newMapping(t reflect.Type) (*mapping, error) {
     }
   }
   
-  return &mapping{t, pk, pv, em}, nil
+  return &mapping{t, pk, po, pv, em}, nil
 }
 
 /**
- * Obtain a list of primary key columns
+ * Obtain a list of primary key columns, in declaration order
  */
 func (m *mapping) PrimaryKeys() []string {
   pk := make([]string, 0)
   
-  for k, _ := range m.primaryKeys {
+  for _, k := range m.keyOrder {
     pk = append(pk, k)
   }
   
@@ -215,8 +214,12 @@ func (m *mapping) Properties() []string {
 func (m *mapping) props(prefix string) []string {
   pv := make([]string, 0)
   
-  for k, _ := range m.properties {
-    pv = append(pv, prefix + k)
+  for k, e := range m.properties {
+    if e.tag.foreignKey {
+      pv = append(pv, foreignKeyColumns(e.field.Type, prefix + k)...)
+    }else{
+      pv = append(pv, prefix + k)
+    }
   }
   
   for _, e := range m.embeds {
@@ -254,8 +257,8 @@ func (m *mapping) idValues(v reflect.Value, top bool) ([]reflect.Value, error) {
     return nil, fmt.Errorf("Value of %v is nil", v.Type())
   }
   
-  for _, e := range m.primaryKeys {
-    pk = append(pk, v.Field(e.index))
+  for _, k := range m.keyOrder {
+    pk = append(pk, v.Field(m.primaryKeys[k].index))
   }
   
   for _, e := range m.embeds {
@@ -276,48 +279,86 @@ func (m *mapping) idValues(v reflect.Value, top bool) ([]reflect.Value, error) {
   return pk, nil
 }
 
-// Obtain the single primary key identifier
+// Obtain the primary key identifier. If there is more than one primary key
+// column the identifier is a Key of their values.
 func (m *mapping) Id(v reflect.Value) (interface{}, error) {
   ids, err := m.idValues(v, true)
   if err != nil {
     return nil, err
   }
-  if len(ids) != 1 {
-    return nil, fmt.Errorf("Invalid primary key count for %v: %d != %d (%s)", v.Type(), len(ids), 1, strings.Join(keys(m.primaryKeys), ", "))
+  switch len(ids) {
+    case 0:
+      return nil, fmt.Errorf("Invalid primary key count for %v: %d < %d", v.Type(), len(ids), 1)
+    case 1:
+      return ids[0].Interface(), nil
   }
-  return ids[0].Interface(), nil
+  k := make(Key, len(ids))
+  for i, e := range ids {
+    k[i] = e.Interface()
+  }
+  return k, nil
 }
 
-// Set the single primary key identifier
+// Set the primary key identifier. If there is more than one primary key column
+// the identifier must be a Key of their values.
 func (m *mapping) SetId(v reflect.Value, id interface{}) error {
   ids, err := m.idValues(v, true)
   if err != nil {
     return err
   }
-  if len(ids) != 1 {
-    return fmt.Errorf("Invalid primary key count for %v: %d != %d (%s)", v.Type(), len(ids), 1, strings.Join(keys(m.primaryKeys), ", "))
+  if len(ids) < 1 {
+    return fmt.Errorf("Invalid primary key count for %v: %d < %d", v.Type(), len(ids), 1)
+  }
+  vals := []interface{}{id}
+  if len(ids) > 1 {
+    k, ok := id.(Key)
+    if !ok || len(k) != len(ids) {
+      return fmt.Errorf("Identifier of %v must be a Key of %d values (%s), not %v", v.Type(), len(ids), strings.Join(m.PrimaryKeys(), ", "), id)
+    }
+    vals = k
   }
-  f := ids[0]
-  if f.Kind() != reflect.Ptr {
-    f = f.Addr()
+  for i, f := range ids {
+    if f.Kind() != reflect.Ptr {
+      f = f.Addr()
+    }
+    err = convert.Assign(f.Interface(), vals[i])
+    if err != nil {
+      return err
+    }
   }
-  return convert.Assign(f.Interface(), id)
+  return nil
 }
 
-// Produce a new identifier
+// Produce a new identifier. If there is more than one primary key column a Key
+// is produced in which values that are already set are retained and those which
+// are empty are generated.
 func (m *mapping) NewId(v reflect.Value) (interface{}, error) {
   ids, err := m.idValues(v, true)
   if err != nil {
     return nil, err
   }
-  if len(ids) != 1 {
-    return nil, fmt.Errorf("Invalid primary key count for %v: %d != %d (%s)", v.Type(), len(ids), 1, strings.Join(keys(m.primaryKeys), ", "))
-  }
-  f := ids[0]
-  if !f.Type().Implements(typeOfIdent) {
-    return nil, fmt.Errorf("Identifier of %v must implement %v", v.Type(), typeOfIdent)
+  switch len(ids) {
+    case 0:
+      return nil, fmt.Errorf("Invalid primary key count for %v: %d < %d", v.Type(), len(ids), 1)
+    case 1:
+      f := ids[0]
+      if !f.Type().Implements(typeOfIdent) {
+        return nil, fmt.Errorf("Identifier of %v must implement %v", v.Type(), typeOfIdent)
+      }
+      return f.Interface().(Ident).New(), nil
+  }
+  pks := m.PrimaryKeys()
+  k := make(Key, len(ids))
+  for i, f := range ids {
+    if x := f.Interface(); !IsEmpty(x) {
+      k[i] = x
+    }else if f.Type().Implements(typeOfIdent) {
+      k[i] = x.(Ident).New()
+    }else{
+      return nil, fmt.Errorf("Identifier %s of %v is empty and must implement %v to be generated", pks[i], v.Type(), typeOfIdent)
+    }
   }
-  return f.Interface().(Ident).New(), nil
+  return k, nil
 }
 
 // Obtain a map of property names to values
@@ -368,12 +409,14 @@ func (m *mapping) values(v reflect.Value, prefix string, pk bool, op Operation)
     if e.tag.foreignKey {
       f := v.Field(e.index)
       if !f.IsNil() {
-        z, err := foreignKey(f)
+        z, err := foreignKeys(f, prefix + n)
         if err != nil {
           return nil, err
         }
-        if op == Write && z != nil { // don't write nil, this can cause unintentinoal overwrites
-          pv[prefix + n] = z
+        for k, x := range z {
+          if op == Write && x != nil { // don't write nil, this can cause unintentinoal overwrites
+            pv[k] = x
+          }
         }
       }
     }else if op == Read || !e.tag.readOnly {
@@ -425,6 +468,9 @@ func (m *mapping) dests(p reflect.Value, q fieldMapping, v reflect.Value, prefix
   
   for _, e := range names {
     f, ok := searchProps(e, prefix, m.primaryKeys, m.properties)
+    if !ok {
+      f, ok = searchForeignKeys(e, prefix, m.properties)
+    }
     if ok {
       if !v.IsValid() {
         v = p.Field(q.index)
@@ -475,11 +521,9 @@ func (m *mapping) Dests(v reflect.Value, names []string) ([]interface{}, Columns
   return d, px, nil
 }
 
-// Derive a foreign key from a foreign entity
+// Derive a foreign key from a foreign entity. Derived keys are traced, along
+// with the other columns of the entity, when the ORM dumps its mapping.
 func foreignKey(e reflect.Value) (interface{}, error) {
-  if debug.TRACE {
-    fmt.Println("persist:", e)
-  }
   if e.Type().Implements(typeOfForeignEntity) {
     v := e.Interface().(ForeignEntity)
     if v == nil {
@@ -495,6 +539,72 @@ func foreignKey(e reflect.Value) (interface{}, error) {
   }
 }
 
+// Derive foreign key columns from a foreign entity. A foreign entity with a
+// composite primary key is referenced by a column for each of its primary key
+// columns; see foreignKeyColumns.
+func foreignKeys(e reflect.Value, name string) (Columns, error) {
+  z, err := foreignKey(e)
+  if err != nil {
+    return nil, err
+  }
+  k, ok := z.(Key)
+  if !ok {
+    return Columns{name: z}, nil
+  }
+  cols := foreignKeyColumns(e.Type(), name)
+  if len(cols) != len(k) {
+    return nil, fmt.Errorf("Foreign key of %v has %d values for %d columns (%s)", e.Type(), len(k), len(cols), strings.Join(cols, ", "))
+  }
+  c := make(Columns)
+  for i, x := range k {
+    c[cols[i]] = x
+  }
+  return c, nil
+}
+
+// Obtain the columns which reference a foreign entity of the provided type. An
+// entity with a single primary key column is referenced by one column, named as
+// the foreign key; an entity with a composite primary key is referenced by one
+// column for each of its primary key columns, named by prefixing the key column
+// with the foreign key name in the same way as inline structs, e.g.:
+//   Parent *Parent `db:"parent_,fk"` // parent_org_id, parent_id
+func foreignKeyColumns(t reflect.Type, name string) []string {
+  for t.Kind() == reflect.Ptr {
+    t = t.Elem()
+  }
+  if t.Kind() != reflect.Struct {
+    return []string{name}
+  }
+  s, err := Mapping(t)
+  if err != nil {
+    return []string{name}
+  }
+  pks := s.PrimaryKeys()
+  if len(pks) < 2 {
+    return []string{name}
+  }
+  cols := make([]string, len(pks))
+  for i, e := range pks {
+    cols[i] = name + e
+  }
+  return cols
+}
+
+// Search for a column of a composite foreign key among properties
+func searchForeignKeys(n, p string, props map[string]fieldMapping) (fieldMapping, bool) {
+  for k, f := range props {
+    if !f.tag.foreignKey {
+      continue
+    }
+    for _, c := range foreignKeyColumns(f.field.Type, k) {
+      if c == n || p + c == n {
+        return f, true
+      }
+    }
+  }
+  return fieldMapping{}, false
+}
+
 // Search for a property in one or more maps
 func searchProps(n, p string, in ...map[string]fieldMapping) (fieldMapping, bool) {
   for _, e := range in {
@@ -517,14 +627,3 @@ func isValid(v reflect.Value) bool {
       return v.IsValid()
   }
 }
-
-// Get the keys
-func keys(v map[string]fieldMapping) []string {
-  s := make([]string, len(v))
-  i := 0
-  for k, _ := range v {
-    s[i] = k
-    i++
-  }
-  return s
-}
@@ -11,6 +11,6 @@ const dbname = "hp_db_persist_test"
 const table  = "hp_persist_test"
 
 func TestMain(m *testing.M) {
-  test.Init(dbname)
+  test.Init(dbname, true)
   os.Exit(m.Run())
 }
@@ -2,16 +2,19 @@ package persist
 
 import (
   "fmt"
+  "sort"
   "time"
+  "errors"
+  "context"
   "reflect"
+  "strings"
+  "database/sql"
   
   "github.com/hirepurpose/godb"
   "github.com/hirepurpose/godb/pql"
 )
 
 import (
-  "github.com/bww/go-util/text"
-  "github.com/bww/go-util/trace"
   "github.com/bww/go-util/debug"
   "github.com/rcrowley/go-metrics"
 )
@@ -21,6 +24,7 @@ var (
   storeDurationMetric metrics.Timer
   insertDurationMetric metrics.Timer
   updateDurationMetric metrics.Timer
+  upsertDurationMetric metrics.Timer
   deleteDurationMetric metrics.Timer
   fetchOneDurationMetric metrics.Timer
   fetchManyDurationMetric metrics.Timer
@@ -35,6 +39,8 @@ func init() {
   metrics.Register("godb.persist.store.insert", insertDurationMetric)
   updateDurationMetric = metrics.NewTimer()
   metrics.Register("godb.persist.store.update", updateDurationMetric)
+  upsertDurationMetric = metrics.NewTimer()
+  metrics.Register("godb.persist.store.upsert", upsertDurationMetric)
   deleteDurationMetric = metrics.NewTimer()
   metrics.Register("godb.persist.delete", deleteDurationMetric)
   fetchOneDurationMetric = metrics.NewTimer()
@@ -45,6 +51,22 @@ func init() {
   metrics.Register("godb.persist.iter", iterDurationMetric)
 }
 
+// Table operations for which per-table timers are kept
+const (
+  tableOpStore  = "store"
+  tableOpFetch  = "fetch"
+  tableOpDelete = "delete"
+)
+
+// Record the duration of an operation on the table managed by a persister, as
+// the timer 'godb.persist.table.<table>.<op>'
+func updateTableMetric(p Persister, op string, start time.Time) {
+  if p == nil {
+    return
+  }
+  metrics.GetOrRegisterTimer(fmt.Sprintf("godb.persist.table.%s.%s", p.Table(), op), metrics.DefaultRegistry).Update(time.Since(start))
+}
+
 // Store options
 type StoreOptions uint32
 const (
@@ -58,6 +80,40 @@ const (
   StoreUserOption             = 17                    // base for user options
 )
 
+// Upsert options. By default an upsert which conflicts on the entity's primary key
+// updates every column of the existing row other than the key.
+type UpsertOptions struct {
+  Store       StoreOptions  // options for storing related entities and references
+  Conflict    []string      // the columns of the unique index an insert may conflict on; defaults to the primary key columns
+  Constraint  string        // the named constraint an insert may conflict on, instead of Conflict; not supported by every dialect
+  Update      []string      // the columns updated on conflict; defaults to every column other than the conflict columns
+  DoNothing   bool          // do nothing on conflict instead of updating the existing row
+}
+
+// The outcome of an upsert
+type Upserted int
+const (
+  UpsertStored    Upserted = iota // a row was inserted or updated, but the dialect cannot report which
+  UpsertInserted
+  UpsertUpdated
+  UpsertUnchanged                 // the insert conflicted and the existing row was not updated
+)
+
+func (u Upserted) String() string {
+  switch u {
+    case UpsertStored:
+      return "stored"
+    case UpsertInserted:
+      return "inserted"
+    case UpsertUpdated:
+      return "updated"
+    case UpsertUnchanged:
+      return "unchanged"
+    default:
+      return fmt.Sprintf("upserted(%d)", int(u))
+  }
+}
+
 // Fetch options
 type FetchOptions uint32
 const (
@@ -78,6 +134,32 @@ type Ident interface {
   New()(interface{})
 }
 
+// A composite identifier: the values of an entity's primary key columns, in the
+// order of its PrimaryKeys. Entities with more than one primary key column are
+// identified by a Key.
+type Key []interface{}
+
+func (k Key) String() string {
+  var s string
+  for i, e := range k {
+    if i > 0 {
+      s += ","
+    }
+    s += fmt.Sprint(e)
+  }
+  return s
+}
+
+// Obtain the statement arguments for an identifier, which are the values of a
+// composite identifier or the identifier itself
+func keyArgs(id interface{}) []interface{} {
+  if k, ok := id.(Key); ok {
+    return []interface{}(k)
+  }else{
+    return []interface{}{id}
+  }
+}
+
 // Foreign entity type
 var typeOfForeignEntity = reflect.TypeOf((*ForeignEntity)(nil)).Elem()
 
@@ -105,7 +187,7 @@ type PersistentMapping interface {
   PrimaryKeys()([]string)
   // Obtain the entity's column names.
   Columns()([]string)
-  // Obtain the persistent identifier for an entity. If this identifier is nil or empty the entity is considered transient.
+  // Obtain the persistent identifier for an entity. If this identifier is nil or empty the entity is considered transient. Entities with composite primary keys are identified by a Key.
   PersistentId(interface{})(interface{})
   // Set the persistent identifier for an entity, e.g., when inserting.
   SetPersistentId(interface{}, interface{})(error)
@@ -158,36 +240,111 @@ type DeletesReferences interface {
   DeleteReferences(interface{}, StoreOptions, godb.Context)(error)
 }
 
-// An ORM
+// An ORM. Each operation has a counterpart which accepts a context.Context; the
+// execution context used by that operation, including the one passed to persister
+// relation hooks, is bound to it so cancellation and deadlines reach the database.
 type ORM interface {
   Context(godb.Context)(godb.Context)
   DefaultContext()(godb.Context)
+  Logger()(godb.Logger)
   
   StoreEntity(Persister, interface{}, StoreOptions, godb.Context)(error)
+  UpsertEntity(Persister, interface{}, UpsertOptions, godb.Context)(Upserted, error)
   CountEntities(Persister, godb.Context, string, ...interface{})(int, error)
   FetchEntity(Persister, interface{}, FetchOptions, godb.Context, string, ...interface{})(error)
+  FetchEntityById(Persister, interface{}, FetchOptions, godb.Context, interface{})(error)
   FetchEntities(Persister, interface{}, FetchOptions, godb.Context, string, ...interface{})(error)
   IterEntities(Persister, reflect.Type, FetchOptions, godb.Context, string, ...interface{})(*iter, error)
   DeleteEntity(Persister, interface{}, StoreOptions, godb.Context)(error)
   
+  StoreEntityContext(context.Context, Persister, interface{}, StoreOptions, godb.Context)(error)
+  UpsertEntityContext(context.Context, Persister, interface{}, UpsertOptions, godb.Context)(Upserted, error)
+  CountEntitiesContext(context.Context, Persister, godb.Context, string, ...interface{})(int, error)
+  FetchEntityContext(context.Context, Persister, interface{}, FetchOptions, godb.Context, string, ...interface{})(error)
+  FetchEntityByIdContext(context.Context, Persister, interface{}, FetchOptions, godb.Context, interface{})(error)
+  FetchEntitiesContext(context.Context, Persister, interface{}, FetchOptions, godb.Context, string, ...interface{})(error)
+  IterEntitiesContext(context.Context, Persister, reflect.Type, FetchOptions, godb.Context, string, ...interface{})(*iter, error)
+  DeleteEntityContext(context.Context, Persister, interface{}, StoreOptions, godb.Context)(error)
+  
   StoreRelated(Persister, interface{}, StoreOptions, godb.Context)(error)
   FetchRelated(Persister, interface{}, Columns, FetchOptions, godb.Context)(error)
   StoreReferences(Persister, interface{}, StoreOptions, godb.Context)(error)
   DeleteRelated(Persister, interface{}, StoreOptions, godb.Context)(error)
   DeleteReferences(Persister, interface{}, StoreOptions, godb.Context)(error)
+  
+  StoreRelatedContext(context.Context, Persister, interface{}, StoreOptions, godb.Context)(error)
+  FetchRelatedContext(context.Context, Persister, interface{}, Columns, FetchOptions, godb.Context)(error)
+  StoreReferencesContext(context.Context, Persister, interface{}, StoreOptions, godb.Context)(error)
+  DeleteRelatedContext(context.Context, Persister, interface{}, StoreOptions, godb.Context)(error)
+  DeleteReferencesContext(context.Context, Persister, interface{}, StoreOptions, godb.Context)(error)
+}
+
+// ORM options
+type Options struct {
+  Logger      godb.Logger   // the logger; defaults to the context's logger or godb.DefaultLogger()
+  Cache       EntityCache   // the entity cache; when nil entities are not cached
+  IncludeArgs bool          // include statement argument values in errors; they are redacted by default
+  Tracer      godb.Tracer   // the tracer; defaults to the context's tracer or, if debug.TRACE is set, a tracer which logs slow operations
 }
 
 // Concrete persister
 type orm struct {
-  cxt godb.Context
+  cxt     godb.Context
+  log     godb.Logger
+  tracer  godb.Tracer
+  cache   EntityCache
+  args    bool
+}
+
+// Implemented by contexts which provide a logger, such as godb.Database
+type providesLogger interface {
+  Logger()(godb.Logger)
+}
+
+// Implemented by contexts which provide a tracer, such as godb.Database
+type providesTracer interface {
+  Tracer()(godb.Tracer)
 }
 
-// Create a persister
+// Create a persister. If the context provides a logger, the persister logs to it.
 func New(cxt godb.Context) ORM {
+  return NewWithOptions(cxt, Options{})
+}
+
+// Create a persister which logs to the provided logger
+func NewWithLogger(cxt godb.Context, l godb.Logger) ORM {
+  return NewWithOptions(cxt, Options{Logger:l})
+}
+
+// Create a persister with options
+func NewWithOptions(cxt godb.Context, opts Options) ORM {
+  l := opts.Logger
+  if l == nil {
+    if x, ok := cxt.(providesLogger); ok {
+      l = x.Logger()
+    }else{
+      l = godb.DefaultLogger()
+    }
+  }
+  t := opts.Tracer
+  if t == nil {
+    if x, ok := cxt.(providesTracer); ok {
+      t = x.Tracer()
+    }else if debug.TRACE {
+      t = godb.NewLogTracer(l, time.Millisecond)
+    }else{
+      t = godb.NopTracer()
+    }
+  }
   if debug.VERBOSE {
-    cxt = godb.NewDebugContext(cxt)
+    cxt = godb.NewDebugContextWithLogger("", l, cxt)
   }
-  return &orm{cxt}
+  return &orm{cxt, l, t, opts.Cache, opts.IncludeArgs}
+}
+
+// Obtain the logger
+func (d *orm) Logger() godb.Logger {
+  return d.log
 }
 
 // Obtain the default execution context
@@ -195,6 +352,37 @@ func (d *orm) DefaultContext() godb.Context {
   return d.cxt
 }
 
+// Obtain statement arguments for inclusion in an error, which is nil if they
+// are to be redacted
+func (d *orm) errorArgs(args []interface{}) []interface{} {
+  if d.args {
+    return args
+  }else{
+    return nil
+  }
+}
+
+// Begin an operation on behalf of a persister. The returned context.Context is
+// annotated with the persister and entity, for godb.SlowQueryContext, and carries
+// the operation's span.
+func (d *orm) operation(ctx context.Context, op Op, p Persister, v interface{}) (context.Context, godb.Span) {
+  ctx = withCaller(ctx, p, v)
+  ctx, span := d.tracer.Start(ctx, "persist."+ string(op))
+  span.SetAttribute(godb.AttrOperation, string(op))
+  if t := tableName(p); t != "" {
+    span.SetAttribute(godb.AttrTable, t)
+  }
+  if e := entityName(v); e != "" {
+    span.SetAttribute(godb.AttrEntity, e)
+  }
+  return ctx, span
+}
+
+// Produce an ORM error
+func (d *orm) error(op Op, p Persister, v interface{}, q string, args []interface{}, err error) error {
+  return newError(op, p, v, q, d.errorArgs(args), err)
+}
+
 // Resolve the execution context
 func (d *orm) Context(c godb.Context) godb.Context {
   if c != nil {
@@ -206,6 +394,12 @@ func (d *orm) Context(c godb.Context) godb.Context {
 
 // Store related
 func (d *orm) StoreRelated(p Persister, v interface{}, opts StoreOptions, cxt godb.Context) error {
+  return d.StoreRelatedContext(godb.ContextFrom(d.Context(cxt)), p, v, opts, cxt)
+}
+
+// Store related under the provided context.Context
+func (d *orm) StoreRelatedContext(ctx context.Context, p Persister, v interface{}, opts StoreOptions, cxt godb.Context) error {
+  cxt = godb.BindContext(ctx, cxt)
   if (opts & StoreOptionStoreRelated) == StoreOptionStoreRelated {
     if rel, ok := p.(StoresRelated); ok {
       err := rel.StoreRelated(v, opts, cxt)
@@ -219,6 +413,12 @@ func (d *orm) StoreRelated(p Persister, v interface{}, opts StoreOptions, cxt go
 
 // Store relationships
 func (d *orm) StoreReferences(p Persister, v interface{}, opts StoreOptions, cxt godb.Context) error {
+  return d.StoreReferencesContext(godb.ContextFrom(d.Context(cxt)), p, v, opts, cxt)
+}
+
+// Store relationships under the provided context.Context
+func (d *orm) StoreReferencesContext(ctx context.Context, p Persister, v interface{}, opts StoreOptions, cxt godb.Context) error {
+  cxt = godb.BindContext(ctx, cxt)
   if (opts & StoreOptionStoreReferences) == StoreOptionStoreReferences {
     if rel, ok := p.(StoresReferences); ok {
       err := rel.StoreReferences(v, opts, cxt)
@@ -232,6 +432,12 @@ func (d *orm) StoreReferences(p Persister, v interface{}, opts StoreOptions, cxt
 
 // Fetch relationships
 func (d *orm) FetchRelated(p Persister, v interface{}, extra Columns, opts FetchOptions, cxt godb.Context) error {
+  return d.FetchRelatedContext(godb.ContextFrom(d.Context(cxt)), p, v, extra, opts, cxt)
+}
+
+// Fetch relationships under the provided context.Context
+func (d *orm) FetchRelatedContext(ctx context.Context, p Persister, v interface{}, extra Columns, opts FetchOptions, cxt godb.Context) error {
+  cxt = godb.BindContext(ctx, cxt)
   if (opts & FetchOptionFetchRelated) == FetchOptionFetchRelated {
     if rel, ok := p.(FetchesRelatedExtra); ok {
       err := rel.FetchRelatedExtra(v, extra, opts, cxt)
@@ -250,6 +456,12 @@ func (d *orm) FetchRelated(p Persister, v interface{}, extra Columns, opts Fetch
 
 // Delete relationships
 func (d *orm) DeleteReferences(p Persister, v interface{}, opts StoreOptions, cxt godb.Context) error {
+  return d.DeleteReferencesContext(godb.ContextFrom(d.Context(cxt)), p, v, opts, cxt)
+}
+
+// Delete relationships under the provided context.Context
+func (d *orm) DeleteReferencesContext(ctx context.Context, p Persister, v interface{}, opts StoreOptions, cxt godb.Context) error {
+  cxt = godb.BindContext(ctx, cxt)
   if (opts & StoreOptionDeleteReferences) == StoreOptionDeleteReferences {
     if rel, ok := p.(DeletesReferences); ok {
       err := rel.DeleteReferences(v, opts, cxt)
@@ -263,6 +475,12 @@ func (d *orm) DeleteReferences(p Persister, v interface{}, opts StoreOptions, cx
 
 // Delete relationships
 func (d *orm) DeleteRelated(p Persister, v interface{}, opts StoreOptions, cxt godb.Context) error {
+  return d.DeleteRelatedContext(godb.ContextFrom(d.Context(cxt)), p, v, opts, cxt)
+}
+
+// Delete relationships under the provided context.Context
+func (d *orm) DeleteRelatedContext(ctx context.Context, p Persister, v interface{}, opts StoreOptions, cxt godb.Context) error {
+  cxt = godb.BindContext(ctx, cxt)
   if (opts & StoreOptionDeleteOrphans) == StoreOptionDeleteOrphans {
     if rel, ok := p.(DeletesRelated); ok {
       err := rel.DeleteRelated(v, opts, cxt)
@@ -276,63 +494,66 @@ func (d *orm) DeleteRelated(p Persister, v interface{}, opts StoreOptions, cxt g
 
 // Store a single persistent entity. The entity is either updated or inserted as needed.
 func (d *orm) StoreEntity(p Persister, v interface{}, opts StoreOptions, cxt godb.Context) error {
+  return d.StoreEntityContext(godb.ContextFrom(d.Context(cxt)), p, v, opts, cxt)
+}
+
+// Store a single persistent entity. The entity is either updated or inserted as needed under the provided context.Context.
+func (d *orm) StoreEntityContext(ctx context.Context, p Persister, v interface{}, opts StoreOptions, cxt godb.Context) (err error) {
   start := time.Now()
-  defer func() { storeDurationMetric.Update(time.Since(start)) }()
-  cxt = d.Context(cxt)
-  
-  var tr *trace.Trace
-  var sp *trace.Span
-  if debug.TRACE {
-    tr = trace.New(fmt.Sprintf("trace: db/store/1: (%T) %v", v, v)).Warn(time.Millisecond)
-    defer tr.Finish()
-  }
+  defer func() { storeDurationMetric.Update(time.Since(start)); updateTableMetric(p, tableOpStore, start) }()
+  ctx, span := d.operation(ctx, OpStore, p, v)
+  defer func() { span.Finish(err) }()
+  cxt = godb.BindContext(ctx, d.Context(cxt))
   
-  sp = tr.Start(fmt.Sprintf("%T: Get or create mapping", v))
   var m PersistentMapping
   if x, ok := p.(PersistentMapping); ok {
     m = x
   }else{
     m = newMappingEntity(v)
   }
-  sp.Finish()
   
-  sp = tr.Start(fmt.Sprintf("%T: Store related entities", v))
-  err := d.StoreRelated(p, v, opts, cxt)
+  err = d.StoreRelatedContext(ctx, p, v, opts, cxt)
   if err != nil {
-    return err
+    return d.error(OpStore, p, v, "", nil, err)
+  }
+  
+  pks := m.PrimaryKeys()
+  if l := len(pks); l < 1 {
+    return d.error(OpStore, p, v, "", nil, fmt.Errorf("Primary key count is invalid: %d < %d", l, 1))
   }
-  sp.Finish()
   
-  sp = tr.Start(fmt.Sprintf("%T: Resolve identifiers: %v", v, v))
   var trans bool
   pkid := m.PersistentId(v)
   gen, genok := p.(GeneratesIdentifiers)
   if !genok {
     trans = IsEmpty(pkid)
+    if _, ok := pkid.(Key); ok && !trans { // composite keys are generally assigned by the caller, so we must check whether the entity exists
+      trans, err = d.isTransient(ctx, p, v, pks, pkid, cxt)
+      if err != nil {
+        return err
+      }
+    }
   }else{
     var err error
     trans, err = gen.IsTransient(v, cxt) // IsTransient must never be called AFTER GenerateId is called, below
     if err != nil {
-      return err
+      return d.error(OpStore, p, v, "", nil, err)
     }
   }
-  sp.Finish()
+  op := OpUpdate
+  if trans {
+    op = OpInsert
+  }
+  span.SetAttribute(godb.AttrOperation, string(op))
   
-  sp = tr.Start(fmt.Sprintf("%T: Map persistent values", v))
   pvals, err := m.PersistentValues(v)
   if err != nil {
-    return err
-  }
-  sp.Finish()
-  
-  sp = tr.Start(fmt.Sprintf("%T: Build query", v))
-  pks := m.PrimaryKeys()
-  if l := len(pks); l != 1 {
-    return fmt.Errorf("Primary key count is invalid: %d != %d", l, 1)
+    return d.error(op, p, v, "", nil, err)
   }
   
   var kc int
   var q, kl string
+  dialect := godb.DialectOf(cxt)
   var vals []interface{}
   if trans {
     defer func() { insertDurationMetric.Update(time.Since(start)) }()
@@ -342,106 +563,249 @@ func (d *orm) StoreEntity(p Persister, v interface{}, opts StoreOptions, cxt god
     }else if IsEmpty(pkid) {
       pkid, err = gen.GenerateId(v, cxt)
       if err != nil {
-        return err
+        return d.error(op, p, v, "", nil, err)
       }
     }
-    if kc > 0 { kl += ", " }; kl += pks[0]
-    vals = append(vals, pkid)
+    for i, e := range pks {
+      if kc + i > 0 { kl += ", " }; kl += e
+    }
+    vals = append(vals, keyArgs(pkid)...)
     if debug.TRACE {
       names, vals := pvals.KeysVals()
-      dumpMapping(v, names, vals)
+      dumpMapping(ctx, d.log, v, names, vals)
     }
-    q = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", p.Table(), kl, arglist(1, len(vals)))
+    q = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", p.Table(), kl, arglist(dialect, 1, len(vals)))
   }else{
     defer func() { updateDurationMetric.Update(time.Since(start)) }()
-    kl, kc, vals = keyValueList("", pvals)
-    vals = append(vals, pkid)
+    kl, kc, vals = keyValueList(dialect, "", pvals)
+    vals = append(vals, keyArgs(pkid)...)
     if debug.TRACE {
       names, vals := pvals.KeysVals()
-      dumpMapping(v, names, vals)
+      dumpMapping(ctx, d.log, v, names, vals)
+    }
+    if kc > 0 { // an entity with no columns other than its key has nothing to update
+      q = fmt.Sprintf("UPDATE %s SET %s WHERE %s", p.Table(), kl, keyCondition(dialect, kc + 1, pks))
     }
-    q = fmt.Sprintf("UPDATE %s SET %s WHERE %s = $%d", p.Table(), kl, pks[0], kc + 1)
   }
-  sp.Finish()
   
-  sp = tr.Start(fmt.Sprintf("%T: Execute query (%s)", v, q))
-  _, err = cxt.Exec(q, vals...)
-  if err != nil {
-    return err
+  if q != "" {
+    res, err := cxt.Exec(q, vals...)
+    if err != nil {
+      return d.error(op, p, v, q, vals, err)
+    }
+    if n, err := res.RowsAffected(); err == nil {
+      span.SetAttribute(godb.AttrRows, n)
+    }
+    d.invalidate(p, pkid, cxt)
   }
-  sp.Finish()
   
   if trans { // this has to happen before we persist relationships
-    sp = tr.Start(fmt.Sprintf("%T: Set persistent ident", v))
     err := m.SetPersistentId(v, pkid)
     if err != nil {
-      return err
+      return d.error(op, p, v, "", nil, err)
     }
-    sp.Finish()
   }
   
-  sp = tr.Start(fmt.Sprintf("%T: Store references", v))
-  err = d.StoreReferences(p, v, opts, cxt)
+  err = d.StoreReferencesContext(ctx, p, v, opts, cxt)
   if err != nil {
-    return err
+    return d.error(op, p, v, "", nil, err)
   }
-  sp.Finish()
   
   return nil
 }
 
+// Insert a single persistent entity or, if the insert conflicts with an existing
+// row, update that row instead in a single statement.
+func (d *orm) UpsertEntity(p Persister, v interface{}, opts UpsertOptions, cxt godb.Context) (Upserted, error) {
+  return d.UpsertEntityContext(godb.ContextFrom(d.Context(cxt)), p, v, opts, cxt)
+}
+
+// Insert or update a single persistent entity under the provided context.Context.
+// Unlike StoreEntity, the entity's transience is never checked; an identifier is
+// generated for it if it has none and the database resolves any conflict.
+//
+// Where the dialect supports RETURNING the primary key of the stored row is read
+// back into the entity, so an entity which conflicts on some other unique index
+// assumes the identifier of the row it updated. If the row was not stored, because
+// the insert conflicted and the existing row was not updated, the entity is left
+// unmodified.
+func (d *orm) UpsertEntityContext(ctx context.Context, p Persister, v interface{}, opts UpsertOptions, cxt godb.Context) (res Upserted, err error) {
+  start := time.Now()
+  defer func() { storeDurationMetric.Update(time.Since(start)); upsertDurationMetric.Update(time.Since(start)); updateTableMetric(p, tableOpStore, start) }()
+  ctx, span := d.operation(ctx, OpUpsert, p, v)
+  defer func() { span.Finish(err) }()
+  cxt = godb.BindContext(ctx, d.Context(cxt))
+  
+  var m PersistentMapping
+  if x, ok := p.(PersistentMapping); ok {
+    m = x
+  }else{
+    m = newMappingEntity(v)
+  }
+  
+  err = d.StoreRelatedContext(ctx, p, v, opts.Store, cxt)
+  if err != nil {
+    return res, d.error(OpUpsert, p, v, "", nil, err)
+  }
+  
+  pks := m.PrimaryKeys()
+  if l := len(pks); l < 1 {
+    return res, d.error(OpUpsert, p, v, "", nil, fmt.Errorf("Primary key count is invalid: %d < %d", l, 1))
+  }
+  
+  pkid := m.PersistentId(v)
+  if IsEmpty(pkid) {
+    if gen, ok := p.(GeneratesIdentifiers); ok {
+      pkid, err = gen.GenerateId(v, cxt)
+      if err != nil {
+        return res, d.error(OpUpsert, p, v, "", nil, err)
+      }
+    }else{
+      pkid = m.NewPersistentId(v)
+    }
+  }
+  
+  pvals, err := m.PersistentValues(v)
+  if err != nil {
+    return res, d.error(OpUpsert, p, v, "", nil, err)
+  }
+  
+  conflict := opts.Conflict
+  if len(conflict) < 1 {
+    conflict = pks
+  }
+  var update []string
+  if !opts.DoNothing {
+    update = opts.Update
+    if update == nil {
+      update = upsertColumns(pvals, pks, conflict)
+    }
+  }
+  
+  dialect := godb.DialectOf(cxt)
+  clause, err := dialect.OnConflict(conflict, opts.Constraint, update)
+  if err != nil {
+    return res, d.error(OpUpsert, p, v, "", nil, err)
+  }
+  
+  kl, kc, vals := keyList("", pvals)
+  for i, e := range pks {
+    if kc + i > 0 { kl += ", " }; kl += e
+  }
+  vals = append(vals, keyArgs(pkid)...)
+  if debug.TRACE {
+    names, vals := pvals.KeysVals()
+    dumpMapping(ctx, d.log, v, names, vals)
+  }
+  q := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) %s", p.Table(), kl, arglist(dialect, 1, len(vals)), clause)
+  
+  if dialect.Returning() {
+    var inserted bool
+    var dst []interface{}
+    ins := dialect.Inserted()
+    if ins != "" {
+      dst = append(dst, &inserted)
+    }
+    kd, _, err := m.ValueDestinations(v, pks)
+    if err != nil {
+      return res, d.error(OpUpsert, p, v, "", nil, err)
+    }
+    dst = append(dst, kd...)
+    q += " RETURNING "+ returningList(ins, pks)
+    err = cxt.QueryRowContext(godb.WithPrimary(ctx), q, vals...).Scan(dst...) // this is a write, so it must not be routed to a replica
+    if errors.Is(err, sql.ErrNoRows) {
+      span.SetAttribute(godb.AttrRows, 0)
+      return UpsertUnchanged, nil
+    }else if err != nil {
+      return res, d.error(OpUpsert, p, v, q, vals, err)
+    }
+    span.SetAttribute(godb.AttrRows, 1)
+    if ins == "" {
+      res = UpsertStored
+    }else if inserted {
+      res = UpsertInserted
+    }else{
+      res = UpsertUpdated
+    }
+    pkid = m.PersistentId(v)
+  }else{
+    r, err := cxt.Exec(q, vals...)
+    if err != nil {
+      return res, d.error(OpUpsert, p, v, q, vals, err)
+    }
+    n, err := r.RowsAffected()
+    if err != nil {
+      return res, d.error(OpUpsert, p, v, q, vals, err)
+    }
+    span.SetAttribute(godb.AttrRows, n)
+    res = upsertedByRowsAffected(dialect, n)
+    if res == UpsertUnchanged {
+      return res, nil
+    }
+    err = m.SetPersistentId(v, pkid) // this has to happen before we persist relationships
+    if err != nil {
+      return res, d.error(OpUpsert, p, v, "", nil, err)
+    }
+  }
+  
+  d.invalidate(p, pkid, cxt)
+  
+  err = d.StoreReferencesContext(ctx, p, v, opts.Store, cxt)
+  if err != nil {
+    return res, d.error(OpUpsert, p, v, "", nil, err)
+  }
+  
+  return res, nil
+}
+
 // Count persistent entities.
 func (d *orm) CountEntities(p Persister, cxt godb.Context, q string, v ...interface{}) (int, error) {
-  cxt = d.Context(cxt)
-  var n int
-  err := cxt.QueryRow(q, v...).Scan(&n)
+  return d.CountEntitiesContext(godb.ContextFrom(d.Context(cxt)), p, cxt, q, v...)
+}
+
+// Count persistent entities under the provided context.Context.
+func (d *orm) CountEntitiesContext(ctx context.Context, p Persister, cxt godb.Context, q string, v ...interface{}) (n int, err error) {
+  ctx, span := d.operation(ctx, OpCount, p, nil)
+  defer func() { span.Finish(err) }()
+  cxt = godb.BindContext(godb.WithReplica(ctx), d.Context(cxt)) // reads may be served by a replica unless pinned to the primary
+  err = cxt.QueryRow(q, v...).Scan(&n)
   if err != nil {
-    return -1, err
+    return -1, d.error(OpCount, p, nil, q, v, err)
   }
   return n, nil
 }
 
 // Fetch a single persistent entity.
 func (d *orm) FetchEntity(p Persister, v interface{}, opts FetchOptions, cxt godb.Context, src string, args ...interface{}) error {
-  var tr *trace.Trace
-  var sp *trace.Span
-  if debug.TRACE {
-    tr = trace.New("trace: db/fetch/1: "+ text.CollapseSpaces(src)).Warn(time.Millisecond)
-    defer tr.Finish()
-  }
-  
+  return d.FetchEntityContext(godb.ContextFrom(d.Context(cxt)), p, v, opts, cxt, src, args...)
+}
+
+// Fetch a single persistent entity under the provided context.Context.
+func (d *orm) FetchEntityContext(ctx context.Context, p Persister, v interface{}, opts FetchOptions, cxt godb.Context, src string, args ...interface{}) (err error) {
   start := time.Now()
-  defer func() { fetchOneDurationMetric.Update(time.Since(start)) }()
-  cxt = d.Context(cxt)
+  defer func() { fetchOneDurationMetric.Update(time.Since(start)); updateTableMetric(p, tableOpFetch, start) }()
+  ctx, span := d.operation(ctx, OpFetch, p, v)
+  defer func() { span.Finish(err) }()
+  cxt = godb.BindContext(godb.WithReplica(ctx), d.Context(cxt))
   
-  sp = tr.Start("Get or create mapping")
   var m PersistentMapping
   if c, ok := p.(PersistentMapping); ok {
     m = c
   }else{
     m = newMappingEntity(v)
   }
-  sp.Finish()
   
-  sp = tr.Start("Parse PQL query")
-  q, err := pql.Parse(src, append(m.PrimaryKeys(), m.Columns()...))
+  q, err := pql.ParseWithLogger(src, append(m.PrimaryKeys(), m.Columns()...), d.log)
   if err != nil {
-    return err
+    return d.error(OpFetch, p, v, src, nil, err)
   }
-  sp.Finish()
   
-  sp = tr.Start("Execute query")
   rows, err := cxt.Query(q.SQL, args...)
   if err != nil {
-    if debug.VERBOSE {
-      return fmt.Errorf("persist: Could not query row for %T (%s): %v", v, q.SQL, err)
-    }else{
-      return fmt.Errorf("persist: Could not query row for %T: %v", v, err)
-    }
+    return d.error(OpFetch, p, v, q.SQL, args, err)
   }
-  sp.Finish()
   
-  it := newIter(rows, d, opts, cxt, m, p, q, tr)
+  it := newIter(rows, d, OpFetch, opts, cxt, m, p, q, d.errorArgs(args), nil, d.log)
   defer func() {
     if it != nil {
       it.Close()
@@ -449,7 +813,10 @@ func (d *orm) FetchEntity(p Persister, v interface{}, opts FetchOptions, cxt god
   }()
   
   if !it.Next() {
-    return godb.ErrNotFound
+    if it.err != nil {
+      return it.err // iteration failed, rather than finding nothing
+    }
+    return d.error(OpFetch, p, v, q.SQL, args, godb.ErrNotFound)
   }
   
   err = it.Scan(v)
@@ -458,80 +825,180 @@ func (d *orm) FetchEntity(p Persister, v interface{}, opts FetchOptions, cxt god
   }
   
   err = it.Close(); it = nil
+  if err != nil {
+    return d.error(OpFetch, p, v, q.SQL, args, err)
+  }
+  
+  span.SetAttribute(godb.AttrRows, 1)
+  return nil
+}
+
+// Fetch a single persistent entity by its primary key. If the ORM has an entity
+// cache and the persister implements CachesEntities, the entity is served from
+// the cache when possible. The cache is bypassed within transactions. An entity
+// which is not cached is read from the primary, so that a lagging replica cannot
+// fill the cache with a stale row.
+func (d *orm) FetchEntityById(p Persister, v interface{}, opts FetchOptions, cxt godb.Context, id interface{}) error {
+  return d.FetchEntityByIdContext(godb.ContextFrom(d.Context(cxt)), p, v, opts, cxt, id)
+}
+
+// Fetch a single persistent entity by its primary key under the provided context.Context.
+func (d *orm) FetchEntityByIdContext(ctx context.Context, p Persister, v interface{}, opts FetchOptions, cxt godb.Context, id interface{}) error {
+  cxt = d.Context(cxt)
+  
+  var m PersistentMapping
+  if c, ok := p.(PersistentMapping); ok {
+    m = c
+  }else{
+    m = newMappingEntity(v)
+  }
+  
+  pks := m.PrimaryKeys()
+  if l := len(pks); l < 1 {
+    return d.error(OpFetch, p, v, "", nil, fmt.Errorf("Primary key count is invalid: %d < %d", l, 1))
+  }
+  args := keyArgs(id)
+  if len(args) != len(pks) {
+    return d.error(OpFetch, p, v, "", nil, fmt.Errorf("Identifier has %d values for %d primary key columns (%s)", len(args), len(pks), strings.Join(pks, ", ")))
+  }
+  
+  ttl := d.cacheTTL(p, cxt)
+  key := entityCacheKey(p.Table(), id)
+  if ttl > 0 {
+    if e, ok := d.cache.Get(key); ok {
+      if c := e.(cachedEntity); c.opts == opts {
+        reflect.ValueOf(v).Elem().Set(reflect.ValueOf(deepCopy(c.value)).Elem())
+        return nil
+      }
+    }
+  }
+  
+  rctx := ctx
+  if ttl > 0 {
+    rctx = godb.WithPrimary(ctx)
+  }
+  err := d.FetchEntityContext(rctx, p, v, opts, cxt, fmt.Sprintf("SELECT {*} FROM %s WHERE %s", p.Table(), keyCondition(godb.DialectOf(cxt), 1, pks)), args...)
   if err != nil {
     return err
   }
   
+  if ttl > 0 {
+    d.cache.Set(key, cachedEntity{opts, deepCopy(v)}, ttl)
+  }
   return nil
 }
 
+// Determine whether an entity with a composite identifier is transient, which
+// is the case when no row with its identifier exists. The row is looked up on the
+// primary, where the entity will be written, since a replica may not have it yet.
+// Outside of a transaction a concurrent store may still insert the same key before
+// the entity is written, in which case the insert fails with a unique violation;
+// callers which race to store entities should use UpsertEntity instead.
+func (d *orm) isTransient(ctx context.Context, p Persister, v interface{}, pks []string, id interface{}, cxt godb.Context) (bool, error) {
+  q := fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE %s)", p.Table(), keyCondition(godb.DialectOf(cxt), 1, pks))
+  args := keyArgs(id)
+  var exists bool
+  err := cxt.QueryRowContext(godb.WithPrimary(ctx), q, args...).Scan(&exists)
+  if err != nil {
+    return false, d.error(OpStore, p, v, q, args, err)
+  }
+  return !exists, nil
+}
+
+// Determine the time-to-live for cached entities managed by a persister in the
+// provided context, which is zero if they should not be cached.
+func (d *orm) cacheTTL(p Persister, cxt godb.Context) time.Duration {
+  if d.cache == nil {
+    return 0
+  }
+  if _, ok := godb.Transactional(cxt); ok {
+    return 0
+  }
+  if c, ok := p.(CachesEntities); ok {
+    return c.EntityCacheTTL()
+  }
+  return 0
+}
+
+// Invalidate a cached entity. If the context is a transaction the entity is
+// invalidated again once the transaction completes, since it may have been
+// cached from outside the transaction in the meantime.
+func (d *orm) invalidate(p Persister, id interface{}, cxt godb.Context) {
+  if d.cache == nil {
+    return
+  }
+  if _, ok := p.(CachesEntities); !ok {
+    return
+  }
+  key := entityCacheKey(p.Table(), id)
+  d.cache.Delete(key)
+  if _, ok := godb.Transactional(cxt); ok {
+    godb.OnCommit(cxt, func(){ d.cache.Delete(key) })
+    godb.OnRollback(cxt, func(error){ d.cache.Delete(key) })
+  }
+}
+
 // Fetch many persistent entities.
 func (d *orm) FetchEntities(p Persister, r interface{}, opts FetchOptions, cxt godb.Context, src string, args ...interface{}) error {
-  var tr *trace.Trace
-  var sp *trace.Span
-  if debug.TRACE {
-    tr = trace.New("trace: db/fetch/n: "+ text.CollapseSpaces(src)).Warn(time.Millisecond)
-    defer tr.Finish()
-  }
-  
+  return d.FetchEntitiesContext(godb.ContextFrom(d.Context(cxt)), p, r, opts, cxt, src, args...)
+}
+
+// Fetch many persistent entities under the provided context.Context.
+func (d *orm) FetchEntitiesContext(ctx context.Context, p Persister, r interface{}, opts FetchOptions, cxt godb.Context, src string, args ...interface{}) (err error) {
   start := time.Now()
-  defer func() { fetchManyDurationMetric.Update(time.Since(start)) }()
-  cxt = d.Context(cxt)
+  defer func() { fetchManyDurationMetric.Update(time.Since(start)); updateTableMetric(p, tableOpFetch, start) }()
+  ctx, span := d.operation(ctx, OpFetch, p, r)
+  defer func() { span.Finish(err) }()
+  cxt = godb.BindContext(godb.WithReplica(ctx), d.Context(cxt))
   
-  sp = tr.Start("Lookup entity type")
   var isptr bool
   rval := reflect.ValueOf(r)
   if rval.Kind() == reflect.Ptr {
     r = rval.Elem().Interface()
     isptr = true
   }else{
-    fmt.Println("persist: Non-pointer value destination provided; this probably will not do what you expect.")
+    d.log.Log(ctx, godb.LevelWarn, "persist: Non-pointer value destination provided; this probably will not do what you expect.", godb.Fields{
+      godb.FieldEntity: fmt.Sprintf("%T", r),
+      godb.FieldTable:  p.Table(),
+    })
   }
   
   stype := reflect.TypeOf(r)
   if stype.Kind() != reflect.Slice {
-    return fmt.Errorf("Argument must be a slice %T", stype)
+    return d.error(OpFetch, p, stype, "", nil, fmt.Errorf("Argument must be a slice %T", stype))
   }
   
   btype, _ := derefType(stype.Elem())
   if btype.Kind() != reflect.Struct {
-    return fmt.Errorf("Array element type must be a struct")
+    return d.error(OpFetch, p, stype.Elem(), "", nil, fmt.Errorf("Array element type must be a struct"))
   }
   
   sval := reflect.ValueOf(r)
-  sp.Finish()
   
-  sp = tr.Start("Get or create mapping")
   var m PersistentMapping
   if x, ok := p.(PersistentMapping); ok {
     m = x
   }else{
     m = newMappingEntityForType(stype.Elem())
   }
-  sp.Finish()
   
-  sp = tr.Start("Parse PQL query")
-  q, err := pql.Parse(src, append(m.PrimaryKeys(), m.Columns()...))
+  q, err := pql.ParseWithLogger(src, append(m.PrimaryKeys(), m.Columns()...), d.log)
   if err != nil {
-    return err
+    return d.error(OpFetch, p, stype.Elem(), src, nil, err)
   }
-  sp.Finish()
   
-  sp = tr.Start("Execute query")
   rows, err := cxt.Query(q.SQL, args...)
   if err != nil {
-    return err
+    return d.error(OpFetch, p, stype.Elem(), q.SQL, args, err)
   }
-  sp.Finish()
   
-  it := newIter(rows, d, opts, cxt, m, p, q, tr)
+  it := newIter(rows, d, OpFetch, opts, cxt, m, p, q, d.errorArgs(args), nil, d.log)
   defer func() {
     if it != nil {
       it.Close()
     }
   }()
   
-  spres := tr.Start("Process results")
   for it.Next() {
     v := reflect.New(btype)
     e := v.Interface()
@@ -543,13 +1010,13 @@ func (d *orm) FetchEntities(p Persister, r interface{}, opts FetchOptions, cxt g
     
     sval = reflect.Append(sval, v) // expand, placeholder
   }
-  spres.Finish()
   
   err = it.Close(); it = nil
   if err != nil {
-    return err
+    return d.error(OpFetch, p, stype.Elem(), q.SQL, args, err)
   }
   
+  span.SetAttribute(godb.AttrRows, sval.Len())
   if isptr {
     rval.Elem().Set(sval)
   }
@@ -558,55 +1025,59 @@ func (d *orm) FetchEntities(p Persister, r interface{}, opts FetchOptions, cxt g
 
 // Fetch many persistent entities.
 func (d *orm) IterEntities(p Persister, t reflect.Type, opts FetchOptions, cxt godb.Context, src string, args ...interface{}) (*iter, error) {
-  var tr *trace.Trace
-  var sp *trace.Span
-  if debug.TRACE {
-    tr = trace.New("trace: db/iter: "+ text.CollapseSpaces(src)).Warn(time.Millisecond)
-    defer tr.Finish()
-  }
-  
+  return d.IterEntitiesContext(godb.ContextFrom(d.Context(cxt)), p, t, opts, cxt, src, args...)
+}
+
+// Fetch many persistent entities under the provided context.Context.
+func (d *orm) IterEntitiesContext(ctx context.Context, p Persister, t reflect.Type, opts FetchOptions, cxt godb.Context, src string, args ...interface{}) (it *iter, err error) {
   start := time.Now()
-  defer func() { iterDurationMetric.Update(time.Since(start)) }()
-  cxt = d.Context(cxt)
+  defer func() { iterDurationMetric.Update(time.Since(start)); updateTableMetric(p, tableOpFetch, start) }()
+  ctx, span := d.operation(ctx, OpIter, p, t)
+  defer func() {
+    if err != nil {
+      span.Finish(err) // otherwise, the span is finished when the iterator is closed
+    }
+  }()
+  cxt = godb.BindContext(godb.WithReplica(ctx), d.Context(cxt))
   
-  sp = tr.Start("Resolve entity type")
   btype, _ := derefType(t)
   if btype.Kind() != reflect.Struct {
-    return nil, fmt.Errorf("Entity must be a struct")
+    return nil, d.error(OpIter, p, t, "", nil, fmt.Errorf("Entity must be a struct"))
   }
-  sp.Finish()
   
-  sp = tr.Start("Get or create mapping")
   var m PersistentMapping
   if x, ok := p.(PersistentMapping); ok {
     m = x
   }else{
     m = newMappingEntityForType(btype)
   }
-  sp.Finish()
   
-  sp = tr.Start("Parse PQL query")
-  q, err := pql.Parse(src, append(m.PrimaryKeys(), m.Columns()...))
+  q, err := pql.ParseWithLogger(src, append(m.PrimaryKeys(), m.Columns()...), d.log)
   if err != nil {
-    return nil, err
+    return nil, d.error(OpIter, p, t, src, nil, err)
   }
-  sp.Finish()
   
-  sp = tr.Start("Execute query")
   rows, err := cxt.Query(q.SQL, args...)
   if err != nil {
-    return nil, err
+    return nil, d.error(OpIter, p, t, q.SQL, args, err)
   }
-  sp.Finish()
   
-  return newIter(rows, d, opts, cxt, m, p, q, tr), nil
+  return newIter(rows, d, OpIter, opts, cxt, m, p, q, d.errorArgs(args), span, d.log), nil
 }
 
 // Delete a persistent entity.
 func (d *orm) DeleteEntity(p Persister, v interface{}, opts StoreOptions, cxt godb.Context) error {
+  return d.DeleteEntityContext(godb.ContextFrom(d.Context(cxt)), p, v, opts, cxt)
+}
+
+// Delete a persistent entity under the provided context.Context. An entity which
+// has not been persisted fails with godb.ErrNotPersisted.
+func (d *orm) DeleteEntityContext(ctx context.Context, p Persister, v interface{}, opts StoreOptions, cxt godb.Context) (err error) {
   start := time.Now()
-  defer func() { deleteDurationMetric.Update(time.Since(start)) }()
-  cxt = d.Context(cxt)
+  defer func() { deleteDurationMetric.Update(time.Since(start)); updateTableMetric(p, tableOpDelete, start) }()
+  ctx, span := d.operation(ctx, OpDelete, p, v)
+  defer func() { span.Finish(err) }()
+  cxt = godb.BindContext(ctx, d.Context(cxt))
   
   var m PersistentMapping
   if x, ok := p.(PersistentMapping); ok {
@@ -617,32 +1088,34 @@ func (d *orm) DeleteEntity(p Persister, v interface{}, opts StoreOptions, cxt go
   
   pkid := m.PersistentId(v)
   if IsEmpty(pkid) {
-    return godb.ErrTransient
+    return d.error(OpDelete, p, v, "", nil, godb.ErrNotPersisted)
   }
   
   pk := m.PrimaryKeys()
-  if l := len(pk); l != 1 {
-    return fmt.Errorf("Invalid primary key count: %v != %v", l, 1)
+  if l := len(pk); l < 1 {
+    return d.error(OpDelete, p, v, "", nil, fmt.Errorf("Invalid primary key count: %v < %v", l, 1))
   }
-  kv, _, args := keyValueList("", map[string]interface{}{
-    pk[0]: pkid,
-  })
+  kv, args := keyCondition(godb.DialectOf(cxt), 1, pk), keyArgs(pkid)
   
-  err := d.DeleteReferences(p, v, opts, cxt)
+  err = d.DeleteReferencesContext(ctx, p, v, opts, cxt)
   if err != nil {
-    return err
+    return d.error(OpDelete, p, v, "", nil, err)
   }
   
-  err = d.DeleteRelated(p, v, opts, cxt)
+  err = d.DeleteRelatedContext(ctx, p, v, opts, cxt)
   if err != nil {
-    return err
+    return d.error(OpDelete, p, v, "", nil, err)
   }
   
   q := fmt.Sprintf("DELETE FROM %s WHERE %s", p.Table(), kv)
-  _, err = cxt.Exec(q, args...)
+  res, err := cxt.Exec(q, args...)
   if err != nil {
-    return err
+    return d.error(OpDelete, p, v, q, args, err)
   }
+  if n, err := res.RowsAffected(); err == nil {
+    span.SetAttribute(godb.AttrRows, n)
+  }
+  d.invalidate(p, pkid, cxt)
   
   return nil
 }
@@ -667,8 +1140,57 @@ func keyList(p string, e Columns) (string, int, []interface{}) {
   return l, i, o
 }
 
-// A list of keys to values and ordered values
-func keyValueList(p string, e Columns) (string, int, []interface{}) {
+// The columns updated by default when an upsert conflicts: every persistent
+// column other than the primary key and conflict columns, in a stable order
+func upsertColumns(e Columns, pks, conflict []string) []string {
+  x := make(map[string]struct{})
+  for _, k := range pks {
+    x[k] = struct{}{}
+  }
+  for _, k := range conflict {
+    x[k] = struct{}{}
+  }
+  var c []string
+  for k := range e {
+    if _, ok := x[k]; !ok {
+      c = append(c, k)
+    }
+  }
+  sort.Strings(c)
+  return c
+}
+
+// The list of expressions returned by an upsert: the dialect's inserted expression,
+// if any, followed by the primary key columns
+func returningList(ins string, pks []string) string {
+  var l string
+  if ins != "" {
+    l = ins
+  }
+  for _, e := range pks {
+    if l != "" { l += ", " }; l += e
+  }
+  return l
+}
+
+// Determine the outcome of an upsert from the number of rows it affected. MySQL
+// reports one row for an insert and two for an update; other dialects report one
+// either way. No rows are affected when the existing row is not updated.
+func upsertedByRowsAffected(d godb.Dialect, n int64) Upserted {
+  switch {
+    case n < 1:
+      return UpsertUnchanged
+    case d.Name() != godb.DialectMySQL:
+      return UpsertStored
+    case n == 1:
+      return UpsertInserted
+    default:
+      return UpsertUpdated
+  }
+}
+
+// A list of keys to values and ordered values, with placeholders in the provided dialect
+func keyValueList(d godb.Dialect, p string, e Columns) (string, int, []interface{}) {
   var o []interface{}
   var l string
   
@@ -680,7 +1202,7 @@ func keyValueList(p string, e Columns) (string, int, []interface{}) {
     }else{
       l += k
     }
-    l += fmt.Sprintf(" = $%d", i + 1)
+    l += " = "+ d.Placeholder(i + 1)
     o = append(o, v)
     i++
   }
@@ -707,19 +1229,16 @@ func indirects(v reflect.Value, n int) reflect.Value {
 }
 
 // Dump a mapping
-func dumpMapping(v interface{}, names []string, dests []interface{}) {
+func dumpMapping(ctx context.Context, log godb.Logger, v interface{}, names []string, dests []interface{}) {
   if len(names) != len(dests) {
     panic(fmt.Sprintf("persist: names and dests must be of equal lengths, but %d != %d", len(names), len(dests)))
   }
-  fmt.Printf("<M> %T %v\n", v, v)
-  var dlen int
-  for _, e := range names {
-    if l := len(e); l > dlen {
-      dlen = l
-    }
-  }
-  dfmt := fmt.Sprintf("    %% 3d: %%%ds -> (%%T) %%+v\n", dlen)
+  cols := make(map[string]string)
   for i, e := range dests {
-    fmt.Printf(dfmt, i, names[i], e, e)
+    cols[names[i]] = fmt.Sprintf("(%T) %+v", e, e)
   }
+  log.Log(ctx, godb.LevelDebug, fmt.Sprintf("persist: <M> %v", v), godb.Fields{
+    godb.FieldEntity: fmt.Sprintf("%T", v),
+    "columns":        cols,
+  })
 }
@@ -2,8 +2,14 @@ package persist
 
 import (
   "fmt"
+  "errors"
+  "context"
+  "reflect"
+  "strings"
   "testing"
+  "database/sql/driver"
   
+  "github.com/hirepurpose/godb"
   "github.com/hirepurpose/godb/test"
   "github.com/hirepurpose/godb/uuid"
 )
@@ -64,6 +70,186 @@ func TestCRUD(t *testing.T) {
   }
 }
 
+func TestUpsert(t *testing.T) {
+  cxt := test.DB()
+  if !assert.NotNil(t, cxt) { return }
+  pf := &foreignPersister{New(cxt)}
+  
+  // dialects which cannot tell an insert from an update report that the row was stored
+  inserted, updated := UpsertInserted, UpsertUpdated
+  if d := godb.DialectOf(cxt); d.Inserted() == "" && d.Name() != godb.DialectMySQL {
+    inserted, updated = UpsertStored, UpsertStored
+  }
+  
+  f := &foreignTester{Value:"Original value"}
+  r, err := pf.UpsertTesterEntity(f, UpsertOptions{}, nil)
+  if assert.Nil(t, err, fmt.Sprintf("%v", err)) {
+    assert.Equal(t, inserted, r)
+    assert.False(t, IsEmpty(f.Id))
+  }
+  
+  f.Value = "Updated value"
+  r, err = pf.UpsertTesterEntity(f, UpsertOptions{}, nil)
+  if assert.Nil(t, err, fmt.Sprintf("%v", err)) {
+    assert.Equal(t, updated, r)
+  }
+  
+  c, err := pf.FetchTesterEntity(f.Id, 0, nil)
+  if assert.Nil(t, err, fmt.Sprintf("%v", err)) {
+    assert.Equal(t, f, c)
+  }
+  
+  x := &foreignTester{Id:f.Id, Value:"Ignored value"}
+  r, err = pf.UpsertTesterEntity(x, UpsertOptions{DoNothing:true}, nil)
+  if assert.Nil(t, err, fmt.Sprintf("%v", err)) {
+    assert.Equal(t, UpsertUnchanged, r)
+  }
+  
+  c, err = pf.FetchTesterEntity(f.Id, 0, nil)
+  if assert.Nil(t, err, fmt.Sprintf("%v", err)) {
+    assert.Equal(t, "Updated value", c.Value)
+  }
+  
+  err = pf.DeleteTesterEntity(f, 0, nil)
+  assert.Nil(t, err, fmt.Sprintf("%v", err))
+}
+
+func TestUpsertPrimary(t *testing.T) {
+  // the primary reports that the row was inserted and returns its key, the last argument
+  primary := test.NewFakeDB("persist_upsert_primary", func(q string, args []driver.Value) (*test.FakeResult, error) {
+    if strings.HasPrefix(q, "INSERT") {
+      return &test.FakeResult{Rows:[][]driver.Value{{true, args[len(args) - 1]}}}, nil
+    }
+    return nil, nil
+  })
+  replica := test.NewFakeDB("persist_upsert_replica", nil)
+  db, err := test.NewFakeDatabase(godb.Options{}, primary, replica)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  defer db.Close()
+  replica.Reset() // forget the health check
+  pf := &foreignPersister{New(db)}
+  
+  f := &foreignTester{Value:"Value"}
+  r, err := pf.UpsertTesterEntity(f, UpsertOptions{}, nil)
+  if assert.Nil(t, err, fmt.Sprint(err)) {
+    assert.Equal(t, UpsertInserted, r)
+    assert.False(t, IsEmpty(f.Id))
+  }
+  
+  // the upsert is a write, so it must reach the primary even though fetches are routed to the replica
+  if s := primary.Statements(); assert.Len(t, s, 1) {
+    assert.True(t, strings.HasPrefix(s[0], "INSERT INTO hp_persist_test_foreign"), s[0])
+  }
+  assert.Len(t, replica.Statements(), 0)
+  
+  primary.Reset()
+  _, err = pf.FetchTesterEntity(f.Id, 0, nil)
+  assert.True(t, errors.Is(err, godb.ErrNotFound), fmt.Sprint(err)) // the replica has no rows
+  if s := replica.Statements(); assert.Len(t, s, 1) {
+    assert.True(t, strings.HasPrefix(s[0], "SELECT id, value FROM hp_persist_test_foreign"), s[0])
+  }
+  assert.Len(t, primary.Statements(), 0)
+}
+
+type compositePersister struct {
+  ORM
+}
+
+func (e compositePersister) Table() string {
+  return "composite"
+}
+
+func TestStoreComposite(t *testing.T) {
+  var exists bool
+  primary := test.NewFakeDB("persist_composite_primary", func(q string, args []driver.Value) (*test.FakeResult, error) {
+    if strings.HasPrefix(q, "SELECT EXISTS") {
+      return &test.FakeResult{Rows:[][]driver.Value{{exists}}}, nil
+    }
+    return &test.FakeResult{RowsAffected:1}, nil
+  })
+  replica := test.NewFakeDB("persist_composite_replica", nil)
+  db, err := test.NewFakeDatabase(godb.Options{}, primary, replica)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  defer db.Close()
+  replica.Reset() // forget the health check
+  pc := compositePersister{New(db)}
+  
+  // whether an entity whose key is assigned exists is checked on the primary,
+  // since a replica may not have it yet, and it is inserted or updated accordingly
+  c := &compositeTester{ident("A"), 2, "C"}
+  err = pc.StoreEntity(pc, c, 0, nil)
+  assert.Nil(t, err, fmt.Sprint(err))
+  exists = true
+  err = pc.StoreEntity(pc, c, 0, nil)
+  assert.Nil(t, err, fmt.Sprint(err))
+  
+  assert.Equal(t, []string{
+    "SELECT EXISTS (SELECT 1 FROM composite WHERE a = $1 AND b = $2)",
+    "INSERT INTO composite (c, a, b) VALUES ($1, $2, $3)",
+    "SELECT EXISTS (SELECT 1 FROM composite WHERE a = $1 AND b = $2)",
+    "UPDATE composite SET c = $1 WHERE a = $2 AND b = $3",
+  }, primary.Statements())
+  assert.Len(t, replica.Statements(), 0)
+}
+
+func TestFetchInterrupted(t *testing.T) {
+  errBroken := errors.New("Connection reset by peer")
+  var result *test.FakeResult
+  f := test.NewFakeDB("persist_fetch_interrupted", func(q string, args []driver.Value) (*test.FakeResult, error) {
+    return result, nil
+  })
+  db, err := test.NewFakeDatabase(godb.Options{}, f)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  defer db.Close()
+  pf := &foreignPersister{New(db)}
+  
+  rows := [][]driver.Value{
+    {uuid.New().String(), "A"},
+    {uuid.New().String(), "B"},
+    {uuid.New().String(), "C"},
+  }
+  
+  // a result which fails before its first row is not reported as missing
+  result = &test.FakeResult{Err:errBroken}
+  _, err = pf.FetchTesterEntity(uuid.New(), 0, nil)
+  assert.True(t, errors.Is(err, errBroken), fmt.Sprint(err))
+  assert.False(t, errors.Is(err, godb.ErrNotFound), fmt.Sprint(err))
+  
+  // nor is a result which fails part way through reported as complete
+  result = &test.FakeResult{Rows:rows[:2], Err:errBroken}
+  _, err = pf.FetchTesterEntities(Range{0, 10}, 0, nil)
+  assert.True(t, errors.Is(err, errBroken), fmt.Sprint(err))
+  
+  // and an iteration whose context is canceled stops and reports why
+  result = &test.FakeResult{Rows:rows}
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+  it, err := pf.IterEntitiesContext(ctx, pf, reflect.TypeOf((*foreignTester)(nil)), 0, nil, `SELECT {*} FROM hp_persist_test_foreign`)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  n := 0
+  for it.Next() {
+    err = it.Scan(&foreignTester{})
+    assert.Nil(t, err, fmt.Sprint(err))
+    n++
+    cancel()
+  }
+  assert.Equal(t, 1, n)
+  err = it.Close()
+  assert.True(t, errors.Is(err, context.Canceled), fmt.Sprint(err))
+  var perr *Error
+  if assert.True(t, errors.As(err, &perr), fmt.Sprint(err)) {
+    assert.Equal(t, OpIter, perr.Op)
+  }
+}
+
 func TestFetchOne(t *testing.T) {
   cxt := test.DB()
   pe := &entityPersister{New(cxt)}
@@ -87,7 +273,7 @@ func TestFetchOne(t *testing.T) {
       assert.Equal(t, e, r)
     }
   }
-  
+
 }
 
 func TestFetchMany(t *testing.T) {
@@ -115,7 +301,7 @@ func TestFetchMany(t *testing.T) {
   if assert.Nil(t, err, fmt.Sprintf("%v", err)) {
     assert.Equal(t, check, a)
   }
-  
+
 }
 
 func TestFetchIter(t *testing.T) {
@@ -151,5 +337,5 @@ func TestFetchIter(t *testing.T) {
     }
     assert.Equal(t, n, i)
   }
-  
+
 }
@@ -38,14 +38,15 @@ func (s *scanner) Properties() []string {
 }
 
 /**
- * Obtain the single primary key identifier
+ * Obtain the primary key identifier, which is a Key if there is more than one
+ * primary key column
  */
 func (s *scanner) Id() (interface{}, error) {
   return s.mapping.Id(s.value)
 }
 
 /**
- * Set the single primary key identifier
+ * Set the primary key identifier
  */
 func (s *scanner) SetId(id interface{}) error {
   return s.mapping.SetId(s.value, id)
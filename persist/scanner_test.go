@@ -51,6 +51,17 @@ type emptyNameTester struct {
   B   string            `db:"b"`
 }
 
+type compositeTester struct {
+  A   ident             `db:"a,pk"`
+  B   int               `db:"b,pk"`
+  C   string            `db:"c"`
+}
+
+type compositeReferenceTester struct {
+  A   ident             `db:"a,pk"`
+  R   *compositeTester  `db:"r_,fk"`
+}
+
 func (r referenceTester) ForeignKey() interface{} {
   return r.F
 }
@@ -218,4 +229,73 @@ func TestMapping(t *testing.T) {
     }
   })
   
+  
+  // ---
+  
+  t.Run("F", func(t *testing.T) {
+    v := &compositeTester{ident("A"), 2, "C"}
+    s := Scanner(v)
+    
+    assert.Equal(t, []string{"a","b"}, s.PrimaryKeys())
+    assert.Equal(t, []string{"c"},     sortedProperties(s))
+    
+    id, err := s.Id()
+    if assert.Nil(t, err, fmt.Sprintf("%v", err)) {
+      assert.Equal(t, Key{ident("A"), 2}, id)
+      assert.Equal(t, "A,2", fmt.Sprint(id))
+    }
+    
+    err = s.SetId(Key{ident("X"), 3})
+    if assert.Nil(t, err, fmt.Sprintf("%v", err)) {
+      assert.Equal(t, &compositeTester{ident("X"), 3, "C"}, v)
+    }
+    assert.NotNil(t, s.SetId(ident("Y")))
+    assert.NotNil(t, s.SetId(Key{ident("Y")}))
+    
+    v.A = ""
+    x, err := s.NewId()
+    if assert.Nil(t, err, fmt.Sprintf("%v", err)) && assert.Len(t, x, 2) {
+      assert.False(t, IsEmpty(x.(Key)[0]))
+      assert.Equal(t, 3, x.(Key)[1])
+    }
+    
+    v.B = 0
+    _, err = s.NewId()
+    assert.NotNil(t, err)
+    
+    assert.True(t, IsEmpty(Key{ident("A"), 0}))
+    assert.True(t, IsEmpty(Key{}))
+    assert.False(t, IsEmpty(Key{ident("A"), 1}))
+    
+    l, err := s.Values(true, Read)
+    if assert.Nil(t, err, fmt.Sprintf("%v", err)) {
+      assert.Equal(t, Columns{"a":ident(""),"b":0,"c":"C"}, l)
+    }
+  })
+  
+  // ---
+  
+  t.Run("G", func(t *testing.T) {
+    r := &compositeReferenceTester{ident("A"), &compositeTester{ident("B"), 2, "C"}}
+    s := Scanner(r)
+    
+    assert.Equal(t, []string{"a"},          sortedPrimaryKeys(s))
+    assert.Equal(t, []string{"r_a","r_b"},  sortedProperties(s))
+    
+    l, err := s.Values(false, Write)
+    if assert.Nil(t, err, fmt.Sprintf("%v", err)) {
+      assert.Equal(t, Columns{"r_a":ident("B"),"r_b":2}, l)
+    }
+    
+    d, z, err := s.Dests([]string{"a","r_a","r_b"})
+    if assert.Nil(t, err, fmt.Sprintf("%v", err)) && assert.Len(t, d, 3) {
+      reflect.ValueOf(d[0]).Elem().Set(reflect.ValueOf(ident("Q")))
+      reflect.ValueOf(z["r_a"]).Elem().Set(reflect.ValueOf(ident("X")))
+      reflect.ValueOf(z["r_b"]).Elem().Set(reflect.ValueOf(9))
+      assert.Equal(t, ident("Q"), r.A)
+      assert.Equal(t, ident("X"), reflect.ValueOf(z["r_a"]).Elem().Interface())
+      assert.Equal(t, 9, reflect.ValueOf(z["r_b"]).Elem().Interface())
+    }
+  })
+
 }
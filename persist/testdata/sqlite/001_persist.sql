@@ -0,0 +1,14 @@
+CREATE TABLE hp_persist_test_foreign (
+  id          TEXT NOT NULL PRIMARY KEY,
+  value       TEXT NOT NULL
+);
+
+CREATE TABLE hp_persist_test (
+  id          TEXT NOT NULL PRIMARY KEY,
+  name        TEXT NOT NULL,
+  foreign_id  TEXT REFERENCES hp_persist_test_foreign (id),
+  named_a     BOOLEAN NOT NULL DEFAULT FALSE,
+  named_b     TEXT NOT NULL DEFAULT '',
+  inline_a    TEXT NOT NULL DEFAULT '',
+  inline_b    INTEGER NOT NULL DEFAULT 0
+);
@@ -1,10 +1,10 @@
 package persist
 
 import (
-  "fmt"
   "time"
   "reflect"
   
+  "github.com/hirepurpose/godb"
   "github.com/hirepurpose/godb/uuid"
 )
 
@@ -23,6 +23,13 @@ func IsEmpty(v interface{}) bool {
       return c == uuid.Zero
     case time.Time:
       return c.IsZero()
+    case Key: // a composite identifier is empty if any of its values are
+      for _, e := range c {
+        if IsEmpty(e) {
+          return true
+        }
+      }
+      return len(c) == 0
   }
   
   val := reflect.ValueOf(v)
@@ -51,15 +58,27 @@ func typeName(v reflect.Value) string {
   }
 }
 
-// Generate an SQL argument list
-func arglist(s, n int) string {
+// Generate an SQL argument list with placeholders in the provided dialect
+func arglist(d godb.Dialect, s, n int) string {
   var l string
   for i := 0; i < n; i++ {
     if i > 0 {
-      l += fmt.Sprintf(", $%d", s + i)
-    }else{
-      l += fmt.Sprintf("$%d", s + i)
+      l += ", "
     }
+    l += d.Placeholder(s + i)
+  }
+  return l
+}
+
+// Generate a condition which matches the provided key columns, with placeholders
+// in the provided dialect beginning with the s-th argument
+func keyCondition(d godb.Dialect, s int, keys []string) string {
+  var l string
+  for i, e := range keys {
+    if i > 0 {
+      l += " AND "
+    }
+    l += e +" = "+ d.Placeholder(s + i)
   }
   return l
 }
@@ -0,0 +1,67 @@
+package persist
+
+import (
+  "fmt"
+  "testing"
+  
+  "github.com/hirepurpose/godb"
+)
+
+import (
+  "github.com/stretchr/testify/assert"
+)
+
+func TestArglist(t *testing.T) {
+  assert.Equal(t, "", arglist(godb.Postgres, 1, 0))
+  assert.Equal(t, "$1, $2, $3", arglist(godb.Postgres, 1, 3))
+  assert.Equal(t, "$3, $4", arglist(godb.Postgres, 3, 2))
+  assert.Equal(t, "?1, ?2, ?3", arglist(godb.SQLite, 1, 3))
+  assert.Equal(t, "?, ?, ?", arglist(godb.MySQL, 1, 3))
+}
+
+func TestKeyValueList(t *testing.T) {
+  l, n, v := keyValueList(godb.Postgres, "", Columns{"id": 1})
+  assert.Equal(t, "id = $1", l)
+  assert.Equal(t, 1, n)
+  assert.Equal(t, []interface{}{1}, v)
+  
+  l, _, _ = keyValueList(godb.SQLite, "e", Columns{"id": 1})
+  assert.Equal(t, "e.id = ?1", l)
+  
+  l, _, _ = keyValueList(godb.MySQL, "", Columns{"id": 1})
+  assert.Equal(t, "id = ?", l)
+}
+
+func TestKeyCondition(t *testing.T) {
+  assert.Equal(t, "id = $1", keyCondition(godb.Postgres, 1, []string{"id"}))
+  assert.Equal(t, "a = $2 AND b = $3", keyCondition(godb.Postgres, 2, []string{"a", "b"}))
+  assert.Equal(t, "a = ? AND b = ?", keyCondition(godb.MySQL, 1, []string{"a", "b"}))
+  assert.Equal(t, []interface{}{1, "b"}, keyArgs(Key{1, "b"}))
+  assert.Equal(t, []interface{}{1}, keyArgs(1))
+}
+
+func TestUpsertClauses(t *testing.T) {
+  assert.Equal(t, []string{"a", "b"}, upsertColumns(Columns{"id": 1, "b": 2, "a": 3, "email": 4}, []string{"id"}, []string{"email"}))
+  assert.Equal(t, "(xmax = 0), id", returningList(godb.Postgres.Inserted(), []string{"id"}))
+  assert.Equal(t, "a, b", returningList(godb.SQLite.Inserted(), []string{"a", "b"}))
+  
+  c, err := godb.Postgres.OnConflict([]string{"id"}, "", []string{"a", "b"})
+  if assert.Nil(t, err, fmt.Sprint(err)) {
+    assert.Equal(t, "ON CONFLICT (id) DO UPDATE SET a = EXCLUDED.a, b = EXCLUDED.b", c)
+  }
+  c, err = godb.Postgres.OnConflict([]string{"id"}, "foo_email_key", nil)
+  if assert.Nil(t, err, fmt.Sprint(err)) {
+    assert.Equal(t, "ON CONFLICT ON CONSTRAINT foo_email_key DO NOTHING", c)
+  }
+  _, err = godb.SQLite.OnConflict([]string{"id"}, "foo_email_key", nil)
+  assert.NotNil(t, err)
+  c, err = godb.MySQL.OnConflict([]string{"id"}, "", nil)
+  if assert.Nil(t, err, fmt.Sprint(err)) {
+    assert.Equal(t, "ON DUPLICATE KEY UPDATE id = id", c)
+  }
+  
+  assert.Equal(t, UpsertUnchanged, upsertedByRowsAffected(godb.Postgres, 0))
+  assert.Equal(t, UpsertStored, upsertedByRowsAffected(godb.SQLite, 1))
+  assert.Equal(t, UpsertInserted, upsertedByRowsAffected(godb.MySQL, 1))
+  assert.Equal(t, UpsertUpdated, upsertedByRowsAffected(godb.MySQL, 2))
+}
@@ -2,6 +2,9 @@ package pql
 
 import (
   "fmt"
+  "context"
+  
+  "github.com/hirepurpose/godb"
 )
 
 import (
@@ -55,12 +58,17 @@ type Query struct {
 
 // Parse an entity SQL query
 func Parse(q string, avail []string) (*Query, error) {
+  return ParseWithLogger(q, avail, godb.DefaultLogger())
+}
+
+// Parse an entity SQL query, tracing to the provided logger
+func ParseWithLogger(q string, avail []string, log godb.Logger) (*Query, error) {
   var i, esc, open, tail int
   var c, seq rune
   var out string
   
   if debug.TRACE {
-    fmt.Println("<Q>", q)
+    log.Log(context.Background(), godb.LevelDebug, "pql: <Q>", godb.Fields{godb.FieldStatement: q})
   }
   
   var cols []string
@@ -126,7 +134,7 @@ func Parse(q string, avail []string) (*Query, error) {
   }
   
   if debug.TRACE {
-    fmt.Println("<R>", out)
+    log.Log(context.Background(), godb.LevelDebug, "pql: <R>", godb.Fields{godb.FieldStatement: out})
   }
   
   return &Query{out, cols}, nil
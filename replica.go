@@ -0,0 +1,253 @@
+package godb
+
+import (
+  "fmt"
+  "time"
+  "sync"
+  "context"
+  "net/url"
+  "sync/atomic"
+  "database/sql"
+)
+
+const (
+  REPLICA_CHECK_INTERVAL_DEFAULT  = time.Second * 5
+  REPLICA_CHECK_TIMEOUT           = time.Second
+  REPLICA_MAX_LAG_DEFAULT         = time.Second * 30
+)
+
+// Context keys under which primary pinning and replica reads are stored
+type primaryContextKey struct{}
+type replicaContextKey struct{}
+
+// Pin reads performed under the returned context to the primary, e.g., to read
+// your own writes. This takes precedence over WithReplica. This only affects the
+// Database; transactions always execute on the primary.
+func WithPrimary(ctx context.Context) context.Context {
+  return context.WithValue(ctx, primaryContextKey{}, true)
+}
+
+// Allow reads performed under the returned context to be served by a healthy
+// replica. Queries are otherwise executed on the primary, since a statement which
+// returns rows may also write, e.g., INSERT ... RETURNING; only ORM fetches allow
+// replicas by default. This only affects the Database; transactions always execute
+// on the primary.
+func WithReplica(ctx context.Context) context.Context {
+  return context.WithValue(ctx, replicaContextKey{}, true)
+}
+
+// Determine if reads under a context are pinned to the primary
+func isPinned(ctx context.Context) bool {
+  if ctx == nil {
+    return false
+  }
+  v, _ := ctx.Value(primaryContextKey{}).(bool)
+  return v
+}
+
+// Determine if reads under a context may be served by a replica
+func allowsReplica(ctx context.Context) bool {
+  if ctx == nil {
+    return false
+  }
+  v, _ := ctx.Value(replicaContextKey{}).(bool)
+  return v && !isPinned(ctx)
+}
+
+// A read replica
+type replica struct {
+  db      *sql.DB
+  host    string
+  dialect Dialect
+  healthy int32
+}
+
+// Determine if this replica is healthy
+func (r *replica) isHealthy() bool {
+  return atomic.LoadInt32(&r.healthy) != 0
+}
+
+// Measure the replication lag of this replica. If the dialect cannot measure
+// replication lag, the replica is pinged instead and its lag is zero.
+func (r *replica) lag(ctx context.Context) (time.Duration, error) {
+  ctx, cancel := context.WithTimeout(ctx, REPLICA_CHECK_TIMEOUT)
+  defer cancel()
+  var lag float64
+  var err error
+  if q := r.dialect.ReplicaLag(); q != "" {
+    err = r.db.QueryRowContext(ctx, q).Scan(&lag)
+  }else{
+    err = r.db.PingContext(ctx)
+  }
+  if err != nil && err != sql.ErrNoRows { // no rows means the replica is not in recovery, so it has no lag
+    return 0, NewErrorWithDialect(r.dialect, "health", err)
+  }
+  return time.Duration(lag * float64(time.Second)), nil
+}
+
+// Check the health of this replica, which is unhealthy if it cannot be reached or,
+// when max is positive, if it lags the primary by more than max
+func (r *replica) check(ctx context.Context, max time.Duration) error {
+  lag, err := r.lag(ctx)
+  if err == nil && max > 0 && lag > max {
+    err = fmt.Errorf("Replication lag %v exceeds %v", lag, max)
+  }
+  if err != nil {
+    atomic.StoreInt32(&r.healthy, 0)
+  }else{
+    atomic.StoreInt32(&r.healthy, 1)
+  }
+  return err
+}
+
+// A set of read replicas which are periodically checked for health
+type replicaSet struct {
+  replicas  []*replica
+  next      uint32
+  maxLag    time.Duration
+  log       Logger
+  stop      chan struct{}
+  done      sync.WaitGroup
+}
+
+// Open connections to the replicas described by the options and begin checking
+// their health
+func newReplicaSet(opts Options, dialect Dialect, log Logger) (*replicaSet, error) {
+  s := &replicaSet{log:log, stop:make(chan struct{})}
+  
+  s.maxLag = opts.ReplicaMaxLag
+  if s.maxLag == 0 {
+    s.maxLag = REPLICA_MAX_LAG_DEFAULT
+  }
+  
+  for _, e := range opts.Replicas {
+    dsn, _, err := ParseOptions(e) // options are taken from the primary; any provided here are ignored
+    if err != nil {
+      s.Close()
+      return nil, err
+    }
+    u, err := url.Parse(dsn)
+    if err != nil {
+      s.Close()
+      return nil, err
+    }
+    driver, dsn, err := dialect.DataSource(u)
+    if err != nil {
+      s.Close()
+      return nil, err
+    }
+    db, err := open(driver, dsn, dialect, opts)
+    if err != nil {
+      s.Close()
+      return nil, fmt.Errorf("Could not open replica connection: %v", err)
+    }
+    s.replicas = append(s.replicas, &replica{db:db, host:u.Host, dialect:dialect})
+  }
+  
+  s.check(context.Background())
+  
+  ival := opts.ReplicaCheckInterval
+  if ival <= 0 {
+    ival = REPLICA_CHECK_INTERVAL_DEFAULT
+  }
+  s.done.Add(1)
+  go s.monitor(ival)
+  
+  return s, nil
+}
+
+// Check the health of every replica
+func (s *replicaSet) check(ctx context.Context) {
+  for _, e := range s.replicas {
+    was := e.isHealthy()
+    err := e.check(ctx, s.maxLag)
+    if err != nil && was {
+      s.log.Log(ctx, LevelWarn, "store: Replica is unhealthy", Fields{"host": e.host, FieldError: err})
+    }else if err == nil && !was {
+      s.log.Log(ctx, LevelInfo, "store: Replica is healthy", Fields{"host": e.host})
+    }
+  }
+}
+
+// Periodically check the health of every replica until the set is closed
+func (s *replicaSet) monitor(ival time.Duration) {
+  defer s.done.Done()
+  t := time.NewTicker(ival)
+  defer t.Stop()
+  for {
+    select {
+      case <-s.stop:
+        return
+      case <-t.C:
+        s.check(context.Background())
+    }
+  }
+}
+
+// Select a healthy replica, if there is one
+func (s *replicaSet) pick() *replica {
+  n := len(s.replicas)
+  if n < 1 {
+    return nil
+  }
+  b := int(atomic.AddUint32(&s.next, 1))
+  for i := 0; i < n; i++ {
+    if r := s.replicas[(b + i) % n]; r.isHealthy() {
+      return r
+    }
+  }
+  return nil
+}
+
+// Stop checking health and close every replica connection
+func (s *replicaSet) Close() {
+  select {
+    case <-s.stop:
+      return // already closed
+    default:
+      close(s.stop)
+  }
+  s.done.Wait()
+  for _, e := range s.replicas {
+    e.db.Close()
+  }
+}
+
+// Resolve the connection pool that reads under the provided context should use
+func (d *Database) reader(ctx context.Context) *sql.DB {
+  if d.replicas == nil || !allowsReplica(ctx) {
+    return d.db
+  }
+  if r := d.replicas.pick(); r != nil {
+    return r.db
+  }
+  return d.db
+}
+
+// Obtain a context which executes every statement, including reads which allow
+// replicas such as ORM fetches, on the primary. This is useful for reading your
+// own writes outside of a transaction.
+func (d *Database) Primary() Context {
+  return primaryContext{d}
+}
+
+// A context which executes every statement on the primary
+type primaryContext struct {
+  *Database
+}
+
+func (p primaryContext) Query(query string, args ...interface{}) (*sql.Rows, error) {
+  return p.Database.QueryContext(WithPrimary(context.Background()), query, args...)
+}
+
+func (p primaryContext) QueryRow(query string, args ...interface{}) *sql.Row {
+  return p.Database.QueryRowContext(WithPrimary(context.Background()), query, args...)
+}
+
+func (p primaryContext) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+  return p.Database.QueryContext(WithPrimary(ctx), query, args...)
+}
+
+func (p primaryContext) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+  return p.Database.QueryRowContext(WithPrimary(ctx), query, args...)
+}
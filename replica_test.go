@@ -0,0 +1,107 @@
+package godb_test
+
+import (
+  "fmt"
+  "time"
+  "context"
+  "testing"
+  "database/sql/driver"
+  
+  "github.com/hirepurpose/godb"
+  "github.com/hirepurpose/godb/test"
+)
+
+import (
+  "github.com/stretchr/testify/assert"
+)
+
+// A fake replica which reports the provided replication lag
+func newReplicaDB(name string, lag time.Duration) *test.FakeDB {
+  return test.NewFakeDB(name, func(q string, args []driver.Value) (*test.FakeResult, error) {
+    if q == godb.Postgres.ReplicaLag() {
+      return &test.FakeResult{Rows:[][]driver.Value{{lag.Seconds()}}}, nil
+    }
+    return nil, nil
+  })
+}
+
+func TestReplicaRouting(t *testing.T) {
+  primary := test.NewFakeDB("replica_routing_primary", nil)
+  replica := newReplicaDB("replica_routing_replica", 0)
+  db, err := test.NewFakeDatabase(godb.Options{}, primary, replica)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  defer db.Close()
+  
+  ctx := context.Background()
+  tests := []struct {
+    Name    string
+    Query   func() error
+    Replica bool
+  }{
+    {"Query", func() error { _, err := db.Query("SELECT 1"); return err }, false},
+    {"QueryRow", func() error { return db.QueryRow("INSERT INTO t (v) VALUES (1) RETURNING id").Err() }, false},
+    {"WithReplica", func() error { _, err := db.QueryContext(godb.WithReplica(ctx), "SELECT 1"); return err }, true},
+    {"WithReplica (row)", func() error { return db.QueryRowContext(godb.WithReplica(ctx), "SELECT 1").Err() }, true},
+    {"WithPrimary", func() error { _, err := db.QueryContext(godb.WithPrimary(godb.WithReplica(ctx)), "SELECT 1"); return err }, false},
+    {"Primary", func() error { _, err := db.Primary().QueryContext(godb.WithReplica(ctx), "SELECT 1"); return err }, false},
+    {"Transaction", func() error {
+      return db.Transaction(func(cxt godb.Context) error {
+        _, err := cxt.QueryContext(godb.WithReplica(ctx), "SELECT 1")
+        return err
+      })
+    }, false},
+  }
+  for _, e := range tests {
+    primary.Reset()
+    replica.Reset()
+    err := e.Query()
+    if !assert.Nil(t, err, fmt.Sprintf("%s: %v", e.Name, err)) {
+      continue
+    }
+    if e.Replica {
+      assert.Len(t, replica.Statements(), 1, e.Name)
+      assert.Len(t, primary.Statements(), 0, e.Name)
+    }else{
+      assert.Len(t, replica.Statements(), 0, e.Name)
+      assert.NotEqual(t, 0, len(primary.Statements()), e.Name)
+    }
+  }
+}
+
+func TestReplicaMaxLag(t *testing.T) {
+  tests := []struct {
+    MaxLag  time.Duration
+    Lag     time.Duration
+    Healthy bool
+  }{
+    {0, time.Second, true},
+    {0, time.Minute, false}, // the default limit
+    {time.Minute * 2, time.Minute, true},
+    {time.Second, time.Second * 2, false},
+    {-1, time.Hour, true}, // no limit
+  }
+  for i, e := range tests {
+    primary := newHealthDB(fmt.Sprintf("replica_lag_primary_%d", i), map[string]int64{})
+    replica := newReplicaDB(fmt.Sprintf("replica_lag_replica_%d", i), e.Lag)
+    db, err := test.NewFakeDatabase(godb.Options{ReplicaMaxLag:e.MaxLag}, primary, replica)
+    if !assert.Nil(t, err, fmt.Sprint(err)) {
+      return
+    }
+    
+    // a lagging replica is unhealthy, so reads fall back to the primary
+    replica.Reset()
+    _, err = db.QueryContext(godb.WithReplica(context.Background()), godb.Postgres.Version())
+    if assert.Nil(t, err, fmt.Sprint(err)) {
+      assert.Equal(t, e.Healthy, len(replica.Statements()) == 1, fmt.Sprint(i))
+    }
+    
+    h, err := db.Health()
+    if assert.Nil(t, err, fmt.Sprint(err)) && assert.Len(t, h.Replicas, 1, fmt.Sprint(i)) {
+      assert.Equal(t, e.Healthy, h.Replicas[0].Healthy, fmt.Sprint(i))
+      assert.Equal(t, e.Lag, h.Replicas[0].Lag, fmt.Sprint(i))
+    }
+    db.Close()
+  }
+}
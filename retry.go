@@ -0,0 +1,121 @@
+package godb
+
+import (
+  "time"
+  "errors"
+  "context"
+  "math/rand"
+)
+
+import (
+  "github.com/rcrowley/go-metrics"
+)
+
+const (
+  RETRY_ATTEMPTS_DEFAULT      = 5
+  RETRY_MIN_BACKOFF_DEFAULT   = time.Millisecond * 10
+  RETRY_MAX_BACKOFF_DEFAULT   = time.Second
+)
+
+// Metrics
+var (
+  retryCountMetric metrics.Counter
+)
+
+// Setup metrics
+func init() {
+  retryCountMetric = metrics.NewCounter()
+  metrics.Register("godb.transaction.retry", retryCountMetric)
+}
+
+// A transaction retry policy. Transactions which fail with a retryable error are
+// retried up to Attempts times in total, waiting a jittered, exponentially
+// increasing interval between MinBackoff and MaxBackoff before each retry.
+// 
+// Retryable determines which errors are retried. If it is nil, only serialization
+// failures and deadlocks are retried, as determined by IsRetryable. A broader
+// predicate, such as IsTransient, may be provided to also retry failures like
+// unavailable locks or lost connections.
+type RetryPolicy struct {
+  Attempts    int
+  MinBackoff  time.Duration
+  MaxBackoff  time.Duration
+  Retryable   func(error) bool
+}
+
+// The default retry policy
+var DefaultRetryPolicy = RetryPolicy{
+  Attempts:   RETRY_ATTEMPTS_DEFAULT,
+  MinBackoff: RETRY_MIN_BACKOFF_DEFAULT,
+  MaxBackoff: RETRY_MAX_BACKOFF_DEFAULT,
+}
+
+// Compute the interval to wait before the provided retry attempt (base 1)
+func (p RetryPolicy) backoff(n int) time.Duration {
+  d := p.MinBackoff
+  if d <= 0 {
+    return 0
+  }
+  for i := 1; i < n && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+    d *= 2
+  }
+  if p.MaxBackoff > 0 && d > p.MaxBackoff {
+    d = p.MaxBackoff
+  }
+  return d / 2 + time.Duration(rand.Int63n(int64(d / 2) + 1))
+}
+
+// Execute in a transaction, as with Transaction, retrying the entire transaction
+// according to the provided policy if it fails with a retryable error. A connection
+// failure while committing is never retried, since the transaction may have been
+// committed. The handler may be invoked more than once and must not have side
+// effects outside the transaction.
+func (d *Database) TransactionRetry(p RetryPolicy, h TransactionHandler) error {
+  return d.TransactionRetryContext(context.Background(), p, h)
+}
+
+// Execute in a retrying transaction, as with TransactionRetry, under the provided
+// context.Context. If ctx is associated with a transaction the handler is executed
+// in a savepoint and is not retried, since the failure aborts the enclosing
+// transaction; the enclosing transaction should be retried instead.
+func (d *Database) TransactionRetryContext(ctx context.Context, p RetryPolicy, h TransactionHandler) error {
+  return d.TransactionWithOptionsContext(ctx, TxOptions{Retry:&p}, h)
+}
+
+// Execute in a new transaction, retrying according to the provided policy
+func (d *Database) retry(ctx context.Context, p RetryPolicy, opts TxOptions, h TransactionHandler) error {
+  var err error
+  for i := 1; ; i++ {
+    err = d.transaction(ctx, opts, h)
+    if err == nil || !p.retryable(err) || i >= p.Attempts {
+      break
+    }
+    
+    retryCountMetric.Inc(1)
+    d.log.Log(ctx, LevelWarn, "store: Retrying transaction", Fields{"attempt": i + 1, FieldError: err})
+    
+    t := time.NewTimer(p.backoff(i))
+    select {
+      case <-ctx.Done():
+        t.Stop()
+        return ctx.Err()
+      case <-t.C:
+    }
+  }
+  return err
+}
+
+// Determine if a failed transaction may be retried under this policy. A connection
+// failure while committing is ambiguous, since the transaction may have been
+// committed, so it is not retried.
+func (p RetryPolicy) retryable(err error) bool {
+  var x *Error
+  if errors.As(err, &x) && x.Op == "commit" && x.Kind == KindConnection {
+    return false
+  }
+  if p.Retryable != nil {
+    return p.Retryable(err)
+  }else{
+    return IsRetryable(err)
+  }
+}
@@ -0,0 +1,139 @@
+package godb_test
+
+import (
+  "fmt"
+  "time"
+  "errors"
+  "context"
+  "testing"
+  "database/sql/driver"
+  
+  "github.com/hirepurpose/godb"
+  "github.com/hirepurpose/godb/test"
+)
+
+import (
+  "github.com/lib/pq"
+  "github.com/rcrowley/go-metrics"
+  "github.com/stretchr/testify/assert"
+)
+
+// The number of transaction retries recorded so far
+func retries() int64 {
+  return metrics.DefaultRegistry.Get("godb.transaction.retry").(metrics.Counter).Count()
+}
+
+// A handler which fails with a serialization failure the first n times it is invoked
+func failing(n int, attempts *int) godb.TransactionHandler {
+  return func(cxt godb.Context) error {
+    *attempts++
+    if *attempts <= n {
+      return &godb.Error{Kind:godb.KindSerializationFailure, Op:"exec", Cause:errors.New("Could not serialize access")}
+    }
+    return nil
+  }
+}
+
+func TestRetryBackoff(t *testing.T) {
+  p := godb.RetryPolicy{Attempts:10, MinBackoff:time.Millisecond * 10, MaxBackoff:time.Millisecond * 100}
+  for i := 0; i < 100; i++ {
+    for n, e := range []time.Duration{10, 20, 40, 80, 100, 100, 100} {
+      max := e * time.Millisecond
+      d := p.Backoff(n + 1)
+      assert.True(t, d >= max / 2 && d <= max, fmt.Sprintf("Backoff %d: %v not in [%v, %v]", n + 1, d, max / 2, max))
+    }
+  }
+  
+  assert.Equal(t, time.Duration(0), godb.RetryPolicy{Attempts:3}.Backoff(1))
+  d := godb.RetryPolicy{Attempts:100, MinBackoff:time.Millisecond}.Backoff(30) // unbounded
+  assert.True(t, d >= time.Millisecond << 28, fmt.Sprint(d))
+}
+
+func TestRetry(t *testing.T) {
+  f := test.NewFakeDB("retry", nil)
+  db, err := test.NewFakeDatabase(godb.Options{}, f)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  defer db.Close()
+  
+  p := godb.RetryPolicy{Attempts:4, MinBackoff:time.Millisecond, MaxBackoff:time.Millisecond * 2}
+  
+  // succeeds after failing fewer times than the policy allows
+  n, base := 0, retries()
+  err = db.TransactionRetry(p, failing(2, &n))
+  assert.Nil(t, err, fmt.Sprint(err))
+  assert.Equal(t, 3, n)
+  assert.Equal(t, int64(2), retries() - base)
+  assert.Equal(t, []string{"BEGIN", "ROLLBACK", "BEGIN", "ROLLBACK", "BEGIN", "COMMIT"}, f.Statements())
+  
+  // gives up once the attempts are exhausted
+  f.Reset()
+  n, base = 0, retries()
+  err = db.TransactionRetry(p, failing(10, &n))
+  assert.True(t, errors.Is(err, godb.ErrSerializationFailure), fmt.Sprint(err))
+  assert.Equal(t, 4, n)
+  assert.Equal(t, int64(3), retries() - base)
+  
+  // errors which are not retryable are returned immediately
+  n, base = 0, retries()
+  errFail := errors.New("Failed")
+  err = db.TransactionRetry(p, func(cxt godb.Context) error {
+    n++
+    return errFail
+  })
+  assert.Equal(t, errFail, err)
+  assert.Equal(t, 1, n)
+  assert.Equal(t, int64(0), retries() - base)
+  
+  // other temporary failures are only retried when the policy asks for them
+  locked := func(cxt godb.Context) error {
+    n++
+    return &godb.Error{Kind:godb.KindLockNotAvailable, Op:"exec", Cause:errors.New("Could not obtain lock")}
+  }
+  n, base = 0, retries()
+  err = db.TransactionRetry(p, locked)
+  assert.True(t, errors.Is(err, godb.ErrLockNotAvailable), fmt.Sprint(err))
+  assert.Equal(t, 1, n)
+  assert.Equal(t, int64(0), retries() - base)
+  
+  n, base = 0, retries()
+  broad := p
+  broad.Retryable = godb.IsTransient
+  err = db.TransactionRetry(broad, locked)
+  assert.True(t, errors.Is(err, godb.ErrLockNotAvailable), fmt.Sprint(err))
+  assert.Equal(t, 4, n)
+  assert.Equal(t, int64(3), retries() - base)
+  
+  // waiting to retry is canceled along with the context
+  ctx, cancel := context.WithCancel(context.Background())
+  n = 0
+  err = db.TransactionRetryContext(ctx, godb.RetryPolicy{Attempts:4, MinBackoff:time.Hour}, func(cxt godb.Context) error {
+    cancel()
+    return failing(10, &n)(cxt)
+  })
+  assert.Equal(t, context.Canceled, err)
+  assert.Equal(t, 1, n)
+}
+
+func TestRetryCommitFailure(t *testing.T) {
+  f := test.NewFakeDB("retry_commit", func(q string, args []driver.Value) (*test.FakeResult, error) {
+    if q == "COMMIT" {
+      return nil, &pq.Error{Code:"08006", Message:"Connection failure"}
+    }
+    return nil, nil
+  })
+  db, err := test.NewFakeDatabase(godb.Options{}, f)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  defer db.Close()
+  
+  // the transaction may have been committed, so it is not retried even when the
+  // policy retries connection failures
+  n, base := 0, retries()
+  err = db.TransactionRetry(godb.RetryPolicy{Attempts:4, MinBackoff:time.Millisecond, Retryable:godb.IsTransient}, failing(0, &n))
+  assert.True(t, errors.Is(err, godb.ErrConnection), fmt.Sprint(err))
+  assert.Equal(t, 1, n)
+  assert.Equal(t, int64(0), retries() - base)
+}
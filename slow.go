@@ -0,0 +1,226 @@
+package godb
+
+import (
+  "fmt"
+  "sync"
+  "time"
+  "context"
+  "strings"
+  "database/sql"
+)
+
+import (
+  "github.com/bww/go-util/text"
+)
+
+const (
+  SLOW_QUERY_THRESHOLD_DEFAULT  = time.Millisecond * 250
+  EXPLAIN_INTERVAL_DEFAULT      = time.Minute
+  explainHistoryMax             = 1024
+)
+
+// Context key under which the caller of a statement is stored
+type callerContextKey struct{}
+
+// Describes the code on whose behalf a statement is executed, such as the
+// persister and entity type of an ORM operation
+type Caller struct {
+  Table   string
+  Entity  string
+}
+
+// Annotate a context with the caller of the statements executed under it
+func WithCaller(ctx context.Context, c Caller) context.Context {
+  return context.WithValue(ctx, callerContextKey{}, c)
+}
+
+// Obtain the caller of the statements executed under a context, if any
+func CallerFrom(ctx context.Context) (Caller, bool) {
+  if ctx == nil {
+    return Caller{}, false
+  }
+  c, ok := ctx.Value(callerContextKey{}).(Caller)
+  return c, ok
+}
+
+// Slow query options
+type SlowQueryOptions struct {
+  Threshold       time.Duration // statements which take at least this long are logged; defaults to SLOW_QUERY_THRESHOLD_DEFAULT
+  Explain         bool          // capture the plan of slow statements with EXPLAIN, in JSON, for dialects which support it
+  ExplainInterval time.Duration // the minimum interval between plans captured for the same statement fingerprint; defaults to EXPLAIN_INTERVAL_DEFAULT
+  IncludeArgs     bool          // log statement argument values; by default only their types are logged
+  Logger          Logger        // the logger; defaults to DefaultLogger()
+}
+
+// State shared by copies of a slow query context
+type slowQueryState struct {
+  sync.Mutex
+  explained map[string]time.Time // when a plan was last captured, by statement fingerprint
+}
+
+// A context which logs statements that take longer than a threshold. Records
+// are logged at LevelWarn with the statement, its arguments, its duration and,
+// when the statement was executed under a context annotated by WithCaller, the
+// table and entity on whose behalf it was executed. The plan of a slow statement
+// is optionally captured and attached to the record; since EXPLAIN (without
+// ANALYZE) does not execute the statement, this is safe for writes as well.
+type SlowQueryContext struct {
+  cxt   Context
+  opts  SlowQueryOptions
+  state *slowQueryState
+}
+
+// Create a slow query context with default options
+func NewSlowQueryContext(cxt Context) SlowQueryContext {
+  return NewSlowQueryContextWithOptions(cxt, SlowQueryOptions{})
+}
+
+// Create a slow query context with options
+func NewSlowQueryContextWithOptions(cxt Context, opts SlowQueryOptions) SlowQueryContext {
+  if opts.Threshold <= 0 {
+    opts.Threshold = SLOW_QUERY_THRESHOLD_DEFAULT
+  }
+  if opts.ExplainInterval <= 0 {
+    opts.ExplainInterval = EXPLAIN_INTERVAL_DEFAULT
+  }
+  opts.Logger = loggerOrDefault(opts.Logger)
+  return SlowQueryContext{cxt, opts, &slowQueryState{explained:make(map[string]time.Time)}}
+}
+
+// Implement Wrapper
+func (s SlowQueryContext) Unwrap() Context {
+  return s.cxt
+}
+
+// Obtain the logger
+func (s SlowQueryContext) Logger() Logger {
+  return s.opts.Logger
+}
+
+// Determine if the plan of a statement should be captured now; if so, the
+// capture is recorded
+func (s SlowQueryContext) shouldExplain(query string) bool {
+  if !s.opts.Explain || !explainable(query) {
+    return false
+  }
+  fp := Fingerprint(query)
+  now := time.Now()
+  st := s.state
+  st.Lock()
+  defer st.Unlock()
+  if t, ok := st.explained[fp]; ok && now.Sub(t) < s.opts.ExplainInterval {
+    return false
+  }
+  if len(st.explained) >= explainHistoryMax {
+    for k, t := range st.explained {
+      if now.Sub(t) >= s.opts.ExplainInterval {
+        delete(st.explained, k)
+      }
+    }
+    if len(st.explained) >= explainHistoryMax {
+      return false // too many distinct statements are being explained; skip this one
+    }
+  }
+  st.explained[fp] = now
+  return true
+}
+
+// Determine if the wrapped context is a transaction
+func (s SlowQueryContext) transactional() bool {
+  _, ok := Transactional(s.cxt)
+  return ok
+}
+
+// Determine if a statement can be explained
+func explainable(query string) bool {
+  f := strings.Fields(query)
+  if len(f) < 1 {
+    return false
+  }
+  switch strings.ToUpper(f[0]) {
+    case "SELECT", "INSERT", "UPDATE", "DELETE", "WITH", "VALUES":
+      return true
+    default:
+      return false
+  }
+}
+
+// Produce statement arguments for logging
+func (s SlowQueryContext) logArgs(args []interface{}) []interface{} {
+  if s.opts.IncludeArgs {
+    return args
+  }
+  r := make([]interface{}, len(args))
+  for i, e := range args {
+    if e != nil {
+      r[i] = fmt.Sprintf("<%T>", e)
+    }
+  }
+  return r
+}
+
+// Log a statement if it was slow. A plan is captured only if explain is true; if
+// the statement failed, no plan is captured, since within a transaction the failure
+// prevents further statements.
+func (s SlowQueryContext) check(ctx context.Context, op, query string, args []interface{}, start time.Time, err error, explain bool) {
+  d := time.Since(start)
+  if d < s.opts.Threshold {
+    return
+  }
+  f := Fields{
+    FieldStatement: text.CollapseSpaces(query),
+    FieldArgs:      s.logArgs(args),
+    FieldDuration:  d,
+  }
+  if c, ok := CallerFrom(ctx); ok {
+    f[FieldTable] = c.Table
+    f[FieldEntity] = c.Entity
+  }
+  if err != nil {
+    f[FieldError] = err
+  }else if q := DialectOf(s.cxt).Explain(query); q != "" && explain && s.shouldExplain(query) {
+    var plan string
+    perr := s.cxt.QueryRowContext(ctx, q, args...).Scan(&plan)
+    if perr != nil {
+      f[FieldPlan] = fmt.Sprintf("<%v>", perr)
+    }else{
+      f[FieldPlan] = plan
+    }
+  }
+  s.opts.Logger.Log(ctx, LevelWarn, "db/slow/"+ op +":", f)
+}
+
+func (s SlowQueryContext) Exec(query string, args ...interface{}) (sql.Result, error) {
+  return s.ExecContext(ContextFrom(s.cxt), query, args...)
+}
+
+func (s SlowQueryContext) Query(query string, args ...interface{}) (*sql.Rows, error) {
+  return s.QueryContext(ContextFrom(s.cxt), query, args...)
+}
+
+func (s SlowQueryContext) QueryRow(query string, args ...interface{}) *sql.Row {
+  return s.QueryRowContext(ContextFrom(s.cxt), query, args...)
+}
+
+func (s SlowQueryContext) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+  start := time.Now()
+  r, err := s.cxt.ExecContext(ctx, query, args...)
+  s.check(ctx, "exec", query, args, start, err, true)
+  return r, err
+}
+
+// Execute a query. The rows of a query remain open after it returns, so within a
+// transaction, which allows only one open statement at a time, no plan is captured.
+func (s SlowQueryContext) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+  start := time.Now()
+  r, err := s.cxt.QueryContext(ctx, query, args...)
+  s.check(ctx, "query/n", query, args, start, err, !s.transactional())
+  return r, err
+}
+
+func (s SlowQueryContext) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+  start := time.Now()
+  r := s.cxt.QueryRowContext(ctx, query, args...)
+  s.check(ctx, "query/1", query, args, start, r.Err(), !s.transactional())
+  return r
+}
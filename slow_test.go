@@ -0,0 +1,245 @@
+package godb_test
+
+import (
+  "fmt"
+  "sync"
+  "time"
+  "errors"
+  "context"
+  "strings"
+  "testing"
+  "database/sql/driver"
+  
+  "github.com/hirepurpose/godb"
+  "github.com/hirepurpose/godb/test"
+)
+
+import (
+  "github.com/stretchr/testify/assert"
+)
+
+// A logged record
+type record struct {
+  Level   godb.Level
+  Message string
+  Fields  godb.Fields
+}
+
+// A logger which captures records
+type captureLogger struct {
+  sync.Mutex
+  records []record
+}
+
+func (l *captureLogger) Log(ctx context.Context, level godb.Level, msg string, fields godb.Fields) {
+  l.Lock()
+  defer l.Unlock()
+  l.records = append(l.records, record{level, msg, fields})
+}
+
+// Obtain and discard the captured records
+func (l *captureLogger) Records() []record {
+  l.Lock()
+  defer l.Unlock()
+  r := l.records
+  l.records = nil
+  return r
+}
+
+const slowDelay = time.Millisecond * 20
+
+// A handler which delays statements that mention slow and answers EXPLAIN with a plan
+func slowHandler(q string, args []driver.Value) (*test.FakeResult, error) {
+  if strings.HasPrefix(q, "EXPLAIN") {
+    return &test.FakeResult{Columns:[]string{"plan"}, Rows:[][]driver.Value{{`[{"Plan":{}}]`}}}, nil
+  }
+  if strings.Contains(q, "slow") {
+    time.Sleep(slowDelay)
+  }
+  if strings.Contains(q, "fail") {
+    return nil, errors.New("Failed")
+  }
+  return &test.FakeResult{Columns:[]string{"n"}, Rows:[][]driver.Value{{int64(1)}}, RowsAffected:1}, nil
+}
+
+// Select the EXPLAIN statements which were executed
+func explained(stmts []string) []string {
+  var r []string
+  for _, e := range stmts {
+    if strings.HasPrefix(e, "EXPLAIN") {
+      r = append(r, e)
+    }
+  }
+  return r
+}
+
+func TestSlowQueryThreshold(t *testing.T) {
+  f := test.NewFakeDB("slow_threshold", slowHandler)
+  db, err := test.NewFakeDatabase(godb.Options{}, f)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  defer db.Close()
+  
+  log := &captureLogger{}
+  cxt := godb.NewSlowQueryContextWithOptions(db, godb.SlowQueryOptions{Threshold:slowDelay / 2, Logger:log})
+  
+  // fast statements are not logged
+  _, err = cxt.Exec("UPDATE fast SET a = $1", "secret")
+  assert.Nil(t, err, fmt.Sprint(err))
+  assert.Len(t, log.Records(), 0)
+  
+  // slow statements are, with their argument values redacted
+  _, err = cxt.Exec("UPDATE slow SET a = $1, b = $2", "secret", nil)
+  assert.Nil(t, err, fmt.Sprint(err))
+  if r := log.Records(); assert.Len(t, r, 1) {
+    assert.Equal(t, godb.LevelWarn, r[0].Level)
+    assert.Equal(t, "db/slow/exec:", r[0].Message)
+    assert.Equal(t, "UPDATE slow SET a = $1, b = $2", r[0].Fields[godb.FieldStatement])
+    assert.Equal(t, []interface{}{"<string>", nil}, r[0].Fields[godb.FieldArgs])
+    assert.True(t, r[0].Fields[godb.FieldDuration].(time.Duration) >= slowDelay)
+    assert.Nil(t, r[0].Fields[godb.FieldPlan])
+    assert.Nil(t, r[0].Fields[godb.FieldTable])
+  }
+  
+  // failures are logged with their error
+  var n int64
+  err = cxt.QueryRow("SELECT slow FROM fail WHERE a = $1", 1).Scan(&n)
+  assert.NotNil(t, err)
+  if r := log.Records(); assert.Len(t, r, 1) {
+    assert.Equal(t, "db/slow/query/1:", r[0].Message)
+    assert.NotNil(t, r[0].Fields[godb.FieldError])
+  }
+}
+
+func TestSlowQueryArgsAndCaller(t *testing.T) {
+  f := test.NewFakeDB("slow_caller", slowHandler)
+  db, err := test.NewFakeDatabase(godb.Options{}, f)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  defer db.Close()
+  
+  log := &captureLogger{}
+  cxt := godb.NewSlowQueryContextWithOptions(db, godb.SlowQueryOptions{Threshold:slowDelay / 2, IncludeArgs:true, Logger:log})
+  
+  ctx := godb.WithCaller(context.Background(), godb.Caller{Table:"users", Entity:"*app.User"})
+  rows, err := cxt.QueryContext(ctx, "SELECT a FROM slow WHERE b = $1", "value")
+  if assert.Nil(t, err, fmt.Sprint(err)) {
+    rows.Close()
+  }
+  if r := log.Records(); assert.Len(t, r, 1) {
+    assert.Equal(t, "db/slow/query/n:", r[0].Message)
+    assert.Equal(t, []interface{}{"value"}, r[0].Fields[godb.FieldArgs])
+    assert.Equal(t, "users", r[0].Fields[godb.FieldTable])
+    assert.Equal(t, "*app.User", r[0].Fields[godb.FieldEntity])
+  }
+}
+
+func TestSlowQueryExplain(t *testing.T) {
+  f := test.NewFakeDB("slow_explain", slowHandler)
+  db, err := test.NewFakeDatabase(godb.Options{}, f)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  defer db.Close()
+  
+  log := &captureLogger{}
+  interval := time.Millisecond * 100
+  cxt := godb.NewSlowQueryContextWithOptions(db, godb.SlowQueryOptions{Threshold:slowDelay / 2, Explain:true, ExplainInterval:interval, Logger:log})
+  
+  // the plan of a slow statement is captured and attached
+  f.Reset()
+  _, err = cxt.Exec("UPDATE slow SET a = $1 WHERE id = $2", 1, 2)
+  assert.Nil(t, err, fmt.Sprint(err))
+  assert.Equal(t, []string{"EXPLAIN (FORMAT JSON) UPDATE slow SET a = $1 WHERE id = $2"}, explained(f.Statements()))
+  if r := log.Records(); assert.Len(t, r, 1) {
+    assert.Equal(t, `[{"Plan":{}}]`, r[0].Fields[godb.FieldPlan])
+  }
+  
+  // but not again for the same fingerprint until the interval has elapsed
+  f.Reset()
+  _, err = cxt.Exec("UPDATE slow SET a = $1 WHERE id = $2", 3, 4)
+  assert.Nil(t, err, fmt.Sprint(err))
+  assert.Len(t, explained(f.Statements()), 0)
+  if r := log.Records(); assert.Len(t, r, 1) {
+    assert.Nil(t, r[0].Fields[godb.FieldPlan])
+  }
+  
+  time.Sleep(interval)
+  f.Reset()
+  _, err = cxt.Exec("UPDATE slow SET a = $1 WHERE id = $2", 5, 6)
+  assert.Nil(t, err, fmt.Sprint(err))
+  assert.Len(t, explained(f.Statements()), 1)
+  log.Records()
+  
+  // statements which cannot be explained, or which failed, are not
+  f.Reset()
+  _, err = cxt.Exec("CREATE TABLE slow (a INT)")
+  assert.Nil(t, err, fmt.Sprint(err))
+  _, err = cxt.Exec("UPDATE slow SET fail = 1")
+  assert.NotNil(t, err)
+  assert.Len(t, explained(f.Statements()), 0)
+  assert.Len(t, log.Records(), 2)
+}
+
+func TestSlowQueryExplainHistory(t *testing.T) {
+  f := test.NewFakeDB("slow_history", nil)
+  db, err := test.NewFakeDatabase(godb.Options{}, f)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  defer db.Close()
+  
+  interval := time.Millisecond * 100
+  cxt := godb.NewSlowQueryContextWithOptions(db, godb.SlowQueryOptions{Explain:true, ExplainInterval:interval})
+  
+  // once the history is full, distinct statements are not explained
+  for i := 0; i < godb.ExplainHistoryMax; i++ {
+    assert.True(t, cxt.ShouldExplain(fmt.Sprintf("SELECT c%d FROM t", i)))
+  }
+  assert.False(t, cxt.ShouldExplain("SELECT other FROM t"))
+  
+  // until expired entries can be evicted
+  time.Sleep(interval)
+  assert.True(t, cxt.ShouldExplain("SELECT other FROM t"))
+  assert.False(t, cxt.ShouldExplain("SELECT other FROM t"))
+}
+
+func TestSlowQueryTransaction(t *testing.T) {
+  f := test.NewFakeDB("slow_tx", slowHandler)
+  db, err := test.NewFakeDatabase(godb.Options{}, f)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  defer db.Close()
+  
+  log := &captureLogger{}
+  opts := godb.SlowQueryOptions{Threshold:slowDelay / 2, Explain:true, Logger:log}
+  
+  f.Reset()
+  err = db.Transaction(func(tx godb.Context) error {
+    cxt := godb.NewSlowQueryContextWithOptions(tx, opts)
+    // the rows of a query remain open, so its plan cannot be captured
+    rows, err := cxt.Query("SELECT a FROM slow")
+    if err != nil {
+      return err
+    }
+    rows.Close()
+    var n int64
+    err = cxt.QueryRow("SELECT b FROM slow").Scan(&n)
+    if err != nil {
+      return err
+    }
+    // statements are otherwise explained within the transaction
+    _, err = cxt.Exec("UPDATE slow SET a = 1")
+    return err
+  })
+  assert.Nil(t, err, fmt.Sprint(err))
+  assert.Equal(t, []string{"EXPLAIN (FORMAT JSON) UPDATE slow SET a = 1"}, explained(f.Statements()))
+  if r := log.Records(); assert.Len(t, r, 3) {
+    assert.Nil(t, r[0].Fields[godb.FieldPlan])
+    assert.Nil(t, r[1].Fields[godb.FieldPlan])
+    assert.NotNil(t, r[2].Fields[godb.FieldPlan])
+  }
+}
@@ -0,0 +1,245 @@
+package godb
+
+import (
+  "sync"
+  "context"
+  "database/sql"
+)
+
+import (
+  "github.com/bww/go-lru"
+  "github.com/rcrowley/go-metrics"
+)
+
+// Metrics
+var (
+  stmtCacheHitMetric metrics.Counter
+  stmtCacheMissMetric metrics.Counter
+)
+
+// Setup metrics
+func init() {
+  stmtCacheHitMetric = metrics.NewCounter()
+  metrics.Register("godb.stmt.cache.hit", stmtCacheHitMetric)
+  stmtCacheMissMetric = metrics.NewCounter()
+  metrics.Register("godb.stmt.cache.miss", stmtCacheMissMetric)
+}
+
+// A statement cache key; statements are prepared on a specific connection pool
+type stmtKey struct {
+  db    *sql.DB
+  query string
+}
+
+// A cached statement. A statement may be evicted while it is in use, in which
+// case it is closed when it is released.
+type stmtEntry struct {
+  stmt    *sql.Stmt
+  refs    int
+  evicted bool
+}
+
+// A prepared statement cache. Statements are prepared the first time they are
+// executed and are closed when they are evicted. Statements which have no
+// arguments are not prepared, since they are frequently generated dynamically
+// (e.g., savepoints) and would churn the cache.
+type stmtCache struct {
+  sync.Mutex
+  cache *lru.Cache
+}
+
+// Create a statement cache which holds up to n statements
+func newStmtCache(n int) *stmtCache {
+  c := &stmtCache{cache:lru.New(n)}
+  c.cache.OnEvicted = func(k lru.Key, v interface{}) {
+    e := v.(*stmtEntry)
+    e.evicted = true
+    if e.refs == 0 {
+      e.stmt.Close()
+    }
+  }
+  return c
+}
+
+// Obtain a prepared statement for a query, preparing it if necessary. The
+// statement must be released when it is no longer in use.
+func (c *stmtCache) acquire(ctx context.Context, db *sql.DB, q string) (*stmtEntry, error) {
+  k := stmtKey{db, q}
+  
+  c.Lock()
+  if v, ok := c.cache.Get(k); ok {
+    e := v.(*stmtEntry)
+    e.refs++
+    c.Unlock()
+    stmtCacheHitMetric.Inc(1)
+    return e, nil
+  }
+  c.Unlock()
+  
+  stmtCacheMissMetric.Inc(1)
+  stmt, err := db.PrepareContext(ctx, q)
+  if err != nil {
+    return nil, err
+  }
+  
+  c.Lock()
+  defer c.Unlock()
+  if v, ok := c.cache.Get(k); ok { // prepared concurrently, use the cached one
+    stmt.Close()
+    e := v.(*stmtEntry)
+    e.refs++
+    return e, nil
+  }
+  e := &stmtEntry{stmt:stmt, refs:1}
+  c.cache.Add(k, e)
+  return e, nil
+}
+
+// Release a statement
+func (c *stmtCache) release(e *stmtEntry) {
+  c.Lock()
+  defer c.Unlock()
+  e.refs--
+  if e.evicted && e.refs == 0 {
+    e.stmt.Close()
+  }
+}
+
+// Close every cached statement
+func (c *stmtCache) Close() {
+  c.Lock()
+  defer c.Unlock()
+  for c.cache.Len() > 0 {
+    c.cache.RemoveOldest()
+  }
+}
+
+// Execute a statement on a connection pool
+func (c *stmtCache) exec(ctx context.Context, db *sql.DB, q string, args []interface{}) (sql.Result, error) {
+  if c == nil || len(args) == 0 {
+    return db.ExecContext(ctx, q, args...)
+  }
+  e, err := c.acquire(ctx, db, q)
+  if err != nil {
+    return db.ExecContext(ctx, q, args...)
+  }
+  defer c.release(e)
+  return e.stmt.ExecContext(ctx, args...)
+}
+
+// Query on a connection pool
+func (c *stmtCache) query(ctx context.Context, db *sql.DB, q string, args []interface{}) (*sql.Rows, error) {
+  if c == nil || len(args) == 0 {
+    return db.QueryContext(ctx, q, args...)
+  }
+  e, err := c.acquire(ctx, db, q)
+  if err != nil {
+    return db.QueryContext(ctx, q, args...)
+  }
+  defer c.release(e)
+  return e.stmt.QueryContext(ctx, args...)
+}
+
+// Query a single row on a connection pool
+func (c *stmtCache) queryRow(ctx context.Context, db *sql.DB, q string, args []interface{}) *sql.Row {
+  if c == nil || len(args) == 0 {
+    return db.QueryRowContext(ctx, q, args...)
+  }
+  e, err := c.acquire(ctx, db, q)
+  if err != nil {
+    return db.QueryRowContext(ctx, q, args...)
+  }
+  defer c.release(e)
+  return e.stmt.QueryRowContext(ctx, args...)
+}
+
+// A context which executes statements in a transaction using statements from a
+// cache, rebound to the transaction. Statements are rebound the first time they
+// are used in the transaction and the rebound statements are retained until the
+// transaction completes, rather than rebinding, and accumulating, a statement on
+// every use.
+type stmtTxContext struct {
+  *sql.Tx
+  db    *sql.DB
+  cache *stmtCache
+  lock  sync.Mutex
+  stmts map[*sql.Stmt]*sql.Stmt
+}
+
+// Create a transaction context which uses cached statements. If the cache is nil
+// statements are executed directly on the transaction.
+func newStmtTxContext(tx *sql.Tx, db *sql.DB, c *stmtCache) *stmtTxContext {
+  return &stmtTxContext{Tx:tx, db:db, cache:c, stmts:make(map[*sql.Stmt]*sql.Stmt)}
+}
+
+// Obtain a cached statement rebound to the transaction, rebinding it if this is
+// the first time it is used
+func (t *stmtTxContext) stmt(ctx context.Context, s *sql.Stmt) *sql.Stmt {
+  t.lock.Lock()
+  defer t.lock.Unlock()
+  if b, ok := t.stmts[s]; ok {
+    return b
+  }
+  b := t.Tx.StmtContext(ctx, s)
+  t.stmts[s] = b
+  return b
+}
+
+// Close the statements rebound to the transaction. This must be called once the
+// transaction has been committed or rolled back.
+func (t *stmtTxContext) close() {
+  t.lock.Lock()
+  defer t.lock.Unlock()
+  for _, e := range t.stmts {
+    e.Close()
+  }
+  t.stmts = make(map[*sql.Stmt]*sql.Stmt)
+}
+
+func (t *stmtTxContext) Exec(query string, args ...interface{}) (sql.Result, error) {
+  return t.ExecContext(context.Background(), query, args...)
+}
+
+func (t *stmtTxContext) Query(query string, args ...interface{}) (*sql.Rows, error) {
+  return t.QueryContext(context.Background(), query, args...)
+}
+
+func (t *stmtTxContext) QueryRow(query string, args ...interface{}) *sql.Row {
+  return t.QueryRowContext(context.Background(), query, args...)
+}
+
+func (t *stmtTxContext) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+  if t.cache == nil || len(args) == 0 {
+    return t.Tx.ExecContext(ctx, query, args...)
+  }
+  e, err := t.cache.acquire(ctx, t.db, query)
+  if err != nil {
+    return t.Tx.ExecContext(ctx, query, args...)
+  }
+  defer t.cache.release(e)
+  return t.stmt(ctx, e.stmt).ExecContext(ctx, args...)
+}
+
+func (t *stmtTxContext) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+  if t.cache == nil || len(args) == 0 {
+    return t.Tx.QueryContext(ctx, query, args...)
+  }
+  e, err := t.cache.acquire(ctx, t.db, query)
+  if err != nil {
+    return t.Tx.QueryContext(ctx, query, args...)
+  }
+  defer t.cache.release(e)
+  return t.stmt(ctx, e.stmt).QueryContext(ctx, args...)
+}
+
+func (t *stmtTxContext) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+  if t.cache == nil || len(args) == 0 {
+    return t.Tx.QueryRowContext(ctx, query, args...)
+  }
+  e, err := t.cache.acquire(ctx, t.db, query)
+  if err != nil {
+    return t.Tx.QueryRowContext(ctx, query, args...)
+  }
+  defer t.cache.release(e)
+  return t.stmt(ctx, e.stmt).QueryRowContext(ctx, args...)
+}
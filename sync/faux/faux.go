@@ -1,6 +1,9 @@
 package faux
 
 import (
+  "time"
+  "context"
+  
   "github.com/hirepurpose/godb/sync"
 )
 
@@ -19,6 +22,73 @@ func (m fauxMutex) Perform(f func()error) error {
   return f()
 }
 
+func (m fauxMutex) LockContext(context.Context) error {
+  return nil
+}
+
+func (m fauxMutex) UnlockContext(context.Context) error {
+  return nil
+}
+
+func (m fauxMutex) TryLock(context.Context) (bool, error) {
+  return true, nil
+}
+
+func (m fauxMutex) LockWithTimeout(time.Duration) error {
+  return nil
+}
+
+func (m fauxMutex) PerformContext(ctx context.Context, f func(context.Context)error) error {
+  return f(ctx)
+}
+
+func (m fauxMutex) RLock() error {
+  return nil
+}
+
+func (m fauxMutex) RUnlock() error {
+  return nil
+}
+
+func (m fauxMutex) RPerform(f func()error) error {
+  return f()
+}
+
+func (m fauxMutex) RLockContext(context.Context) error {
+  return nil
+}
+
+func (m fauxMutex) RUnlockContext(context.Context) error {
+  return nil
+}
+
+func (m fauxMutex) TryRLock(context.Context) (bool, error) {
+  return true, nil
+}
+
+func (m fauxMutex) RPerformContext(ctx context.Context, f func(context.Context)error) error {
+  return f(ctx)
+}
+
+// A faux semaphore which does no actual limiting
+type fauxSemaphore struct {}
+
+func (s fauxSemaphore) Acquire(context.Context) error {
+  return nil
+}
+
+func (s fauxSemaphore) TryAcquire(context.Context) (bool, error) {
+  return true, nil
+}
+
+func (s fauxSemaphore) Release(context.Context) error {
+  return nil
+}
+
+func (s fauxSemaphore) Perform(ctx context.Context, f func(context.Context)error) error {
+  return f(ctx)
+}
+
 // A faux lock service which does no actual locking
 type fauxService struct {}
 
@@ -29,3 +99,11 @@ func New() sync.Service {
 func (s fauxService) Mutex(string) (sync.Mutex, error) {
   return fauxMutex{}, nil
 }
+
+func (s fauxService) RWMutex(string) (sync.RWMutex, error) {
+  return fauxMutex{}, nil
+}
+
+func (s fauxService) Semaphore(string, int) (sync.Semaphore, error) {
+  return fauxSemaphore{}, nil
+}
@@ -0,0 +1,88 @@
+package sync
+
+import (
+  "time"
+  "context"
+  "sync/atomic"
+)
+
+const (
+  ELECTION_RETRY_INTERVAL_DEFAULT = time.Second
+)
+
+// Election options
+type ElectionOptions struct {
+  OnElected     func(context.Context) // called when leadership is acquired; the context is canceled when it is lost
+  OnRevoked     func()                // called when leadership is lost, after the context passed to OnElected is canceled
+  OnError       func(error)           // called when campaigning fails; campaigning is retried after RetryInterval
+  RetryInterval time.Duration         // the interval after which to campaign again; defaults to ELECTION_RETRY_INTERVAL_DEFAULT
+}
+
+// A leader election. Candidates campaign for a named leadership by acquiring the
+// mutex of that name from a sync service; the candidate which holds the mutex is
+// the leader. Loss of leadership is detected when the mutex implementation cancels
+// the context passed to PerformContext, e.g., when a lease cannot be renewed or
+// the connection holding an advisory lock drops.
+type Election struct {
+  svc     Service
+  name    string
+  opts    ElectionOptions
+  leader  int32
+}
+
+// Create an election for the named leadership
+func NewElection(svc Service, name string, opts ElectionOptions) *Election {
+  if opts.RetryInterval <= 0 {
+    opts.RetryInterval = ELECTION_RETRY_INTERVAL_DEFAULT
+  }
+  return &Election{svc:svc, name:name, opts:opts}
+}
+
+// Determine if this candidate is currently the leader
+func (e *Election) IsLeader() bool {
+  return atomic.LoadInt32(&e.leader) != 0
+}
+
+// Campaign for leadership until the provided context is canceled. When elected,
+// OnElected is called and leadership is held until the context is canceled or
+// the underlying mutex is lost, at which point OnRevoked is called and the mutex
+// is released. If leadership is lost, the candidate campaigns again. This method
+// blocks until the context is canceled and the candidate has stepped down.
+func (e *Election) Run(ctx context.Context) error {
+  for {
+    err := e.campaign(ctx)
+    if ctx.Err() != nil {
+      return nil
+    }
+    if err != nil && e.opts.OnError != nil {
+      e.opts.OnError(err)
+    }
+    t := time.NewTimer(e.opts.RetryInterval)
+    select {
+      case <-ctx.Done():
+        t.Stop()
+        return nil
+      case <-t.C:
+    }
+  }
+}
+
+// Campaign for a single term
+func (e *Election) campaign(ctx context.Context) error {
+  m, err := e.svc.Mutex(e.name)
+  if err != nil {
+    return err
+  }
+  return m.PerformContext(ctx, func(lctx context.Context) error {
+    atomic.StoreInt32(&e.leader, 1)
+    if e.opts.OnElected != nil {
+      e.opts.OnElected(lctx)
+    }
+    <-lctx.Done()
+    atomic.StoreInt32(&e.leader, 0)
+    if e.opts.OnRevoked != nil {
+      e.opts.OnRevoked()
+    }
+    return nil
+  })
+}
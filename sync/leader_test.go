@@ -0,0 +1,139 @@
+package sync
+
+import (
+  "fmt"
+  "time"
+  "context"
+  "testing"
+)
+
+import (
+  "github.com/stretchr/testify/assert"
+)
+
+// An in-process mutex whose holder can be made to lose it
+type testMutex struct {
+  sem   chan struct{}
+  lose  chan struct{}
+}
+
+func (m *testMutex) Lock() error {
+  return m.LockContext(context.Background())
+}
+
+func (m *testMutex) Unlock() error {
+  return m.UnlockContext(context.Background())
+}
+
+func (m *testMutex) Perform(f func()error) error {
+  return m.PerformContext(context.Background(), func(context.Context) error { return f() })
+}
+
+func (m *testMutex) LockContext(ctx context.Context) error {
+  select {
+    case m.sem <- struct{}{}:
+      return nil
+    case <-ctx.Done():
+      return ctx.Err()
+  }
+}
+
+func (m *testMutex) UnlockContext(context.Context) error {
+  <-m.sem
+  return nil
+}
+
+func (m *testMutex) TryLock(ctx context.Context) (bool, error) {
+  select {
+    case m.sem <- struct{}{}:
+      return true, nil
+    default:
+      return false, nil
+  }
+}
+
+func (m *testMutex) LockWithTimeout(d time.Duration) error {
+  return LockWithTimeout(m, d)
+}
+
+func (m *testMutex) PerformContext(ctx context.Context, f func(context.Context)error) error {
+  err := m.LockContext(ctx)
+  if err != nil {
+    return err
+  }
+  defer m.Unlock()
+  lctx, cancel := context.WithCancel(ctx)
+  defer cancel()
+  go func() {
+    select {
+      case <-m.lose:
+        cancel()
+      case <-lctx.Done():
+    }
+  }()
+  return f(lctx)
+}
+
+type testService struct {
+  m *testMutex
+}
+
+func (s testService) Mutex(string) (Mutex, error) {
+  return s.m, nil
+}
+
+func (s testService) RWMutex(string) (RWMutex, error) {
+  return nil, fmt.Errorf("Unsupported")
+}
+
+func (s testService) Semaphore(string, int) (Semaphore, error) {
+  return nil, fmt.Errorf("Unsupported")
+}
+
+func TestElection(t *testing.T) {
+  svc := testService{&testMutex{sem:make(chan struct{}, 1), lose:make(chan struct{})}}
+  events := make(chan string, 16)
+  
+  candidate := func(n string) *Election {
+    return NewElection(svc, "/leader", ElectionOptions{
+      OnElected: func(context.Context) { events <- n +" elected" },
+      OnRevoked: func() { events <- n +" revoked" },
+      RetryInterval: time.Millisecond * 10,
+    })
+  }
+  
+  a := candidate("a")
+  actx, acancel := context.WithCancel(context.Background())
+  adone := make(chan struct{})
+  go func() { a.Run(actx); close(adone) }()
+  assert.Equal(t, "a elected", <-events)
+  assert.True(t, a.IsLeader())
+  
+  b := candidate("b")
+  bctx, bcancel := context.WithCancel(context.Background())
+  bdone := make(chan struct{})
+  go func() { b.Run(bctx); close(bdone) }()
+  
+  select {
+    case e := <-events:
+      t.Fatalf("Unexpected event: %s", e)
+    case <-time.After(time.Millisecond * 50):
+  }
+  assert.False(t, b.IsLeader())
+  
+  acancel() // a steps down
+  <-adone
+  assert.Equal(t, "a revoked", <-events)
+  assert.False(t, a.IsLeader())
+  assert.Equal(t, "b elected", <-events)
+  assert.True(t, b.IsLeader())
+  
+  svc.m.lose <- struct{}{} // b loses the mutex and campaigns again
+  assert.Equal(t, "b revoked", <-events)
+  assert.Equal(t, "b elected", <-events)
+  
+  bcancel()
+  <-bdone
+  assert.Equal(t, "b revoked", <-events)
+  assert.False(t, b.IsLeader())
+}
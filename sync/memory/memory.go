@@ -0,0 +1,303 @@
+package memory
+
+import (
+  "fmt"
+  "time"
+  "context"
+  gosync "sync"
+  
+  "github.com/hirepurpose/godb/sync"
+)
+
+// The state of a named lock. Waiters block on a channel which is closed, and
+// replaced, whenever the state changes.
+type lockState struct {
+  gosync.Mutex
+  writer  bool
+  readers int
+  pending int // writers waiting to acquire the lock; readers yield to them
+  changed chan struct{}
+}
+
+// Notify waiters that the state has changed; the lock must be held
+func (s *lockState) broadcast() {
+  close(s.changed)
+  s.changed = make(chan struct{})
+}
+
+// An in-memory read/write mutex
+type mutex struct {
+  st *lockState
+}
+
+// Acquire the mutex for writing
+func (m mutex) Lock() error {
+  return m.LockContext(context.Background())
+}
+
+// Release the mutex for writing
+func (m mutex) Unlock() error {
+  return m.UnlockContext(context.Background())
+}
+
+// Perform a function while holding the mutex for writing
+func (m mutex) Perform(f func()error) error {
+  return m.PerformContext(context.Background(), func(context.Context) error {
+    return f()
+  })
+}
+
+// Acquire the mutex for writing, blocking until it is available or the context is done
+func (m mutex) LockContext(ctx context.Context) error {
+  s := m.st
+  s.Lock()
+  s.pending++
+  for s.writer || s.readers > 0 {
+    c := s.changed
+    s.Unlock()
+    select {
+      case <-c:
+        s.Lock()
+      case <-ctx.Done():
+        s.Lock()
+        s.pending--
+        s.broadcast() // readers may have been waiting on us
+        s.Unlock()
+        return ctx.Err()
+    }
+  }
+  s.pending--
+  s.writer = true
+  s.Unlock()
+  return nil
+}
+
+// Release the mutex for writing
+func (m mutex) UnlockContext(context.Context) error {
+  s := m.st
+  s.Lock()
+  defer s.Unlock()
+  if !s.writer {
+    return sync.ErrNotLocked
+  }
+  s.writer = false
+  s.broadcast()
+  return nil
+}
+
+// Acquire the mutex for writing if it is available without blocking
+func (m mutex) TryLock(context.Context) (bool, error) {
+  s := m.st
+  s.Lock()
+  defer s.Unlock()
+  if s.writer || s.readers > 0 {
+    return false, nil
+  }
+  s.writer = true
+  return true, nil
+}
+
+// Acquire the mutex for writing, blocking for up to the provided duration
+func (m mutex) LockWithTimeout(d time.Duration) error {
+  return sync.LockWithTimeout(m, d)
+}
+
+// Perform a function while holding the mutex for writing. An in-memory mutex
+// cannot be lost, so the function's context is the one provided.
+func (m mutex) PerformContext(ctx context.Context, f func(context.Context)error) error {
+  err := m.LockContext(ctx)
+  if err != nil {
+    return err
+  }
+  defer m.UnlockContext(ctx)
+  return f(ctx)
+}
+
+// Acquire the mutex for reading
+func (m mutex) RLock() error {
+  return m.RLockContext(context.Background())
+}
+
+// Release the mutex for reading
+func (m mutex) RUnlock() error {
+  return m.RUnlockContext(context.Background())
+}
+
+// Perform a function while holding the mutex for reading
+func (m mutex) RPerform(f func()error) error {
+  return m.RPerformContext(context.Background(), func(context.Context) error {
+    return f()
+  })
+}
+
+// Acquire the mutex for reading, blocking until it is available or the context is done
+func (m mutex) RLockContext(ctx context.Context) error {
+  s := m.st
+  s.Lock()
+  for s.writer || s.pending > 0 {
+    c := s.changed
+    s.Unlock()
+    select {
+      case <-c:
+        s.Lock()
+      case <-ctx.Done():
+        return ctx.Err()
+    }
+  }
+  s.readers++
+  s.Unlock()
+  return nil
+}
+
+// Release the mutex for reading
+func (m mutex) RUnlockContext(context.Context) error {
+  s := m.st
+  s.Lock()
+  defer s.Unlock()
+  if s.readers < 1 {
+    return sync.ErrNotLocked
+  }
+  s.readers--
+  s.broadcast()
+  return nil
+}
+
+// Acquire the mutex for reading if it is available without blocking
+func (m mutex) TryRLock(context.Context) (bool, error) {
+  s := m.st
+  s.Lock()
+  defer s.Unlock()
+  if s.writer || s.pending > 0 {
+    return false, nil
+  }
+  s.readers++
+  return true, nil
+}
+
+// Perform a function while holding the mutex for reading
+func (m mutex) RPerformContext(ctx context.Context, f func(context.Context)error) error {
+  err := m.RLockContext(ctx)
+  if err != nil {
+    return err
+  }
+  defer m.RUnlockContext(ctx)
+  return f(ctx)
+}
+
+// The state of a named semaphore
+type semaphoreState struct {
+  gosync.Mutex
+  n       int
+  held    int
+  changed chan struct{}
+}
+
+// An in-memory counting semaphore
+type semaphore struct {
+  st *semaphoreState
+}
+
+// Acquire a permit, blocking until one is available or the context is done
+func (m semaphore) Acquire(ctx context.Context) error {
+  s := m.st
+  s.Lock()
+  for s.held >= s.n {
+    c := s.changed
+    s.Unlock()
+    select {
+      case <-c:
+        s.Lock()
+      case <-ctx.Done():
+        return ctx.Err()
+    }
+  }
+  s.held++
+  s.Unlock()
+  return nil
+}
+
+// Acquire a permit if one is available without blocking
+func (m semaphore) TryAcquire(context.Context) (bool, error) {
+  s := m.st
+  s.Lock()
+  defer s.Unlock()
+  if s.held >= s.n {
+    return false, nil
+  }
+  s.held++
+  return true, nil
+}
+
+// Release a permit
+func (m semaphore) Release(context.Context) error {
+  s := m.st
+  s.Lock()
+  defer s.Unlock()
+  if s.held < 1 {
+    return sync.ErrNotLocked
+  }
+  s.held--
+  close(s.changed)
+  s.changed = make(chan struct{})
+  return nil
+}
+
+// Perform a function while holding a permit
+func (m semaphore) Perform(ctx context.Context, f func(context.Context)error) error {
+  err := m.Acquire(ctx)
+  if err != nil {
+    return err
+  }
+  defer m.Release(ctx)
+  return f(ctx)
+}
+
+// An in-memory lock service. Mutexes and semaphores of the same name obtained
+// from a service share their state, so they coordinate the goroutines of a
+// single process. This is useful in tests and for single-instance deployments.
+type service struct {
+  slock   gosync.Mutex
+  locks map[string]*lockState
+  sems  map[string]*semaphoreState
+}
+
+// Create an in-memory lock service
+func New() sync.Service {
+  return &service{locks:make(map[string]*lockState), sems:make(map[string]*semaphoreState)}
+}
+
+// Obtain the state of a named lock
+func (s *service) lock(name string) *lockState {
+  s.slock.Lock()
+  defer s.slock.Unlock()
+  st, ok := s.locks[name]
+  if !ok {
+    st = &lockState{changed:make(chan struct{})}
+    s.locks[name] = st
+  }
+  return st
+}
+
+func (s *service) Mutex(name string) (sync.Mutex, error) {
+  return mutex{s.lock(name)}, nil
+}
+
+func (s *service) RWMutex(name string) (sync.RWMutex, error) {
+  return mutex{s.lock(name)}, nil
+}
+
+func (s *service) Semaphore(name string, n int) (sync.Semaphore, error) {
+  if n < 1 {
+    return nil, fmt.Errorf("Semaphore %s must permit at least one holder", name)
+  }
+  s.slock.Lock()
+  defer s.slock.Unlock()
+  st, ok := s.sems[name]
+  if !ok {
+    st = &semaphoreState{n:n, changed:make(chan struct{})}
+    s.sems[name] = st
+  }else if st.n != n {
+    return nil, fmt.Errorf("Semaphore %s permits %d holders, not %d", name, st.n, n)
+  }
+  return semaphore{st}, nil
+}
@@ -0,0 +1,159 @@
+package memory
+
+import (
+  "time"
+  "context"
+  "testing"
+  gosync "sync"
+  "sync/atomic"
+)
+
+import (
+  "github.com/hirepurpose/godb/sync"
+  "github.com/stretchr/testify/assert"
+)
+
+// Run n goroutines which each perform f, returning the greatest number which
+// were inside f at the same time
+func contend(n int, f func(func()) error) (int32, error) {
+  var cur, max int32
+  var wg gosync.WaitGroup
+  errs := make(chan error, n)
+  for i := 0; i < n; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      errs <- f(func() {
+        c := atomic.AddInt32(&cur, 1)
+        for {
+          m := atomic.LoadInt32(&max)
+          if c <= m || atomic.CompareAndSwapInt32(&max, m, c) {
+            break
+          }
+        }
+        time.Sleep(time.Millisecond * 5)
+        atomic.AddInt32(&cur, -1)
+      })
+    }()
+  }
+  wg.Wait()
+  close(errs)
+  for e := range errs {
+    if e != nil {
+      return max, e
+    }
+  }
+  return max, nil
+}
+
+func TestMutex(t *testing.T) {
+  svc := New()
+  
+  max, err := contend(10, func(f func()) error {
+    m, err := svc.Mutex("/a")
+    if err != nil {
+      return err
+    }
+    return m.Perform(func() error { f(); return nil })
+  })
+  if assert.Nil(t, err) {
+    assert.Equal(t, int32(1), max)
+  }
+  
+  m, err := svc.Mutex("/b")
+  if assert.Nil(t, err) {
+    ok, err := m.TryLock(context.Background())
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    ok, err = m.TryLock(context.Background())
+    assert.Nil(t, err)
+    assert.False(t, ok)
+    ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 10)
+    assert.Equal(t, context.DeadlineExceeded, m.LockContext(ctx))
+    cancel()
+    assert.Nil(t, m.Unlock())
+    assert.Nil(t, m.LockWithTimeout(time.Millisecond * 10))
+    assert.Nil(t, m.Unlock())
+  }
+}
+
+func TestRWMutex(t *testing.T) {
+  svc := New()
+  m, err := svc.RWMutex("/a")
+  if !assert.Nil(t, err) {
+    return
+  }
+  
+  max, err := contend(5, func(f func()) error {
+    return m.RPerform(func() error { f(); return nil })
+  })
+  if assert.Nil(t, err) {
+    assert.True(t, max > 1, "Readers should hold the lock concurrently")
+  }
+  
+  assert.Nil(t, m.RLock())
+  ok, err := m.TryLock(context.Background())
+  assert.Nil(t, err)
+  assert.False(t, ok) // readers exclude writers
+  
+  locked := make(chan struct{})
+  go func() {
+    m.Lock()
+    close(locked)
+  }()
+  time.Sleep(time.Millisecond * 10)
+  ok, err = m.TryRLock(context.Background())
+  assert.Nil(t, err)
+  assert.False(t, ok) // readers yield to a pending writer
+  
+  assert.Nil(t, m.RUnlock())
+  <-locked
+  ok, err = m.TryRLock(context.Background())
+  assert.Nil(t, err)
+  assert.False(t, ok) // writers exclude readers
+  assert.Nil(t, m.Unlock())
+  
+  x, err := svc.Mutex("/a")
+  if assert.Nil(t, err) {
+    assert.Nil(t, m.RLock())
+    ok, err = x.TryLock(context.Background())
+    assert.Nil(t, err)
+    assert.False(t, ok) // a mutex of the same name shares state
+    assert.Nil(t, m.RUnlock())
+  }
+  
+  assert.Equal(t, sync.ErrNotLocked, m.RUnlock())
+}
+
+func TestSemaphore(t *testing.T) {
+  svc := New()
+  s, err := svc.Semaphore("/a", 3)
+  if !assert.Nil(t, err) {
+    return
+  }
+  
+  max, err := contend(10, func(f func()) error {
+    return s.Perform(context.Background(), func(context.Context) error { f(); return nil })
+  })
+  if assert.Nil(t, err) {
+    assert.True(t, max > 1 && max <= 3, "At most 3 holders should hold permits concurrently")
+  }
+  
+  for i := 0; i < 3; i++ {
+    ok, err := s.TryAcquire(context.Background())
+    assert.Nil(t, err)
+    assert.True(t, ok)
+  }
+  ok, err := s.TryAcquire(context.Background())
+  assert.Nil(t, err)
+  assert.False(t, ok)
+  for i := 0; i < 3; i++ {
+    assert.Nil(t, s.Release(context.Background()))
+  }
+  assert.Equal(t, sync.ErrNotLocked, s.Release(context.Background()))
+  
+  _, err = svc.Semaphore("/a", 2)
+  assert.NotNil(t, err)
+  _, err = svc.Semaphore("/b", 0)
+  assert.NotNil(t, err)
+}
@@ -0,0 +1,531 @@
+package pgadvisory
+
+import (
+  "fmt"
+  "time"
+  "context"
+  "hash/fnv"
+  "database/sql"
+  "database/sql/driver"
+  gosync "sync"
+  
+  "github.com/hirepurpose/godb/sync"
+)
+
+import (
+  _ "github.com/lib/pq"
+)
+
+const (
+  RETRY_INTERVAL_DEFAULT  = time.Millisecond * 250
+  PING_INTERVAL_DEFAULT   = time.Second * 5
+)
+
+var (
+  ErrLockLost = fmt.Errorf("Lock was lost")
+)
+
+// Produce the advisory lock key for a mutex name
+func Key(name string) int64 {
+  h := fnv.New64a()
+  h.Write([]byte(name))
+  return int64(h.Sum64())
+}
+
+// Advisory lock functions, exclusive and shared
+type lockFuncs struct {
+  lock, try, unlock string
+}
+
+var (
+  exclusive = lockFuncs{"pg_advisory_lock", "pg_try_advisory_lock", "pg_advisory_unlock"}
+  shared    = lockFuncs{"pg_advisory_lock_shared", "pg_try_advisory_lock_shared", "pg_advisory_unlock_shared"}
+)
+
+// A held advisory lock and the dedicated connection on which it is held
+type held struct {
+  conn  *sql.Conn
+  key   int64
+}
+
+// Acquire an advisory lock on a dedicated connection, blocking until it is
+// available or the context is done
+func lock(ctx context.Context, db *sql.DB, fn lockFuncs, key int64) (*sql.Conn, error) {
+  conn, err := db.Conn(ctx)
+  if err != nil {
+    return nil, err
+  }
+  _, err = conn.ExecContext(ctx, fmt.Sprintf("SELECT %s($1)", fn.lock), key)
+  if err != nil {
+    discard(conn)
+    if cerr := ctx.Err(); cerr != nil {
+      err = cerr // the statement was canceled; report why
+    }
+    return nil, err
+  }
+  return conn, nil
+}
+
+// Attempt to acquire one of the provided advisory locks on a dedicated connection
+// without blocking. If no lock is acquired the connection is nil.
+func tryLock(ctx context.Context, db *sql.DB, fn lockFuncs, keys ...int64) (*sql.Conn, int64, error) {
+  conn, err := db.Conn(ctx)
+  if err != nil {
+    return nil, 0, err
+  }
+  for _, k := range keys {
+    var ok bool
+    err = conn.QueryRowContext(ctx, fmt.Sprintf("SELECT %s($1)", fn.try), k).Scan(&ok)
+    if err != nil {
+      discard(conn)
+      return nil, 0, err
+    }
+    if ok {
+      return conn, k, nil
+    }
+  }
+  conn.Close()
+  return nil, 0, nil
+}
+
+// Release an advisory lock. The dedicated connection is returned to the pool
+// once the lock has been released; if the lock cannot be released the connection
+// is closed instead, which releases it.
+func unlock(ctx context.Context, fn lockFuncs, h held) error {
+  var ok bool
+  err := h.conn.QueryRowContext(ctx, fmt.Sprintf("SELECT %s($1)", fn.unlock), h.key).Scan(&ok)
+  if err != nil {
+    discard(h.conn)
+    return err
+  }else if !ok {
+    discard(h.conn)
+    return sync.ErrNotLocked
+  }
+  return h.conn.Close()
+}
+
+// Close a connection without returning it to the pool, so that any session-level
+// locks it holds are released
+func discard(conn *sql.Conn) {
+  conn.Raw(func(interface{}) error {
+    return driver.ErrBadConn
+  })
+  conn.Close()
+}
+
+// A read/write mutex backed by Postgres session-level advisory locks, which is
+// held exclusively for writing and shared for reading. Each acquisition is held
+// on a dedicated connection for as long as it is held; if that connection drops,
+// Postgres releases the lock.
+type mutex struct {
+  gosync.Mutex
+  svc     *Service
+  name    string
+  key     int64
+  conn    *sql.Conn   // the connection holding the exclusive lock, if any
+  readers []*sql.Conn // connections holding shared locks, if any
+}
+
+// Acquire the lock, blocking until it is available
+func (m *mutex) Lock() error {
+  return m.LockContext(context.Background())
+}
+
+// Acquire the lock, blocking until it is available or the context is done
+func (m *mutex) LockContext(ctx context.Context) error {
+  conn, err := lock(ctx, m.svc.db, exclusive, m.key)
+  if err != nil {
+    return fmt.Errorf("Could not lock %s: %w", m.name, err)
+  }
+  m.acquired(conn)
+  return nil
+}
+
+// Acquire the lock if it is available without blocking
+func (m *mutex) TryLock(ctx context.Context) (bool, error) {
+  conn, _, err := tryLock(ctx, m.svc.db, exclusive, m.key)
+  if err != nil {
+    return false, fmt.Errorf("Could not lock %s: %w", m.name, err)
+  }else if conn == nil {
+    return false, nil
+  }
+  m.acquired(conn)
+  return true, nil
+}
+
+// Record the connection which holds the exclusive lock. If another connection is
+// recorded it cannot still hold the lock, since the database has granted it to
+// this one, e.g., because its session was terminated; it is discarded rather than
+// leaked along with any other locks its session holds.
+func (m *mutex) acquired(conn *sql.Conn) {
+  m.Mutex.Lock()
+  prev := m.conn
+  m.conn = conn
+  m.Mutex.Unlock()
+  if prev != nil {
+    discard(prev)
+  }
+}
+
+// Acquire the lock, blocking for up to the provided duration
+func (m *mutex) LockWithTimeout(d time.Duration) error {
+  return sync.LockWithTimeout(m, d)
+}
+
+// Release the lock
+func (m *mutex) Unlock() error {
+  return m.UnlockContext(context.Background())
+}
+
+// Release the lock, as with Unlock
+func (m *mutex) UnlockContext(ctx context.Context) error {
+  m.Mutex.Lock()
+  conn := m.conn
+  m.conn = nil
+  m.Mutex.Unlock()
+  if conn == nil {
+    return sync.ErrNotLocked
+  }
+  err := unlock(ctx, exclusive, held{conn, m.key})
+  if err != nil {
+    return fmt.Errorf("Could not unlock %s: %w", m.name, err)
+  }
+  return nil
+}
+
+// Perform a function while holding the lock
+func (m *mutex) Perform(f func()error) error {
+  err := m.Lock()
+  if err != nil {
+    return err
+  }
+  defer m.Unlock()
+  return f()
+}
+
+// Perform a function while holding the lock, which is acquired under the provided
+// context. The lock is lost only if its connection drops, so the connection is
+// checked periodically while the function runs; if it has dropped, the function's
+// context is canceled and an error wrapping ErrLockLost is returned unless the
+// function fails first.
+func (m *mutex) PerformContext(ctx context.Context, f func(context.Context)error) error {
+  conn, err := lock(ctx, m.svc.db, exclusive, m.key)
+  if err != nil {
+    return fmt.Errorf("Could not lock %s: %w", m.name, err)
+  }
+  m.acquired(conn)
+  
+  lost, err := m.svc.hold(ctx, m.name, conn, f)
+  if lost {
+    m.Mutex.Lock()
+    if m.conn == conn {
+      m.conn = nil // the lock is no longer ours to release
+    }
+    m.Mutex.Unlock()
+    discard(conn)
+  }else if uerr := m.UnlockContext(context.Background()); uerr != nil && err == nil {
+    err = uerr
+  }
+  return err
+}
+
+// Acquire the lock for reading
+func (m *mutex) RLock() error {
+  return m.RLockContext(context.Background())
+}
+
+// Acquire the lock for reading, blocking until it is available or the context is done
+func (m *mutex) RLockContext(ctx context.Context) error {
+  conn, err := lock(ctx, m.svc.db, shared, m.key)
+  if err != nil {
+    return fmt.Errorf("Could not lock %s: %w", m.name, err)
+  }
+  m.Mutex.Lock()
+  m.readers = append(m.readers, conn)
+  m.Mutex.Unlock()
+  return nil
+}
+
+// Acquire the lock for reading if it is available without blocking
+func (m *mutex) TryRLock(ctx context.Context) (bool, error) {
+  conn, _, err := tryLock(ctx, m.svc.db, shared, m.key)
+  if err != nil {
+    return false, fmt.Errorf("Could not lock %s: %w", m.name, err)
+  }else if conn == nil {
+    return false, nil
+  }
+  m.Mutex.Lock()
+  m.readers = append(m.readers, conn)
+  m.Mutex.Unlock()
+  return true, nil
+}
+
+// Release the lock for reading
+func (m *mutex) RUnlock() error {
+  return m.RUnlockContext(context.Background())
+}
+
+// Release the lock for reading, as with RUnlock
+func (m *mutex) RUnlockContext(ctx context.Context) error {
+  m.Mutex.Lock()
+  n := len(m.readers)
+  if n < 1 {
+    m.Mutex.Unlock()
+    return sync.ErrNotLocked
+  }
+  conn := m.readers[n - 1]
+  m.readers = m.readers[:n - 1]
+  m.Mutex.Unlock()
+  err := unlock(ctx, shared, held{conn, m.key})
+  if err != nil {
+    return fmt.Errorf("Could not unlock %s: %w", m.name, err)
+  }
+  return nil
+}
+
+// Perform a function while holding the lock for reading
+func (m *mutex) RPerform(f func()error) error {
+  err := m.RLock()
+  if err != nil {
+    return err
+  }
+  defer m.RUnlock()
+  return f()
+}
+
+// Perform a function while holding the lock for reading, as with PerformContext
+func (m *mutex) RPerformContext(ctx context.Context, f func(context.Context)error) error {
+  conn, err := lock(ctx, m.svc.db, shared, m.key)
+  if err != nil {
+    return fmt.Errorf("Could not lock %s: %w", m.name, err)
+  }
+  
+  lost, err := m.svc.hold(ctx, m.name, conn, f)
+  if lost {
+    discard(conn)
+  }else if uerr := unlock(context.Background(), shared, held{conn, m.key}); uerr != nil && err == nil {
+    err = fmt.Errorf("Could not unlock %s: %w", m.name, uerr)
+  }
+  return err
+}
+
+// A counting semaphore backed by Postgres advisory locks. Each of its n permits
+// is an advisory lock; a permit is acquired by locking any one of them.
+type semaphore struct {
+  gosync.Mutex
+  svc   *Service
+  name  string
+  keys  []int64
+  retry time.Duration
+  held  []held
+}
+
+// Acquire a permit, blocking until one is available or the context is done
+func (s *semaphore) Acquire(ctx context.Context) error {
+  h, err := s.acquire(ctx)
+  if err != nil {
+    return err
+  }
+  s.Lock()
+  s.held = append(s.held, h)
+  s.Unlock()
+  return nil
+}
+
+// Acquire a permit if one is available without blocking
+func (s *semaphore) TryAcquire(ctx context.Context) (bool, error) {
+  conn, key, err := tryLock(ctx, s.svc.db, exclusive, s.keys...)
+  if err != nil {
+    return false, fmt.Errorf("Could not acquire %s: %w", s.name, err)
+  }else if conn == nil {
+    return false, nil
+  }
+  s.Lock()
+  s.held = append(s.held, held{conn, key})
+  s.Unlock()
+  return true, nil
+}
+
+// Release the most recently acquired permit
+func (s *semaphore) Release(ctx context.Context) error {
+  s.Lock()
+  n := len(s.held)
+  if n < 1 {
+    s.Unlock()
+    return sync.ErrNotLocked
+  }
+  h := s.held[n - 1]
+  s.held = s.held[:n - 1]
+  s.Unlock()
+  err := unlock(ctx, exclusive, h)
+  if err != nil {
+    return fmt.Errorf("Could not release %s: %w", s.name, err)
+  }
+  return nil
+}
+
+// Acquire a permit without adding it to the permits held by the semaphore,
+// blocking until one is available or the context is done. Permits are polled
+// for, since Postgres cannot wait on any one of several locks.
+func (s *semaphore) acquire(ctx context.Context) (held, error) {
+  t := time.NewTicker(s.retry)
+  defer t.Stop()
+  for {
+    conn, key, err := tryLock(ctx, s.svc.db, exclusive, s.keys...)
+    if err != nil {
+      return held{}, fmt.Errorf("Could not acquire %s: %w", s.name, err)
+    }else if conn != nil {
+      return held{conn, key}, nil
+    }
+    select {
+      case <-ctx.Done():
+        return held{}, fmt.Errorf("Could not acquire %s: %w", s.name, ctx.Err())
+      case <-t.C:
+    }
+  }
+}
+
+// Perform a function while holding a permit. The permit's connection is checked
+// while the function runs, as with Mutex.PerformContext.
+func (s *semaphore) Perform(ctx context.Context, f func(context.Context)error) error {
+  h, err := s.acquire(ctx)
+  if err != nil {
+    return err
+  }
+  lost, err := s.svc.hold(ctx, s.name, h.conn, f)
+  if lost {
+    discard(h.conn)
+  }else if uerr := unlock(context.Background(), exclusive, h); uerr != nil && err == nil {
+    err = fmt.Errorf("Could not release %s: %w", s.name, uerr)
+  }
+  return err
+}
+
+// Lock service options
+type Options struct {
+  MaxConns      int           // the maximum number of connections in a pool opened by Open, which bounds the number of locks held and awaited at once; defaults to unlimited
+  PingInterval  time.Duration // the interval at which the connection holding a lock is checked while a function is performed with it; defaults to PING_INTERVAL_DEFAULT
+}
+
+// A lock service backed by Postgres advisory locks. Every lock that is held or
+// awaited occupies a connection of the service's pool for as long as it is held
+// or awaited, so the pool must be dedicated to the service; if it were shared
+// with the application, locks could starve the application of connections and
+// the application could starve waiters of them.
+type Service struct {
+  db    *sql.DB
+  ping  time.Duration
+  owned bool
+}
+
+// Open a lock service on its own connection pool to the Postgres database
+// identified by the provided data source name, as accepted by lib/pq. The pool
+// is closed when the service is closed.
+func Open(dsn string, opts Options) (*Service, error) {
+  db, err := sql.Open("postgres", dsn)
+  if err != nil {
+    return nil, err
+  }
+  if opts.MaxConns > 0 {
+    db.SetMaxOpenConns(opts.MaxConns)
+  }
+  s := NewWithOptions(db, opts)
+  s.owned = true
+  return s, nil
+}
+
+// Create a lock service with default options which acquires advisory locks using
+// connections from the provided pool. The pool must be dedicated to the service;
+// use Open to create a service with its own pool. Mutex names are hashed to
+// produce advisory lock keys, so every service which coordinates on a name must
+// use the same database.
+func New(db *sql.DB) *Service {
+  return NewWithOptions(db, Options{})
+}
+
+// Create a lock service with options, as with New. MaxConns is not applied to a
+// pool which is provided.
+func NewWithOptions(db *sql.DB, opts Options) *Service {
+  s := &Service{db:db, ping:opts.PingInterval}
+  if s.ping <= 0 {
+    s.ping = PING_INTERVAL_DEFAULT
+  }
+  return s
+}
+
+// Close the service. If the service was opened with its own pool, the pool is
+// closed, which releases every lock held through it.
+func (s *Service) Close() error {
+  if s.owned {
+    return s.db.Close()
+  }
+  return nil
+}
+
+// Perform a function while checking, in the background, that the connection
+// holding a lock has not dropped, in which case Postgres has released the lock.
+// If it has, the function's context is canceled and an error wrapping ErrLockLost
+// is returned unless the function fails first, along with true. The connection is
+// not used by the check once this method returns.
+func (s *Service) hold(ctx context.Context, name string, conn *sql.Conn, f func(context.Context)(error)) (bool, error) {
+  fctx, cancel := context.WithCancel(ctx)
+  defer cancel()
+  
+  var wg gosync.WaitGroup
+  lost := make(chan error, 1)
+  done := make(chan struct{})
+  wg.Add(1)
+  go func() {
+    defer wg.Done()
+    t := time.NewTicker(s.ping)
+    defer t.Stop()
+    for {
+      select {
+        case <-done:
+          return
+        case <-t.C:
+          pctx, pcancel := context.WithTimeout(context.Background(), s.ping) // the check is independent of the caller's context
+          _, err := conn.ExecContext(pctx, "SELECT 1")
+          pcancel()
+          if err != nil {
+            lost <- fmt.Errorf("%w: %s: %v", ErrLockLost, name, err)
+            cancel()
+            return
+          }
+      }
+    }
+  }()
+  
+  err := f(fctx)
+  close(done)
+  wg.Wait()
+  
+  select {
+    case lerr := <-lost:
+      if err == nil {
+        err = lerr
+      }
+      return true, err
+    default:
+      return false, err
+  }
+}
+
+func (s *Service) Mutex(name string) (sync.Mutex, error) {
+  return &mutex{svc:s, name:name, key:Key(name)}, nil
+}
+
+func (s *Service) RWMutex(name string) (sync.RWMutex, error) {
+  return &mutex{svc:s, name:name, key:Key(name)}, nil
+}
+
+func (s *Service) Semaphore(name string, n int) (sync.Semaphore, error) {
+  if n < 1 {
+    return nil, fmt.Errorf("Semaphore %s must permit at least one holder", name)
+  }
+  keys := make([]int64, n)
+  for i := range keys {
+    keys[i] = Key(fmt.Sprintf("%s#%d", name, i))
+  }
+  return &semaphore{svc:s, name:name, keys:keys, retry:RETRY_INTERVAL_DEFAULT}, nil
+}
@@ -0,0 +1,202 @@
+package pgadvisory
+
+import (
+  "fmt"
+  "time"
+  "errors"
+  "context"
+  "strings"
+  "testing"
+  "sync/atomic"
+  "database/sql"
+  "database/sql/driver"
+)
+
+import (
+  "github.com/hirepurpose/godb/sync"
+  "github.com/hirepurpose/godb/test"
+  "github.com/stretchr/testify/assert"
+)
+
+// A fake database which grants every advisory lock and fails to check held
+// connections while dropped is set
+func newFakeService(name string, dropped *atomic.Bool) (*test.FakeDB, *Service, error) {
+  f := test.NewFakeDB(name, func(q string, args []driver.Value) (*test.FakeResult, error) {
+    switch {
+      case q == "SELECT 1" && dropped.Load():
+        return nil, errors.New("Connection reset by peer")
+      case strings.HasPrefix(q, "SELECT pg_try_advisory_lock"), strings.HasPrefix(q, "SELECT pg_advisory_unlock"):
+        return &test.FakeResult{Rows:[][]driver.Value{{true}}}, nil
+      default:
+        return nil, nil
+    }
+  })
+  db, err := sql.Open(test.FakeDriver, name)
+  if err != nil {
+    return nil, nil, err
+  }
+  return f, NewWithOptions(db, Options{PingInterval:time.Millisecond * 5}), nil
+}
+
+// Count the statements which release a lock
+func unlocks(f *test.FakeDB) int {
+  var n int
+  for _, e := range f.Statements() {
+    if strings.HasPrefix(e, "SELECT pg_advisory_unlock") {
+      n++
+    }
+  }
+  return n
+}
+
+func TestPerformLost(t *testing.T) {
+  var dropped atomic.Bool
+  f, svc, err := newFakeService("pgadvisory_lost", &dropped)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  defer svc.db.Close()
+  
+  m, err := svc.RWMutex("mutex")
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  s, err := svc.Semaphore("semaphore", 2)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  
+  tests := []struct {
+    Name    string
+    Perform func(context.Context, func(context.Context)error) error
+  }{
+    {"PerformContext", m.PerformContext},
+    {"RPerformContext", m.RPerformContext},
+    {"Semaphore", s.Perform},
+  }
+  for _, e := range tests {
+    dropped.Store(false)
+    f.Reset()
+    
+    // while the connection is alive the function runs to completion and the
+    // lock is released
+    err = e.Perform(context.Background(), func(ctx context.Context) error {
+      time.Sleep(time.Millisecond * 25)
+      return ctx.Err()
+    })
+    assert.Nil(t, err, fmt.Sprintf("%s: %v", e.Name, err))
+    assert.Equal(t, 1, unlocks(f), e.Name)
+    
+    // once the connection drops the function's context is canceled and the
+    // lock, which has been released by the database, is not released again
+    var canceled bool
+    err = e.Perform(context.Background(), func(ctx context.Context) error {
+      dropped.Store(true)
+      select {
+        case <-ctx.Done():
+          canceled = true
+        case <-time.After(time.Second):
+      }
+      return nil
+    })
+    assert.True(t, canceled, e.Name)
+    assert.True(t, errors.Is(err, ErrLockLost), fmt.Sprintf("%s: %v", e.Name, err))
+    assert.Equal(t, 1, unlocks(f), e.Name)
+  }
+  
+  // the lost lock is no longer held
+  assert.Equal(t, sync.ErrNotLocked, m.Unlock())
+  assert.Equal(t, sync.ErrNotLocked, m.RUnlock())
+}
+
+func TestRelock(t *testing.T) {
+  var dropped atomic.Bool
+  _, svc, err := newFakeService("pgadvisory_relock", &dropped)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  defer svc.db.Close()
+  
+  m, err := svc.Mutex("mutex")
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  
+  // the lock is granted again, as when the session holding it was terminated; the
+  // connection which no longer holds it is discarded rather than leaked
+  assert.Nil(t, m.Lock())
+  ok, err := m.TryLock(context.Background())
+  assert.Nil(t, err, fmt.Sprint(err))
+  assert.True(t, ok)
+  assert.Nil(t, m.LockContext(context.Background()))
+  assert.Equal(t, 1, svc.db.Stats().InUse)
+  
+  assert.Nil(t, m.Unlock())
+  assert.Equal(t, 0, svc.db.Stats().InUse)
+  assert.Equal(t, sync.ErrNotLocked, m.Unlock())
+}
+
+func TestPerformError(t *testing.T) {
+  var dropped atomic.Bool
+  f, svc, err := newFakeService("pgadvisory_error", &dropped)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  defer svc.db.Close()
+  
+  m, err := svc.Mutex("mutex")
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  
+  // the function's error takes precedence over the loss of the lock
+  errFail := errors.New("Failed")
+  err = m.PerformContext(context.Background(), func(ctx context.Context) error {
+    dropped.Store(true)
+    <-ctx.Done()
+    return errFail
+  })
+  assert.Equal(t, errFail, err)
+  assert.Equal(t, 0, unlocks(f))
+}
+
+func TestElectionLost(t *testing.T) {
+  var dropped atomic.Bool
+  _, svc, err := newFakeService("pgadvisory_election", &dropped)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  defer svc.db.Close()
+  
+  events := make(chan string, 16)
+  e := sync.NewElection(svc, "/leader", sync.ElectionOptions{
+    OnElected: func(context.Context) { events <- "elected" },
+    OnRevoked: func() { events <- "revoked" },
+    OnError: func(err error) {
+      if errors.Is(err, ErrLockLost) {
+        dropped.Store(false) // the next term is held on a new connection
+        events <- "lost"
+      }else{
+        events <- "error: "+ err.Error()
+      }
+    },
+    RetryInterval: time.Millisecond * 10,
+  })
+  
+  ctx, cancel := context.WithCancel(context.Background())
+  done := make(chan struct{})
+  go func() { e.Run(ctx); close(done) }()
+  assert.Equal(t, "elected", <-events)
+  assert.True(t, e.IsLeader())
+  
+  dropped.Store(true) // the connection holding the lock drops, so leadership is lost
+  assert.Equal(t, "revoked", <-events)
+  assert.Equal(t, "lost", <-events)
+  assert.Equal(t, "elected", <-events) // and the candidate campaigns again
+  assert.True(t, e.IsLeader())
+  
+  cancel()
+  <-done
+  assert.Equal(t, "revoked", <-events)
+  assert.False(t, e.IsLeader())
+}
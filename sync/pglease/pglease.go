@@ -0,0 +1,606 @@
+package pglease
+
+import (
+  "os"
+  "fmt"
+  "time"
+  "errors"
+  "context"
+  "database/sql"
+  gosync "sync"
+  
+  "github.com/hirepurpose/godb/sync"
+  "github.com/hirepurpose/godb/uuid"
+)
+
+const (
+  TABLE_DEFAULT           = "godb_locks"
+  TTL_DEFAULT             = time.Second * 30
+  RETRY_INTERVAL_DEFAULT  = time.Millisecond * 250
+)
+
+var (
+  ErrLeaseLost = fmt.Errorf("Lease was lost")
+)
+
+// Lock service options
+type Options struct {
+  Table         string        // the lock table; defaults to TABLE_DEFAULT. Shared leases are stored in the table of the same name suffixed by "_shared".
+  TTL           time.Duration // the lease duration; defaults to TTL_DEFAULT
+  RetryInterval time.Duration // the interval at which a held lock is retried; defaults to RETRY_INTERVAL_DEFAULT
+  Owner         string        // identifies this service as the holder of its locks; defaults to a unique identifier
+}
+
+// A lock service backed by a Postgres table. Locks are leases which expire if
+// they are not renewed, so a lock whose holder dies or is partitioned from the
+// database is eventually released. Each exclusive acquisition of a lock is
+// assigned a fencing token which increases monotonically.
+type Service struct {
+  db      *sql.DB
+  table   string
+  shared  string
+  ttl     time.Duration
+  retry   time.Duration
+  owner   string
+}
+
+// Create a lock service with default options
+func New(db *sql.DB) (*Service, error) {
+  return NewWithOptions(db, Options{})
+}
+
+// Create a lock service with options. The lock tables must already exist; they
+// may be created by Install or by a migration which executes the statements
+// produced by Schema.
+func NewWithOptions(db *sql.DB, opts Options) (*Service, error) {
+  s := &Service{db:db, table:opts.Table, ttl:opts.TTL, retry:opts.RetryInterval, owner:opts.Owner}
+  if s.table == "" {
+    s.table = TABLE_DEFAULT
+  }
+  s.shared = s.table +"_shared"
+  if s.ttl <= 0 {
+    s.ttl = TTL_DEFAULT
+  }
+  if s.retry <= 0 {
+    s.retry = RETRY_INTERVAL_DEFAULT
+  }
+  if s.owner == "" {
+    host, _ := os.Hostname()
+    s.owner = fmt.Sprintf("%s/%d/%v", host, os.Getpid(), uuid.New())
+  }
+  return s, nil
+}
+
+// Produce the statements which create the lock tables used by this service if
+// they do not exist
+func (s *Service) Schema() []string {
+  return []string{
+    fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (name TEXT PRIMARY KEY, owner TEXT NOT NULL, token BIGINT NOT NULL, expires_at TIMESTAMP WITH TIME ZONE NOT NULL)", s.table),
+    fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (name TEXT NOT NULL, holder TEXT NOT NULL, expires_at TIMESTAMP WITH TIME ZONE NOT NULL, PRIMARY KEY (name, holder))", s.shared),
+  }
+}
+
+// Create the lock tables used by this service if they do not exist. This requires
+// privileges to create tables; applications whose schema is managed by migrations
+// should execute the statements produced by Schema in a migration instead.
+func (s *Service) Install(ctx context.Context) error {
+  for _, e := range s.Schema() {
+    _, err := s.db.ExecContext(ctx, e)
+    if err != nil {
+      return fmt.Errorf("Could not create lock tables: %w", err)
+    }
+  }
+  return nil
+}
+
+// Obtain the identifier of this service as the holder of its locks
+func (s *Service) Owner() string {
+  return s.owner
+}
+
+// Obtain a mutex
+func (s *Service) Mutex(name string) (sync.Mutex, error) {
+  return &Mutex{svc:s, name:name}, nil
+}
+
+// Obtain a read/write mutex
+func (s *Service) RWMutex(name string) (sync.RWMutex, error) {
+  return &Mutex{svc:s, name:name}, nil
+}
+
+// Obtain a semaphore
+func (s *Service) Semaphore(name string, n int) (sync.Semaphore, error) {
+  if n < 1 {
+    return nil, fmt.Errorf("Semaphore %s must permit at least one holder", name)
+  }
+  slots := make([]*Mutex, n)
+  for i := range slots {
+    slots[i] = &Mutex{svc:s, name:fmt.Sprintf("%s#%d", name, i)}
+  }
+  return &Semaphore{svc:s, name:name, slots:slots}, nil
+}
+
+// Update a lease, failing with ErrLeaseLost if no lease was updated
+func (s *Service) update(ctx context.Context, q string, args ...interface{}) error {
+  res, err := s.db.ExecContext(ctx, q, args...)
+  if err != nil {
+    return err
+  }
+  n, err := res.RowsAffected()
+  if err != nil {
+    return err
+  }
+  if n < 1 {
+    return ErrLeaseLost
+  }
+  return nil
+}
+
+// Attempt an acquisition until it succeeds or the context is done
+func (s *Service) poll(ctx context.Context, try func(context.Context)(bool, error)) error {
+  t := time.NewTicker(s.retry)
+  defer t.Stop()
+  for {
+    ok, err := try(ctx)
+    if err != nil {
+      return err
+    }else if ok {
+      return nil
+    }
+    select {
+      case <-ctx.Done():
+        return ctx.Err()
+      case <-t.C:
+    }
+  }
+}
+
+// Perform a function while renewing a lease in the background. A renewal which
+// fails, e.g., due to a connection blip, is retried until the lease would have
+// expired. If the lease is lost, the function's context is canceled and the
+// renewal error is returned unless the function fails first, along with true.
+func (s *Service) hold(ctx context.Context, renew func(context.Context)(error), f func(context.Context)(error)) (bool, error) {
+  fctx, cancel := context.WithCancel(ctx)
+  defer cancel()
+  
+  var wg gosync.WaitGroup
+  lost := make(chan error, 1)
+  done := make(chan struct{})
+  wg.Add(1)
+  go func() {
+    defer wg.Done()
+    ival := s.ttl / 3
+    t := time.NewTicker(ival)
+    defer t.Stop()
+    last := time.Now() // conservatively, the lease is valid for one TTL from the last renewal attempt which succeeded
+    for {
+      select {
+        case <-done:
+          return
+        case <-t.C:
+          start := time.Now()
+          rctx, rcancel := context.WithTimeout(context.Background(), ival) // renewal is independent of the caller's context
+          err := renew(rctx)
+          rcancel()
+          if err == nil {
+            last = start
+          }else if errors.Is(err, ErrLeaseLost) || time.Since(last) >= s.ttl {
+            lost <- err
+            cancel()
+            return
+          } // otherwise, the failure may be transient; try again until the lease expires
+      }
+    }
+  }()
+  
+  err := f(fctx)
+  close(done)
+  wg.Wait()
+  
+  select {
+    case lerr := <-lost:
+      if err == nil {
+        err = lerr
+      }
+      return true, err
+    default:
+      return false, err
+  }
+}
+
+// A lease-based read/write mutex. It is held for writing by a single exclusive
+// lease, which carries a fencing token, and for reading by any number of shared
+// leases while there is no exclusive lease.
+type Mutex struct {
+  gosync.Mutex
+  svc     *Service
+  name    string
+  token   int64     // the fencing token of the current exclusive lease, or zero if it is not held
+  readers []string  // the holders of shared leases acquired through this mutex
+}
+
+// Obtain the fencing token of the current exclusive lease, or zero if the lock
+// is not held for writing. Resources protected by the lock can reject writes
+// which carry a token lower than the highest they have seen, which guards against
+// a holder whose lease expired without it noticing.
+func (m *Mutex) Token() int64 {
+  m.Mutex.Lock()
+  defer m.Mutex.Unlock()
+  return m.token
+}
+
+// Attempt to acquire the lease. Acquisitions of the same name are serialized by
+// a transaction-level advisory lock so that exclusive and shared leases can be
+// checked against each other.
+func (m *Mutex) acquire(ctx context.Context) (bool, error) {
+  tx, err := m.svc.db.BeginTx(ctx, nil)
+  if err != nil {
+    return false, fmt.Errorf("Could not lock %s: %w", m.name, err)
+  }
+  defer tx.Rollback()
+  
+  _, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", m.name)
+  if err != nil {
+    return false, fmt.Errorf("Could not lock %s: %w", m.name, err)
+  }
+  var readers bool
+  err = tx.QueryRowContext(ctx, fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE name = $1 AND expires_at > now())", m.svc.shared), m.name).Scan(&readers)
+  if err != nil {
+    return false, fmt.Errorf("Could not lock %s: %w", m.name, err)
+  }
+  if readers {
+    return false, nil // the lock is held for reading
+  }
+  
+  var token int64
+  err = tx.QueryRowContext(ctx, fmt.Sprintf(`INSERT INTO %[1]s (name, owner, token, expires_at) VALUES ($1, $2, 1, now() + $3 * interval '1 millisecond')
+    ON CONFLICT (name) DO UPDATE SET owner = EXCLUDED.owner, token = %[1]s.token + 1, expires_at = EXCLUDED.expires_at
+    WHERE %[1]s.expires_at <= now()
+    RETURNING token`, m.svc.table), m.name, m.svc.owner, m.svc.ttl.Milliseconds()).Scan(&token)
+  if err == sql.ErrNoRows {
+    return false, nil // the lease is held by another owner
+  }else if err != nil {
+    return false, fmt.Errorf("Could not lock %s: %w", m.name, err)
+  }
+  
+  err = tx.Commit()
+  if err != nil {
+    return false, fmt.Errorf("Could not lock %s: %w", m.name, err)
+  }
+  m.Mutex.Lock()
+  m.token = token
+  m.Mutex.Unlock()
+  return true, nil
+}
+
+// Acquire the lock, blocking until it is available
+func (m *Mutex) Lock() error {
+  return m.LockContext(context.Background())
+}
+
+// Acquire the lock, blocking until it is available or the context is done
+func (m *Mutex) LockContext(ctx context.Context) error {
+  err := m.svc.poll(ctx, m.acquire)
+  if err != nil && ctx.Err() != nil {
+    return fmt.Errorf("Could not lock %s: %w", m.name, err)
+  }
+  return err
+}
+
+// Acquire the lock if it is available without blocking
+func (m *Mutex) TryLock(ctx context.Context) (bool, error) {
+  return m.acquire(ctx)
+}
+
+// Acquire the lock, blocking for up to the provided duration
+func (m *Mutex) LockWithTimeout(d time.Duration) error {
+  return sync.LockWithTimeout(m, d)
+}
+
+// Renew the exclusive lease for another TTL. If the lease has expired and been
+// acquired by another owner in the meantime, ErrLeaseLost is returned.
+func (m *Mutex) Renew(ctx context.Context) error {
+  token := m.Token()
+  if token == 0 {
+    return sync.ErrNotLocked
+  }
+  err := m.svc.update(ctx, fmt.Sprintf("UPDATE %s SET expires_at = now() + $4 * interval '1 millisecond' WHERE name = $1 AND owner = $2 AND token = $3", m.svc.table), m.name, m.svc.owner, token, m.svc.ttl.Milliseconds())
+  if err != nil {
+    return fmt.Errorf("Could not renew %s: %w", m.name, err)
+  }
+  return nil
+}
+
+// Release the lock
+func (m *Mutex) Unlock() error {
+  return m.UnlockContext(context.Background())
+}
+
+// Release the lock. The lease is expired rather than deleted so that fencing
+// tokens continue to increase.
+func (m *Mutex) UnlockContext(ctx context.Context) error {
+  m.Mutex.Lock()
+  token := m.token
+  m.token = 0
+  m.Mutex.Unlock()
+  if token == 0 {
+    return sync.ErrNotLocked
+  }
+  err := m.svc.update(ctx, fmt.Sprintf("UPDATE %s SET expires_at = now() WHERE name = $1 AND owner = $2 AND token = $3", m.svc.table), m.name, m.svc.owner, token)
+  if err != nil {
+    return fmt.Errorf("Could not unlock %s: %w", m.name, err)
+  }
+  return nil
+}
+
+// Perform a function while holding the lock, as with PerformContext
+func (m *Mutex) Perform(f func()error) error {
+  return m.PerformContext(context.Background(), func(context.Context) error {
+    return f()
+  })
+}
+
+// Perform a function while holding the lock. The lease is renewed in the background
+// while the function runs; a renewal which fails, e.g., due to a connection blip,
+// is retried until the lease would have expired. If the lease is lost, the
+// function's context is canceled and the renewal error, which wraps ErrLeaseLost
+// if another owner acquired the lock, is returned unless the function fails first.
+func (m *Mutex) PerformContext(ctx context.Context, f func(context.Context)error) error {
+  err := m.LockContext(ctx)
+  if err != nil {
+    return err
+  }
+  lost, err := m.svc.hold(ctx, m.Renew, f)
+  if lost {
+    m.Mutex.Lock()
+    m.token = 0 // the lease is no longer ours to release
+    m.Mutex.Unlock()
+  }else if uerr := m.UnlockContext(context.Background()); uerr != nil && err == nil {
+    err = uerr
+  }
+  return err
+}
+
+// Attempt to acquire a shared lease, returning its holder if it is acquired
+func (m *Mutex) racquire(ctx context.Context) (string, error) {
+  tx, err := m.svc.db.BeginTx(ctx, nil)
+  if err != nil {
+    return "", fmt.Errorf("Could not lock %s: %w", m.name, err)
+  }
+  defer tx.Rollback()
+  
+  _, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", m.name)
+  if err != nil {
+    return "", fmt.Errorf("Could not lock %s: %w", m.name, err)
+  }
+  var writer bool
+  err = tx.QueryRowContext(ctx, fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE name = $1 AND expires_at > now())", m.svc.table), m.name).Scan(&writer)
+  if err != nil {
+    return "", fmt.Errorf("Could not lock %s: %w", m.name, err)
+  }
+  if writer {
+    return "", nil // the lock is held for writing
+  }
+  
+  _, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE name = $1 AND expires_at <= now()", m.svc.shared), m.name)
+  if err != nil {
+    return "", fmt.Errorf("Could not lock %s: %w", m.name, err)
+  }
+  holder := fmt.Sprintf("%s/%v", m.svc.owner, uuid.New())
+  _, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (name, holder, expires_at) VALUES ($1, $2, now() + $3 * interval '1 millisecond')", m.svc.shared), m.name, holder, m.svc.ttl.Milliseconds())
+  if err != nil {
+    return "", fmt.Errorf("Could not lock %s: %w", m.name, err)
+  }
+  
+  err = tx.Commit()
+  if err != nil {
+    return "", fmt.Errorf("Could not lock %s: %w", m.name, err)
+  }
+  m.Mutex.Lock()
+  m.readers = append(m.readers, holder)
+  m.Mutex.Unlock()
+  return holder, nil
+}
+
+// Attempt to acquire a shared lease
+func (m *Mutex) tryRLock(ctx context.Context) (bool, error) {
+  h, err := m.racquire(ctx)
+  return h != "", err
+}
+
+// Forget a shared lease, returning false if it was not held
+func (m *Mutex) forget(holder string) bool {
+  m.Mutex.Lock()
+  defer m.Mutex.Unlock()
+  for i, e := range m.readers {
+    if e == holder {
+      m.readers = append(m.readers[:i], m.readers[i+1:]...)
+      return true
+    }
+  }
+  return false
+}
+
+// Release a shared lease
+func (m *Mutex) runlock(ctx context.Context, holder string) error {
+  if !m.forget(holder) {
+    return sync.ErrNotLocked
+  }
+  err := m.svc.update(ctx, fmt.Sprintf("DELETE FROM %s WHERE name = $1 AND holder = $2", m.svc.shared), m.name, holder)
+  if err != nil {
+    return fmt.Errorf("Could not unlock %s: %w", m.name, err)
+  }
+  return nil
+}
+
+// Renew a shared lease
+func (m *Mutex) rrenew(ctx context.Context, holder string) error {
+  err := m.svc.update(ctx, fmt.Sprintf("UPDATE %s SET expires_at = now() + $3 * interval '1 millisecond' WHERE name = $1 AND holder = $2", m.svc.shared), m.name, holder, m.svc.ttl.Milliseconds())
+  if err != nil {
+    return fmt.Errorf("Could not renew %s: %w", m.name, err)
+  }
+  return nil
+}
+
+// Acquire the lock for reading
+func (m *Mutex) RLock() error {
+  return m.RLockContext(context.Background())
+}
+
+// Acquire the lock for reading, blocking until it is available or the context
+// is done. Shared leases are not renewed unless the lock is acquired through
+// RPerformContext.
+func (m *Mutex) RLockContext(ctx context.Context) error {
+  err := m.svc.poll(ctx, m.tryRLock)
+  if err != nil && ctx.Err() != nil {
+    return fmt.Errorf("Could not lock %s: %w", m.name, err)
+  }
+  return err
+}
+
+// Acquire the lock for reading if it is available without blocking
+func (m *Mutex) TryRLock(ctx context.Context) (bool, error) {
+  return m.tryRLock(ctx)
+}
+
+// Release the lock for reading
+func (m *Mutex) RUnlock() error {
+  return m.RUnlockContext(context.Background())
+}
+
+// Release the most recently acquired shared lease
+func (m *Mutex) RUnlockContext(ctx context.Context) error {
+  m.Mutex.Lock()
+  n := len(m.readers)
+  var holder string
+  if n > 0 {
+    holder = m.readers[n - 1]
+  }
+  m.Mutex.Unlock()
+  if holder == "" {
+    return sync.ErrNotLocked
+  }
+  return m.runlock(ctx, holder)
+}
+
+// Perform a function while holding the lock for reading, as with RPerformContext
+func (m *Mutex) RPerform(f func()error) error {
+  return m.RPerformContext(context.Background(), func(context.Context) error {
+    return f()
+  })
+}
+
+// Perform a function while holding the lock for reading. The shared lease is
+// renewed in the background, as with PerformContext.
+func (m *Mutex) RPerformContext(ctx context.Context, f func(context.Context)error) error {
+  var holder string
+  err := m.svc.poll(ctx, func(ctx context.Context) (bool, error) {
+    var err error
+    holder, err = m.racquire(ctx)
+    return holder != "", err
+  })
+  if err != nil {
+    return err
+  }
+  lost, err := m.svc.hold(ctx, func(ctx context.Context) error {
+    return m.rrenew(ctx, holder)
+  }, f)
+  if lost {
+    m.forget(holder)
+  }else if uerr := m.runlock(context.Background(), holder); uerr != nil && err == nil {
+    err = uerr
+  }
+  return err
+}
+
+// A lease-based counting semaphore. Each of its n permits is an exclusive lease;
+// a permit is acquired by acquiring any one of them.
+type Semaphore struct {
+  gosync.Mutex
+  svc   *Service
+  name  string
+  slots []*Mutex
+  held  []*Mutex
+}
+
+// Attempt to acquire a permit, returning its slot if one is acquired
+func (s *Semaphore) acquire(ctx context.Context) (*Mutex, error) {
+  for _, e := range s.slots {
+    ok, err := e.TryLock(ctx)
+    if err != nil {
+      return nil, fmt.Errorf("Could not acquire %s: %w", s.name, err)
+    }else if ok {
+      s.Lock()
+      s.held = append(s.held, e)
+      s.Unlock()
+      return e, nil
+    }
+  }
+  return nil, nil
+}
+
+// Forget a held permit
+func (s *Semaphore) forget(m *Mutex) {
+  s.Lock()
+  defer s.Unlock()
+  for i, e := range s.held {
+    if e == m {
+      s.held = append(s.held[:i], s.held[i+1:]...)
+      return
+    }
+  }
+}
+
+// Acquire a permit, blocking until one is available or the context is done.
+// Permits are not renewed unless they are acquired through Perform.
+func (s *Semaphore) Acquire(ctx context.Context) error {
+  err := s.svc.poll(ctx, s.TryAcquire)
+  if err != nil && ctx.Err() != nil {
+    return fmt.Errorf("Could not acquire %s: %w", s.name, err)
+  }
+  return err
+}
+
+// Acquire a permit if one is available without blocking
+func (s *Semaphore) TryAcquire(ctx context.Context) (bool, error) {
+  m, err := s.acquire(ctx)
+  return m != nil, err
+}
+
+// Release the most recently acquired permit
+func (s *Semaphore) Release(ctx context.Context) error {
+  s.Lock()
+  n := len(s.held)
+  if n < 1 {
+    s.Unlock()
+    return sync.ErrNotLocked
+  }
+  m := s.held[n - 1]
+  s.held = s.held[:n - 1]
+  s.Unlock()
+  return m.UnlockContext(ctx)
+}
+
+// Perform a function while holding a permit. The permit's lease is renewed in
+// the background, as with Mutex.PerformContext.
+func (s *Semaphore) Perform(ctx context.Context, f func(context.Context)error) error {
+  var m *Mutex
+  err := s.svc.poll(ctx, func(ctx context.Context) (bool, error) {
+    var err error
+    m, err = s.acquire(ctx)
+    return m != nil, err
+  })
+  if err != nil {
+    return err
+  }
+  lost, err := s.svc.hold(ctx, m.Renew, f)
+  s.forget(m)
+  if lost {
+    m.Mutex.Lock()
+    m.token = 0
+    m.Mutex.Unlock()
+  }else if uerr := m.UnlockContext(context.Background()); uerr != nil && err == nil {
+    err = uerr
+  }
+  return err
+}
@@ -0,0 +1,38 @@
+package pglease
+
+import (
+  "fmt"
+  "context"
+  "testing"
+  "database/sql"
+)
+
+import (
+  "github.com/hirepurpose/godb/test"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestInstall(t *testing.T) {
+  f := test.NewFakeDB("pglease_install", nil)
+  db, err := sql.Open(test.FakeDriver, "pglease_install")
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  defer db.Close()
+  
+  s, err := NewWithOptions(db, Options{Table:"leases"})
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  assert.Equal(t, 0, len(f.Statements())) // creating the service does not modify the schema
+  
+  schema := s.Schema()
+  if assert.Equal(t, 2, len(schema)) {
+    assert.Contains(t, schema[0], "CREATE TABLE IF NOT EXISTS leases ")
+    assert.Contains(t, schema[1], "CREATE TABLE IF NOT EXISTS leases_shared ")
+  }
+  
+  err = s.Install(context.Background())
+  assert.Nil(t, err, fmt.Sprint(err))
+  assert.Equal(t, schema, f.Statements())
+}
@@ -1,13 +1,90 @@
 package sync
 
+import (
+  "fmt"
+  "time"
+  "errors"
+  "context"
+)
+
+var (
+  ErrNotLocked  = fmt.Errorf("Mutex is not locked")
+  ErrTimeout    = fmt.Errorf("Timed out waiting for mutex")
+)
+
 // A mutex
 type Mutex interface {
   Lock()(error)
   Unlock()(error)
   Perform(func()error)(error)
+  
+  // Acquire the mutex, blocking until it is available or the context is done
+  LockContext(context.Context)(error)
+  // Release the mutex
+  UnlockContext(context.Context)(error)
+  // Acquire the mutex if it is available without blocking; returns false if it is held
+  TryLock(context.Context)(bool, error)
+  // Acquire the mutex, blocking for up to the provided duration; returns ErrTimeout if it is not acquired
+  LockWithTimeout(time.Duration)(error)
+  // Perform a function while holding the mutex. The function's context is canceled
+  // if the mutex is lost before it returns, for implementations which can detect that.
+  PerformContext(context.Context, func(context.Context)error)(error)
+}
+
+// A read/write mutex. The methods of Mutex acquire and release it exclusively
+// for writing; any number of readers may hold it concurrently while there is no
+// writer.
+type RWMutex interface {
+  Mutex
+  
+  RLock()(error)
+  RUnlock()(error)
+  RPerform(func()error)(error)
+  
+  // Acquire the mutex for reading, blocking until it is available or the context is done
+  RLockContext(context.Context)(error)
+  // Release the mutex for reading
+  RUnlockContext(context.Context)(error)
+  // Acquire the mutex for reading if it is available without blocking; returns false if it is held for writing
+  TryRLock(context.Context)(bool, error)
+  // Perform a function while holding the mutex for reading, as with PerformContext
+  RPerformContext(context.Context, func(context.Context)error)(error)
+}
+
+// A counting semaphore, which limits the number of concurrent holders. A single
+// semaphore may hold several permits, which are released in the reverse order
+// they were acquired.
+type Semaphore interface {
+  // Acquire a permit, blocking until one is available or the context is done
+  Acquire(context.Context)(error)
+  // Acquire a permit if one is available without blocking; returns false if none are
+  TryAcquire(context.Context)(bool, error)
+  // Release the most recently acquired permit
+  Release(context.Context)(error)
+  // Perform a function while holding a permit, as with Mutex.PerformContext
+  Perform(context.Context, func(context.Context)error)(error)
 }
 
 // A sync service
 type Service interface {
+  // Obtain the named mutex
   Mutex(string)(Mutex, error)
+  // Obtain the named read/write mutex. A mutex and a read/write mutex of the same
+  // name exclude each other.
+  RWMutex(string)(RWMutex, error)
+  // Obtain the named semaphore, which permits up to n concurrent holders. Every
+  // user of a semaphore must agree on n.
+  Semaphore(string, int)(Semaphore, error)
+}
+
+// Acquire a mutex under a context with the provided timeout. This is a convenience
+// for implementations of LockWithTimeout.
+func LockWithTimeout(m Mutex, d time.Duration) error {
+  ctx, cancel := context.WithTimeout(context.Background(), d)
+  defer cancel()
+  err := m.LockContext(ctx)
+  if errors.Is(err, context.DeadlineExceeded) {
+    return ErrTimeout
+  }
+  return err
 }
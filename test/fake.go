@@ -0,0 +1,302 @@
+package test
+
+import (
+  "io"
+  "fmt"
+  "sync"
+  "context"
+  "net/url"
+  "database/sql"
+  "database/sql/driver"
+  
+  "github.com/hirepurpose/godb"
+)
+
+// The name under which the fake driver is registered
+const FakeDriver = "godb_fake"
+
+func init() {
+  sql.Register(FakeDriver, fakeDriver{})
+}
+
+// The result of a statement executed on a fake database
+type FakeResult struct {
+  Columns       []string
+  Rows          [][]driver.Value
+  RowsAffected  int64
+  Err           error // reported once the rows are exhausted, as by a connection which fails mid-result
+}
+
+// Answers statements executed on a fake database. If the handler returns a nil
+// result the statement affects no rows and selects none.
+type FakeHandler func(query string, args []driver.Value)(*FakeResult, error)
+
+// A fake database, which records the statements executed on it and answers them
+// with a handler. Fake databases are opened by the fake driver using their name
+// as the data source name; transactions are recorded as the statements BEGIN,
+// COMMIT and ROLLBACK. This allows code which routes statements, such as replica
+// selection and transaction management, to be tested without a database server.
+type FakeDB struct {
+  sync.Mutex
+  name      string
+  handler   FakeHandler
+  stmts     []string
+  prepared  int
+}
+
+var (
+  fakeLock  sync.Mutex
+  fakes     = make(map[string]*FakeDB)
+)
+
+// Create a fake database with the provided name, replacing any of the same name
+func NewFakeDB(name string, h FakeHandler) *FakeDB {
+  f := &FakeDB{name:name, handler:h}
+  fakeLock.Lock()
+  defer fakeLock.Unlock()
+  fakes[name] = f
+  return f
+}
+
+// Obtain the URI of this database, which is opened by FakeDialect
+func (f *FakeDB) URL() string {
+  return "fake://"+ url.PathEscape(f.name)
+}
+
+// Set the handler which answers statements
+func (f *FakeDB) SetHandler(h FakeHandler) {
+  f.Lock()
+  defer f.Unlock()
+  f.handler = h
+}
+
+// Obtain the statements executed so far, in order
+func (f *FakeDB) Statements() []string {
+  f.Lock()
+  defer f.Unlock()
+  return append([]string{}, f.stmts...)
+}
+
+// Obtain the number of statements which have been prepared
+func (f *FakeDB) Prepared() int {
+  f.Lock()
+  defer f.Unlock()
+  return f.prepared
+}
+
+// Forget the statements executed so far
+func (f *FakeDB) Reset() {
+  f.Lock()
+  defer f.Unlock()
+  f.stmts, f.prepared = nil, 0
+}
+
+// Record and answer a statement
+func (f *FakeDB) execute(q string, args []driver.Value) (*FakeResult, error) {
+  f.Lock()
+  f.stmts = append(f.stmts, q)
+  h := f.handler
+  f.Unlock()
+  if h == nil {
+    return &FakeResult{}, nil
+  }
+  r, err := h(q, args)
+  if err != nil {
+    return nil, err
+  }else if r == nil {
+    r = &FakeResult{}
+  }
+  return r, nil
+}
+
+// A dialect which opens fake databases, named by the host of their URIs, and
+// otherwise behaves as the dialect it wraps
+type fakeDialect struct {
+  godb.Dialect
+}
+
+// Produce a dialect which opens fake databases and otherwise behaves as the
+// provided dialect
+func FakeDialect(d godb.Dialect) godb.Dialect {
+  return fakeDialect{d}
+}
+
+func (d fakeDialect) DataSource(u *url.URL) (string, string, error) {
+  return FakeDriver, u.Host, nil
+}
+
+// Open a database on a fake primary and, optionally, fake replicas. Unless
+// options provide them, the dialect is Postgres, the connection banner is not
+// logged and pool statistics are not published.
+func NewFakeDatabase(opts godb.Options, primary *FakeDB, replicas ...*FakeDB) (*godb.Database, error) {
+  if opts.Dialect == nil {
+    opts.Dialect = godb.Postgres
+  }
+  opts.Dialect = FakeDialect(opts.Dialect)
+  opts.Quiet = true
+  if opts.StatsInterval == 0 {
+    opts.StatsInterval = -1
+  }
+  for _, e := range replicas {
+    opts.Replicas = append(opts.Replicas, e.URL())
+  }
+  return godb.NewWithOptions(primary.URL(), opts)
+}
+
+// The fake driver
+type fakeDriver struct{}
+
+func (d fakeDriver) Open(name string) (driver.Conn, error) {
+  fakeLock.Lock()
+  f, ok := fakes[name]
+  fakeLock.Unlock()
+  if !ok {
+    return nil, fmt.Errorf("No such fake database: %s", name)
+  }
+  return &fakeConn{db:f}, nil
+}
+
+// A connection to a fake database
+type fakeConn struct {
+  db *FakeDB
+}
+
+func (c *fakeConn) Prepare(q string) (driver.Stmt, error) {
+  c.db.Lock()
+  c.db.prepared++
+  c.db.Unlock()
+  return &fakeStmt{c, q}, nil
+}
+
+func (c *fakeConn) Close() error {
+  return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+  return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+  _, err := c.db.execute("BEGIN", nil)
+  if err != nil {
+    return nil, err
+  }
+  return fakeTx{c}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, q string, args []driver.NamedValue) (driver.Result, error) {
+  r, err := c.db.execute(q, values(args))
+  if err != nil {
+    return nil, err
+  }
+  return driver.RowsAffected(r.RowsAffected), nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, q string, args []driver.NamedValue) (driver.Rows, error) {
+  r, err := c.db.execute(q, values(args))
+  if err != nil {
+    return nil, err
+  }
+  return &fakeRows{ctx, r, 0}, nil
+}
+
+// Convert named arguments to ordered values
+func values(args []driver.NamedValue) []driver.Value {
+  v := make([]driver.Value, len(args))
+  for i, e := range args {
+    v[i] = e.Value
+  }
+  return v
+}
+
+// A transaction on a fake database
+type fakeTx struct {
+  c *fakeConn
+}
+
+func (t fakeTx) Commit() error {
+  _, err := t.c.db.execute("COMMIT", nil)
+  return err
+}
+
+func (t fakeTx) Rollback() error {
+  _, err := t.c.db.execute("ROLLBACK", nil)
+  return err
+}
+
+// A prepared statement on a fake database
+type fakeStmt struct {
+  c *fakeConn
+  q string
+}
+
+func (s *fakeStmt) Close() error {
+  return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+  return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+  r, err := s.c.db.execute(s.q, args)
+  if err != nil {
+    return nil, err
+  }
+  return driver.RowsAffected(r.RowsAffected), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+  return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *fakeStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+  r, err := s.c.db.execute(s.q, values(args))
+  if err != nil {
+    return nil, err
+  }
+  return &fakeRows{ctx, r, 0}, nil
+}
+
+// Convert ordered values to named arguments
+func namedValues(args []driver.Value) []driver.NamedValue {
+  v := make([]driver.NamedValue, len(args))
+  for i, e := range args {
+    v[i] = driver.NamedValue{Ordinal:i + 1, Value:e}
+  }
+  return v
+}
+
+// Rows selected from a fake database. Rows stop, reporting the error, once the
+// context of the query which selected them is canceled.
+type fakeRows struct {
+  ctx context.Context
+  r   *FakeResult
+  i   int
+}
+
+func (r *fakeRows) Columns() []string {
+  if r.r.Columns == nil && len(r.r.Rows) > 0 {
+    return make([]string, len(r.r.Rows[0]))
+  }
+  return r.r.Columns
+}
+
+func (r *fakeRows) Close() error {
+  return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+  if err := r.ctx.Err(); err != nil {
+    return err
+  }
+  if r.i >= len(r.r.Rows) {
+    if r.r.Err != nil {
+      return r.r.Err
+    }
+    return io.EOF
+  }
+  copy(dest, r.r.Rows[r.i])
+  r.i++
+  return nil
+}
@@ -0,0 +1,15 @@
+//go:build sqlite
+
+package test
+
+import (
+  "github.com/hirepurpose/godb"
+)
+
+import (
+  _ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+  dialect = godb.DialectSQLite
+}
@@ -4,7 +4,9 @@ import (
   "os"
   "fmt"
   "sync"
+  "sort"
   "net/url"
+  "path/filepath"
   
   "github.com/hirepurpose/godb"
   "github.com/hirepurpose/godb/sync/faux"
@@ -17,6 +19,15 @@ import (
 
 const sourceDB = "postgres"
 
+// The dialect of the database under test. Tests run against Postgres unless they
+// are built with the sqlite tag, in which case they run against an SQLite database
+// in a temporary file and no Postgres server is required.
+var dialect = godb.DialectPostgres
+
+// The directory, relative to the package under test, which contains the schema
+// of an SQLite test database
+const sqliteSchema = "testdata/sqlite"
+
 func dburl(n string) string {
   return fmt.Sprintf("postgres://postgres@localhost/%s?sslmode=disable", url.PathEscape(n))
 }
@@ -26,35 +37,51 @@ func DB() *godb.Database {
   return sharedDB
 }
 
+// Initialize the shared test database. If it cannot be set up, e.g., because no
+// database server is available, the failure is reported and DB returns nil, so
+// tests which require a database fail while those which don't still run.
 var initOnce sync.Once
 func Init(n string, m bool) {
   initOnce.Do(func() {
-    teardown(n, m)
-    setup(n, m)
+    err := teardown(n, m)
+    if err == nil {
+      err = setup(n, m)
+    }
+    if err != nil {
+      fmt.Fprintf(os.Stderr, "test: Could not set up database %s: %v\n", n, err)
+    }
   })
 }
 
-func setup(name string, migrate bool) {
+func setup(name string, migrate bool) error {
   syncer := faux.New()
   
   debug.DEBUG   = istrue(os.Getenv("GODB_DEBUG"))
   debug.VERBOSE = istrue(os.Getenv("GODB_VERBOSE"))
   debug.TRACE   = istrue(os.Getenv("GODB_TRACE"))
   
-  err := postgres.CreateDatabase(dburl(sourceDB), name)
-  if err != nil {
-    panic(fmt.Errorf("Creating %s (from %s): %v", name, sourceDB, err))
+  var err error
+  if dialect == godb.DialectSQLite {
+    sharedDB, err = godb.New(sqliteurl(name), false, syncer) // migrations on startup are not supported for SQLite
+    if err != nil || !migrate {
+      return err
+    }
+    return createSQLite(sharedDB, sqliteSchema)
   }
-  sharedDB, err = godb.New(dburl(name), migrate, syncer)
+  
+  err = postgres.CreateDatabase(dburl(sourceDB), name)
   if err != nil {
-    panic(err)
+    return fmt.Errorf("Creating %s (from %s): %v", name, sourceDB, err)
   }
+  sharedDB, err = godb.New(dburl(name), migrate, syncer)
+  return err
 }
 
-func teardown(name string, migrate bool) {
-  err := teardownPostgres(name)
-  if err != nil {
-    panic(err)
+func teardown(name string, migrate bool) error {
+  if dialect == godb.DialectSQLite {
+    return teardownSQLite(name)
+  }else{
+    return teardownPostgres(name)
   }
 }
 
@@ -66,6 +93,43 @@ func teardownPostgres(name string) error {
   return nil
 }
 
+func sqlitepath(n string) string {
+  return filepath.Join(os.TempDir(), n +".db")
+}
+
+func sqliteurl(n string) string {
+  return fmt.Sprintf("sqlite3:%s?_foreign_keys=on", sqlitepath(n)) // opened with github.com/mattn/go-sqlite3
+}
+
+// Create the schema of an SQLite test database by executing the SQL files in the
+// provided directory, in order of their names
+func createSQLite(db *godb.Database, dir string) error {
+  files, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+  if err != nil {
+    return err
+  }
+  sort.Strings(files)
+  for _, e := range files {
+    data, err := os.ReadFile(e)
+    if err != nil {
+      return err
+    }
+    _, err = db.Exec(string(data))
+    if err != nil {
+      return fmt.Errorf("Creating schema (%s): %v", e, err)
+    }
+  }
+  return nil
+}
+
+func teardownSQLite(name string) error {
+  err := os.Remove(sqlitepath(name))
+  if err != nil && !os.IsNotExist(err) {
+    return err
+  }
+  return nil
+}
+
 func istrue(s string) bool {
   return s == "true" || s == "t" || s == "yes" || s == "y"
 }
@@ -0,0 +1,147 @@
+package godb
+
+import (
+  "time"
+  "context"
+  "strings"
+)
+
+import (
+  "github.com/bww/go-util/text"
+  "github.com/bww/go-util/debug"
+)
+
+// Span attribute keys. Where one exists, the OpenTelemetry semantic convention
+// for database spans is used.
+const (
+  AttrSystem    = "db.system"
+  AttrOperation = "db.operation"
+  AttrTable     = "db.sql.table"
+  AttrStatement = "db.statement"
+  AttrEntity    = "godb.entity"
+  AttrRows      = "godb.rows"
+)
+
+// A span of work traced by a Tracer
+type Span interface {
+  SetAttribute(key string, value interface{})
+  Finish(err error)
+}
+
+// A tracer creates spans for database work. The span started for an operation
+// is a child of the span carried by the provided context.Context, if any, and
+// the returned context.Context carries the new span so that work performed under
+// it, such as the statements executed by an ORM operation, is traced as its children.
+type Tracer interface {
+  Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Context key under which the current span is stored
+type spanContextKey struct{}
+
+// Obtain a context which carries the provided span. This is intended for use by
+// Tracer implementations to propagate parent spans.
+func ContextWithSpan(ctx context.Context, s Span) context.Context {
+  return context.WithValue(ctx, spanContextKey{}, s)
+}
+
+// Obtain the span carried by a context, if any
+func SpanFromContext(ctx context.Context) Span {
+  if ctx == nil {
+    return nil
+  }
+  s, _ := ctx.Value(spanContextKey{}).(Span)
+  return s
+}
+
+// A tracer which does nothing
+type nopTracer struct {}
+
+// A span which does nothing
+type nopSpan struct {}
+
+// Obtain a tracer which does nothing
+func NopTracer() Tracer {
+  return nopTracer{}
+}
+
+func (t nopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+  return ctx, nopSpan{}
+}
+
+func (s nopSpan) SetAttribute(key string, value interface{}) {
+  // nothing
+}
+
+func (s nopSpan) Finish(err error) {
+  // nothing
+}
+
+// Resolve a tracer. If none is provided and tracing is enabled via debug.TRACE,
+// spans which take at least a millisecond are logged; otherwise nothing is traced.
+func tracerOrDefault(t Tracer, l Logger) Tracer {
+  if t != nil {
+    return t
+  }else if debug.TRACE {
+    return NewLogTracer(l, time.Millisecond)
+  }else{
+    return NopTracer()
+  }
+}
+
+// Start a span for a statement
+func startStatement(ctx context.Context, t Tracer, op, query string) (context.Context, Span) {
+  if _, ok := t.(nopTracer); ok {
+    return ctx, nopSpan{} // avoid formatting attributes which are discarded
+  }
+  ctx, s := t.Start(ctx, "godb."+ op)
+  if f := strings.Fields(query); len(f) > 0 {
+    s.SetAttribute(AttrOperation, strings.ToUpper(f[0]))
+  }
+  s.SetAttribute(AttrStatement, text.CollapseSpaces(query))
+  return ctx, s
+}
+
+// A tracer which logs spans that take at least a threshold duration
+type logTracer struct {
+  log       Logger
+  threshold time.Duration
+}
+
+// A span created by a logging tracer
+type logSpan struct {
+  t     logTracer
+  ctx   context.Context
+  name  string
+  start time.Time
+  attrs Fields
+}
+
+// Create a tracer which logs finished spans, at LevelDebug or LevelWarn if they
+// fail, which take at least the threshold duration
+func NewLogTracer(l Logger, threshold time.Duration) Tracer {
+  return logTracer{loggerOrDefault(l), threshold}
+}
+
+func (t logTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+  s := &logSpan{t:t, ctx:ctx, name:name, start:time.Now(), attrs:Fields{}}
+  return ContextWithSpan(ctx, s), s
+}
+
+func (s *logSpan) SetAttribute(key string, value interface{}) {
+  s.attrs[key] = value
+}
+
+func (s *logSpan) Finish(err error) {
+  d := time.Since(s.start)
+  if d < s.t.threshold {
+    return
+  }
+  s.attrs[FieldDuration] = d
+  level := LevelDebug
+  if err != nil {
+    s.attrs[FieldError] = err
+    level = LevelWarn
+  }
+  s.t.log.Log(s.ctx, level, "trace: "+ s.name, s.attrs)
+}
@@ -0,0 +1,282 @@
+package godb
+
+import (
+  "fmt"
+  "sync"
+  "context"
+  "sync/atomic"
+  "database/sql"
+)
+
+// Transaction options. Deferrable only has an effect on serializable, read-only
+// Postgres transactions, which may then wait to obtain a snapshot that cannot fail
+// with a serialization failure; otherwise it is ignored. If a retry policy is
+// provided the transaction is retried according to it, as with
+// Database.TransactionRetry.
+type TxOptions struct {
+  Isolation   sql.IsolationLevel
+  ReadOnly    bool
+  Deferrable  bool
+  Retry       *RetryPolicy
+}
+
+// Context key under which the current transaction is stored
+type txContextKey struct{}
+
+// A transaction context. This is the context provided to a TransactionHandler.
+// Nested atomic operations performed within it, via Database.Atomic or
+// Database.TransactionContext, are scoped by savepoints so that they can be
+// rolled back without aborting the entire transaction.
+// 
+// Hooks may be registered to run after the transaction is committed or rolled
+// back. Hooks registered within a savepoint belong to the enclosing transaction;
+// if the savepoint is rolled back its rollback hooks are run immediately and its
+// commit hooks are discarded.
+type Tx struct {
+  tx        *sql.Tx
+  cxt       Context // the transaction or a context which wraps it
+  db        *Database
+  seq       int32
+  closed    int32
+  hlock     sync.Mutex
+  commit    []func()
+  rollback  []func(error)
+  failed    error // set when the transaction can no longer be committed
+}
+
+// A failure to roll back to a savepoint after the handler executed within it
+// failed. The enclosing transaction can no longer be committed and is rolled
+// back when it completes. The error matches, via errors.Is and errors.As, both
+// the handler's error and the rollback failure.
+type SavepointError struct {
+  Savepoint string
+  Cause     error // the handler's error
+  Rollback  error // the failure to roll back to the savepoint
+}
+
+func (e *SavepointError) Error() string {
+  return fmt.Sprintf("%v (could not roll back to savepoint %s: %v)", e.Cause, e.Savepoint, e.Rollback)
+}
+
+func (e *SavepointError) Unwrap() []error {
+  return []error{e.Cause, e.Rollback}
+}
+
+// Create a transaction context
+func newTx(db *Database, tx *sql.Tx, cxt Context) *Tx {
+  return &Tx{tx:tx, cxt:cxt, db:db}
+}
+
+// Obtain the transaction associated with a context.Context, if any
+func txFromContext(ctx context.Context) *Tx {
+  if ctx == nil {
+    return nil
+  }
+  if t, ok := ctx.Value(txContextKey{}).(*Tx); ok && !t.isClosed() {
+    return t
+  }
+  return nil
+}
+
+// Obtain the transaction underlying an execution context, if any
+func Transactional(cxt Context) (*Tx, bool) {
+  for cxt != nil {
+    switch c := cxt.(type) {
+      case *Tx:
+        return c, !c.isClosed()
+      case Wrapper:
+        cxt = c.Unwrap()
+      default:
+        return nil, false
+    }
+  }
+  return nil, false
+}
+
+// Determine if the transaction has been committed or rolled back
+func (t *Tx) isClosed() bool {
+  return atomic.LoadInt32(&t.closed) != 0
+}
+
+// Mark the transaction as committed or rolled back
+func (t *Tx) close() {
+  atomic.StoreInt32(&t.closed, 1)
+}
+
+// Register a hook to run after the transaction is committed. Hooks run in the
+// order they are registered.
+func (t *Tx) OnCommit(f func()) {
+  t.hlock.Lock()
+  defer t.hlock.Unlock()
+  t.commit = append(t.commit, f)
+}
+
+// Register a hook to run after the transaction is rolled back. The hook receives
+// the error which caused the rollback. Hooks run in the order they are registered.
+func (t *Tx) OnRollback(f func(error)) {
+  t.hlock.Lock()
+  defer t.hlock.Unlock()
+  t.rollback = append(t.rollback, f)
+}
+
+// Obtain the current number of registered hooks
+func (t *Tx) hooks() (int, int) {
+  t.hlock.Lock()
+  defer t.hlock.Unlock()
+  return len(t.commit), len(t.rollback)
+}
+
+// Mark the transaction as failed; it will be rolled back instead of committed
+func (t *Tx) fail(err error) {
+  t.hlock.Lock()
+  defer t.hlock.Unlock()
+  if t.failed == nil {
+    t.failed = err
+  }
+}
+
+// Obtain the failure which prevents the transaction from being committed, if any
+func (t *Tx) failure() error {
+  t.hlock.Lock()
+  defer t.hlock.Unlock()
+  return t.failed
+}
+
+// Unwind hooks registered after the provided marks: commit hooks are discarded and
+// rollback hooks are run with the provided error.
+func (t *Tx) unwind(nc, nr int, err error) {
+  t.hlock.Lock()
+  f := append([]func(error){}, t.rollback[nr:]...)
+  t.commit, t.rollback = t.commit[:nc], t.rollback[:nr]
+  t.hlock.Unlock()
+  for _, e := range f {
+    e(err)
+  }
+}
+
+// Run commit hooks if the transaction was committed, which is the case if the
+// provided error is nil, or rollback hooks otherwise.
+func (t *Tx) finish(err error) {
+  t.hlock.Lock()
+  commit, rollback := t.commit, t.rollback
+  t.commit, t.rollback = nil, nil
+  t.hlock.Unlock()
+  if err == nil {
+    for _, e := range commit {
+      e()
+    }
+  }else{
+    for _, e := range rollback {
+      e(err)
+    }
+  }
+}
+
+// Implement Wrapper
+func (t *Tx) Unwrap() Context {
+  return t.cxt
+}
+
+// Obtain the dialect of the transaction's database
+func (t *Tx) Dialect() Dialect {
+  return t.db.dialect
+}
+
+// Execute in a savepoint. A savepoint is established and the handler is invoked.
+// If the handler returns a non-nil error the transaction is rolled back to the
+// savepoint, undoing only the work performed by the handler, and the error is
+// returned; the enclosing transaction may continue. Otherwise the savepoint is
+// released. If the transaction cannot be rolled back to the savepoint, a
+// *SavepointError is returned and the enclosing transaction is rolled back when
+// it completes, even if its handler succeeds.
+func (t *Tx) Savepoint(ctx context.Context, h TransactionHandler) error {
+  n := fmt.Sprintf("godb_savepoint_%d", atomic.AddInt32(&t.seq, 1))
+  
+  _, err := t.cxt.ExecContext(ctx, "SAVEPOINT "+ n)
+  if err != nil {
+    return NewErrorWithDialect(t.db.dialect, "savepoint", err)
+  }
+  
+  nc, nr := t.hooks()
+  err = h(BindContext(context.WithValue(ctx, txContextKey{}, t), t))
+  if err != nil {
+    if _, serr := t.cxt.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+ n); serr != nil {
+      t.db.log.Log(ctx, LevelError, "store: Could not rollback to savepoint", Fields{"savepoint": n, FieldError: serr})
+      err = &SavepointError{n, err, NewErrorWithDialect(t.db.dialect, "savepoint", serr)}
+      t.fail(err)
+    }
+    t.unwind(nc, nr, err)
+    return err
+  }
+  
+  _, err = t.cxt.ExecContext(ctx, "RELEASE SAVEPOINT "+ n)
+  if err != nil {
+    return NewErrorWithDialect(t.db.dialect, "savepoint", err)
+  }
+  
+  return nil
+}
+
+// Register a hook to run after the transaction underlying the provided context
+// is committed. If the context is not a transaction its statements have already
+// been committed and the hook is run immediately.
+func OnCommit(cxt Context, f func()) {
+  if tx, ok := Transactional(cxt); ok {
+    tx.OnCommit(f)
+  }else{
+    f()
+  }
+}
+
+// Register a hook to run after the transaction underlying the provided context
+// is rolled back. If the context is not a transaction it cannot be rolled back
+// and the hook is discarded.
+func OnRollback(cxt Context, f func(error)) {
+  if tx, ok := Transactional(cxt); ok {
+    tx.OnRollback(f)
+  }
+}
+
+// Implement Context
+func (t *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+  r, err := t.cxt.Exec(query, args...)
+  return r, NewErrorWithDialect(t.db.dialect, "exec", err)
+}
+
+// Implement Context
+func (t *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+  r, err := t.cxt.Query(query, args...)
+  return r, NewErrorWithDialect(t.db.dialect, "query", err)
+}
+
+// Implement Context
+func (t *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+  return t.cxt.QueryRow(query, args...)
+}
+
+// Implement Context
+func (t *Tx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+  ctx, span := startStatement(ctx, t.db.tracer, "exec", query)
+  r, err := t.cxt.ExecContext(ctx, query, args...)
+  err = NewErrorWithDialect(t.db.dialect, "exec", err)
+  span.Finish(err)
+  return r, err
+}
+
+// Implement Context
+func (t *Tx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+  ctx, span := startStatement(ctx, t.db.tracer, "query", query)
+  r, err := t.cxt.QueryContext(ctx, query, args...)
+  err = NewErrorWithDialect(t.db.dialect, "query", err)
+  span.Finish(err)
+  return r, err
+}
+
+// Implement Context. As with Database.QueryRowContext, errors reported by the
+// row are not classified.
+func (t *Tx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+  ctx, span := startStatement(ctx, t.db.tracer, "query", query)
+  r := t.cxt.QueryRowContext(ctx, query, args...)
+  span.Finish(NewErrorWithDialect(t.db.dialect, "query", r.Err()))
+  return r
+}
@@ -0,0 +1,164 @@
+package godb_test
+
+import (
+  "fmt"
+  "errors"
+  "strings"
+  "testing"
+  "database/sql"
+  "database/sql/driver"
+  
+  "github.com/hirepurpose/godb"
+  "github.com/hirepurpose/godb/test"
+)
+
+import (
+  "github.com/stretchr/testify/assert"
+)
+
+func TestSavepointHooks(t *testing.T) {
+  f := test.NewFakeDB("tx_savepoint_hooks", nil)
+  db, err := test.NewFakeDatabase(godb.Options{}, f)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  defer db.Close()
+  
+  errFail := errors.New("Failed")
+  var events []string
+  
+  err = db.Transaction(func(cxt godb.Context) error {
+    godb.OnCommit(cxt, func(){ events = append(events, "outer commit") })
+    godb.OnRollback(cxt, func(error){ events = append(events, "outer rollback") })
+    
+    err := db.Atomic(cxt, func(cxt godb.Context) error {
+      godb.OnCommit(cxt, func(){ events = append(events, "failed commit") })
+      godb.OnRollback(cxt, func(err error){ events = append(events, "failed rollback: "+ err.Error()) })
+      return errFail
+    })
+    assert.Equal(t, errFail, err)
+    // rollback hooks registered in the savepoint run as soon as it is rolled back
+    assert.Equal(t, []string{"failed rollback: Failed"}, events)
+    
+    return db.Atomic(cxt, func(cxt godb.Context) error {
+      godb.OnCommit(cxt, func(){ events = append(events, "released commit") })
+      godb.OnRollback(cxt, func(error){ events = append(events, "released rollback") })
+      return nil
+    })
+  })
+  assert.Nil(t, err, fmt.Sprint(err))
+  
+  // commit hooks registered in the rolled back savepoint are discarded; those in
+  // the released savepoint run with the enclosing transaction's
+  assert.Equal(t, []string{"failed rollback: Failed", "outer commit", "released commit"}, events)
+  assert.Equal(t, []string{
+    "BEGIN",
+    "SAVEPOINT godb_savepoint_1",
+    "ROLLBACK TO SAVEPOINT godb_savepoint_1",
+    "SAVEPOINT godb_savepoint_2",
+    "RELEASE SAVEPOINT godb_savepoint_2",
+    "COMMIT",
+  }, f.Statements())
+}
+
+func TestSavepointRollbackFailure(t *testing.T) {
+  errRollback := errors.New("Connection lost")
+  f := test.NewFakeDB("tx_savepoint_failure", func(q string, args []driver.Value) (*test.FakeResult, error) {
+    if strings.HasPrefix(q, "ROLLBACK TO SAVEPOINT") {
+      return nil, errRollback
+    }
+    return nil, nil
+  })
+  db, err := test.NewFakeDatabase(godb.Options{}, f)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  defer db.Close()
+  
+  errFail := errors.New("Failed")
+  var events []string
+  
+  err = db.Transaction(func(cxt godb.Context) error {
+    godb.OnCommit(cxt, func(){ events = append(events, "outer commit") })
+    godb.OnRollback(cxt, func(error){ events = append(events, "outer rollback") })
+    
+    err := db.Atomic(cxt, func(cxt godb.Context) error {
+      return errFail
+    })
+    var serr *godb.SavepointError
+    if assert.True(t, errors.As(err, &serr), fmt.Sprint(err)) {
+      assert.Equal(t, "godb_savepoint_1", serr.Savepoint)
+    }
+    assert.True(t, errors.Is(err, errFail))
+    assert.True(t, errors.Is(err, errRollback))
+    
+    return nil // ignore the failure; the transaction must not be committed anyway
+  })
+  assert.True(t, errors.Is(err, errFail), fmt.Sprint(err))
+  assert.True(t, errors.Is(err, errRollback), fmt.Sprint(err))
+  
+  assert.Equal(t, []string{"outer rollback"}, events)
+  assert.Equal(t, []string{
+    "BEGIN",
+    "SAVEPOINT godb_savepoint_1",
+    "ROLLBACK TO SAVEPOINT godb_savepoint_1",
+    "ROLLBACK",
+  }, f.Statements())
+}
+
+func TestDeferrable(t *testing.T) {
+  f := test.NewFakeDB("tx_deferrable", nil)
+  
+  tests := []struct {
+    Dialect     godb.Dialect
+    Options     godb.TxOptions
+    Deferrable  bool
+  }{
+    {godb.Postgres, godb.TxOptions{Isolation:sql.LevelSerializable, ReadOnly:true, Deferrable:true}, true},
+    {godb.Postgres, godb.TxOptions{Isolation:sql.LevelSerializable, ReadOnly:true}, false},
+    {godb.Postgres, godb.TxOptions{Isolation:sql.LevelSerializable, Deferrable:true}, false},
+    {godb.Postgres, godb.TxOptions{Isolation:sql.LevelRepeatableRead, ReadOnly:true, Deferrable:true}, false},
+    {godb.Postgres, godb.TxOptions{ReadOnly:true, Deferrable:true}, false},
+    {godb.SQLite, godb.TxOptions{Isolation:sql.LevelSerializable, ReadOnly:true, Deferrable:true}, false},
+    {godb.MySQL, godb.TxOptions{Isolation:sql.LevelSerializable, ReadOnly:true, Deferrable:true}, false},
+  }
+  for i, e := range tests {
+    db, err := test.NewFakeDatabase(godb.Options{Dialect:e.Dialect}, f)
+    if !assert.Nil(t, err, fmt.Sprint(err)) {
+      return
+    }
+    f.Reset()
+    err = db.TransactionWithOptions(e.Options, func(cxt godb.Context) error { return nil })
+    assert.Nil(t, err, fmt.Sprint(err))
+    if e.Deferrable {
+      assert.Equal(t, []string{"BEGIN", "SET TRANSACTION DEFERRABLE", "COMMIT"}, f.Statements(), fmt.Sprint(i))
+    }else{
+      assert.Equal(t, []string{"BEGIN", "COMMIT"}, f.Statements(), fmt.Sprint(i))
+    }
+    db.Close()
+  }
+}
+
+func TestTransactionStatementCache(t *testing.T) {
+  f := test.NewFakeDB("tx_stmt_cache", nil)
+  db, err := test.NewFakeDatabase(godb.Options{}, f)
+  if !assert.Nil(t, err, fmt.Sprint(err)) {
+    return
+  }
+  defer db.Close()
+  
+  err = db.Transaction(func(cxt godb.Context) error {
+    for i := 0; i < 5; i++ {
+      _, err := cxt.Exec("UPDATE counter SET n = $1", i)
+      if err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  assert.Nil(t, err, fmt.Sprint(err))
+  // prepared once on the pool and once on the transaction's connection, however
+  // many times it is used
+  assert.Equal(t, 2, f.Prepared())
+  assert.Equal(t, 7, len(f.Statements()))
+}